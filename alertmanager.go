@@ -0,0 +1,245 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// alertmanagerResolvedRetention is the time during which resolved alarms are
+// sent again, in case an Alertmanager missed them.
+const alertmanagerResolvedRetention = 15 * time.Minute
+
+// deviceAlarms names the alarms of the status word, as alert names and
+// summaries.
+var deviceAlarms = map[int][2]string{
+	StatusOverVoltage:           {"SBMSCellOverVoltage", "A cell is over voltage"},
+	StatusOverVoltageLock:       {"SBMSCellOverVoltageLock", "Charging is locked after a cell over voltage"},
+	StatusUnderVoltage:          {"SBMSCellUnderVoltage", "A cell is under voltage"},
+	StatusUnderVoltageLock:      {"SBMSCellUnderVoltageLock", "Discharging is locked after a cell under voltage"},
+	StatusInternalOverTemp:      {"SBMSInternalOverTemperature", "The internal temperature is too high"},
+	StatusChargeOverCurrent:     {"SBMSChargeOverCurrent", "The charge current is too high"},
+	StatusDischargeOverCurrent:  {"SBMSDischargeOverCurrent", "The discharge current is too high"},
+	StatusDischargeShortCircuit: {"SBMSDischargeShortCircuit", "The discharge is short-circuited"},
+	StatusCellFailure:           {"SBMSCellFailure", "A cell failed"},
+	StatusOpenCellWire:          {"SBMSOpenCellWire", "A cell wire is open"},
+	StatusLowVoltageCutoff:      {"SBMSLowVoltageCutoff", "The low voltage cutoff tripped"},
+	StatusEEPROMFailure:         {"SBMSEEPROMFailure", "The EEPROM failed"},
+}
+
+// AlertmanagerConfig configures an AlertmanagerClient.
+type AlertmanagerConfig struct {
+	// URLs are the base URLs of the Alertmanagers, e.g.
+	// http://alertmanager:9093.
+	URLs []string
+	// Labels are added to every alert, e.g. to tell the devices apart.
+	Labels map[string]string
+	// Interval is the time between two sends of the active alarms. They
+	// expire after four intervals without a send.
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// AlertmanagerClient sends the alarms reported by the device in its status
+// word, see StatusAlarms, to the Alertmanager v2 API.
+type AlertmanagerClient struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	cfg    AlertmanagerConfig
+	client *http.Client
+
+	up     bool
+	alarms map[int]*deviceAlarm
+}
+
+type deviceAlarm struct {
+	startsAt time.Time
+	// endsAt is the time the alarm cleared, zero while it is active.
+	endsAt time.Time
+}
+
+// amAlert is an alert as posted to /api/v2/alerts.
+type amAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// NewAlertmanagerClient returns a client for cfg.
+func NewAlertmanagerClient(cfg AlertmanagerConfig) *AlertmanagerClient {
+	return &AlertmanagerClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		now:    time.Now,
+		alarms: map[int]*deviceAlarm{},
+	}
+}
+
+// Run follows the alarms of the states received from sub until it is closed,
+// sending them as soon as one is raised or cleared and then every interval.
+// Alarms are not refreshed while the device is down, so they expire unless
+// it comes back with them still raised.
+func (c *AlertmanagerClient) Run(sub *Subscription) {
+	timer := time.NewTimer(c.interval())
+	defer timer.Stop()
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if c.update(st) {
+				c.send()
+			}
+		case <-timer.C:
+			c.send()
+			timer.Reset(c.interval())
+		}
+	}
+}
+
+// Reload replaces the configuration of the client, applied from the next
+// send on. Reload waits for the alerts being sent.
+func (c *AlertmanagerClient) Reload(cfg AlertmanagerConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg, c.client = cfg, &http.Client{Timeout: cfg.Timeout}
+}
+
+func (c *AlertmanagerClient) interval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg.Interval
+}
+
+// update records the alarms raised and cleared in st, telling whether any
+// was.
+func (c *AlertmanagerClient) update(st State) bool {
+	c.up = st.Up
+	if !st.Up {
+		return false
+	}
+
+	now, changed := c.now(), false
+	for _, bit := range statusAlarmBits() {
+		a := c.alarms[bit]
+		active := a != nil && a.endsAt.IsZero()
+		raised := st.Values.Status&bit != 0
+		switch {
+		case raised && !active:
+			log.Warnf("Device alarm %s raised", deviceAlarms[bit][0])
+			c.alarms[bit] = &deviceAlarm{startsAt: now}
+			changed = true
+		case !raised && active:
+			log.Infof("Device alarm %s cleared", deviceAlarms[bit][0])
+			a.endsAt = now
+			changed = true
+		}
+	}
+	return changed
+}
+
+// alerts returns the alerts to send at now, forgetting the alarms resolved
+// long ago.
+func (c *AlertmanagerClient) alerts(now time.Time) []amAlert {
+	alerts := []amAlert{}
+	for _, bit := range statusAlarmBits() {
+		a := c.alarms[bit]
+		if a == nil {
+			continue
+		}
+		endsAt := a.endsAt
+		switch {
+		case endsAt.IsZero() && !c.up:
+			continue
+		case endsAt.IsZero():
+			endsAt = now.Add(4 * c.cfg.Interval)
+		case now.Sub(endsAt) >= alertmanagerResolvedRetention:
+			delete(c.alarms, bit)
+			continue
+		}
+
+		labels := map[string]string{}
+		for k, v := range c.cfg.Labels {
+			labels[k] = v
+		}
+		labels["alertname"] = deviceAlarms[bit][0]
+		labels["flag"] = statusFlagNamesOf(bit)[0]
+		labels["severity"] = "critical"
+		alerts = append(alerts, amAlert{
+			Labels:      labels,
+			Annotations: map[string]string{"summary": deviceAlarms[bit][1]},
+			StartsAt:    a.startsAt,
+			EndsAt:      endsAt,
+		})
+	}
+	return alerts
+}
+
+// statusAlarmBits returns the bits of StatusAlarms, in order.
+func statusAlarmBits() []int {
+	var bits []int
+	for i := range statusFlagNames {
+		if bit := 1 << uint(i); StatusAlarms&bit != 0 {
+			bits = append(bits, bit)
+		}
+	}
+	return bits
+}
+
+// send posts the alerts to every Alertmanager. Failures are not retried
+// beyond the next interval, which sends the alerts again.
+func (c *AlertmanagerClient) send() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	alerts := c.alerts(c.now())
+	if len(alerts) == 0 {
+		return
+	}
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		log.Errorln("Error encoding alerts:", err)
+		return
+	}
+	for _, u := range c.cfg.URLs {
+		if err := c.post(strings.TrimRight(u, "/")+"/api/v2/alerts", body); err != nil {
+			log.Errorf("Error sending alerts to %s: %v", u, err)
+		}
+	}
+}
+
+func (c *AlertmanagerClient) post(url string, body []byte) error {
+	res, err := c.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
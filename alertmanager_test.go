@@ -0,0 +1,122 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// alertmanagerServer records the alerts posted to it.
+type alertmanagerServer struct {
+	mu    sync.Mutex
+	posts [][]amAlert
+}
+
+func (s *alertmanagerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v2/alerts" {
+		http.NotFound(w, r)
+		return
+	}
+	var alerts []amAlert
+	if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.posts = append(s.posts, alerts)
+	s.mu.Unlock()
+}
+
+func TestAlertmanagerClient(t *testing.T) {
+	s := &alertmanagerServer{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	c := NewAlertmanagerClient(AlertmanagerConfig{
+		URLs:     []string{srv.URL + "/"},
+		Labels:   map[string]string{"instance": "cabin", "alertname": "ignored"},
+		Interval: time.Minute,
+		Timeout:  time.Second,
+	})
+	start := time.Date(2019, 11, 14, 12, 0, 0, 0, time.UTC)
+	now := start
+	c.now = func() time.Time { return now }
+
+	v := new(Values)
+	if err := v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(")); err != nil {
+		t.Fatal(err)
+	}
+	alarm := *v
+	alarm.Status |= StatusOverVoltage
+	ov := func(endsAt time.Time) amAlert {
+		return amAlert{
+			Labels:      map[string]string{"alertname": "SBMSCellOverVoltage", "flag": "OV", "severity": "critical", "instance": "cabin"},
+			Annotations: map[string]string{"summary": "A cell is over voltage"},
+			StartsAt:    start,
+			EndsAt:      endsAt,
+		}
+	}
+
+	step := func(st *State) {
+		t.Helper()
+		if st == nil || c.update(*st) {
+			c.send()
+		}
+	}
+	// No alarm, nothing to send.
+	step(&State{Up: true, Values: *v})
+	step(nil)
+	// Raised, then refreshed every interval.
+	step(&State{Up: true, Values: alarm})
+	now = now.Add(time.Minute)
+	step(&State{Up: true, Values: alarm})
+	step(nil)
+	// Not refreshed while the device is down.
+	now = now.Add(time.Minute)
+	step(&State{Up: false, Values: alarm})
+	step(nil)
+	// Back up with the alarm, refreshed again.
+	now = now.Add(time.Minute)
+	step(&State{Up: true, Values: alarm})
+	step(nil)
+	// Cleared, resolved until the retention passes.
+	now = now.Add(time.Minute)
+	cleared := now
+	step(&State{Up: true, Values: *v})
+	now = now.Add(time.Minute)
+	step(nil)
+	now = now.Add(alertmanagerResolvedRetention)
+	step(nil)
+
+	want := [][]amAlert{
+		{ov(start.Add(4 * time.Minute))},
+		{ov(start.Add(5 * time.Minute))},
+		{ov(start.Add(7 * time.Minute))},
+		{ov(cleared)},
+		{ov(cleared)},
+	}
+	if diff := cmp.Diff(want, s.posts); diff != "" {
+		t.Errorf("posted alerts differ (-want +got):\n%s", diff)
+	}
+	if len(c.alarms) != 0 {
+		t.Errorf("got %d alarms after the retention, want none", len(c.alarms))
+	}
+}
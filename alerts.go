@@ -0,0 +1,272 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+)
+
+// alertHistorySize is the number of firing and resolved events kept.
+const alertHistorySize = 100
+
+// defaultAlertSeverity is the severity of rules without one.
+const defaultAlertSeverity = "warning"
+
+// Alert states.
+const (
+	AlertInactive = "inactive"
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertsConfig is the content of an alert rules file.
+type AlertsConfig struct {
+	Rules []AlertRule `yaml:"rules"`
+}
+
+// AlertRule fires an alert once its expression, see Expr, held for For.
+type AlertRule struct {
+	Alert       string        `yaml:"alert"`
+	Expr        string        `yaml:"expr"`
+	For         time.Duration `yaml:"for"`
+	Severity    string        `yaml:"severity"`
+	Description string        `yaml:"description"`
+}
+
+// LoadAlertsFile reads and validates an alert rules file.
+func LoadAlertsFile(path string) (*AlertsConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &AlertsConfig{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, err
+	}
+	if _, err := compileAlertRules(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func compileAlertRules(cfg *AlertsConfig) ([]*alertRule, error) {
+	var rules []*alertRule
+	names := map[string]bool{}
+	for i, r := range cfg.Rules {
+		if r.Alert == "" {
+			return nil, fmt.Errorf("rule %d has no alert name", i+1)
+		}
+		if names[r.Alert] {
+			return nil, fmt.Errorf("duplicate alert %q", r.Alert)
+		}
+		names[r.Alert] = true
+		expr, err := ParseExpr(r.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("alert %q: %v", r.Alert, err)
+		}
+		if r.Severity == "" {
+			r.Severity = defaultAlertSeverity
+		}
+		rules = append(rules, &alertRule{AlertRule: r, expr: expr, state: AlertInactive})
+	}
+	return rules, nil
+}
+
+// AlertEngine evaluates alert rules on every line read from the device and
+// serves the active alerts and their history.
+type AlertEngine struct {
+	now    func() time.Time
+	active *prometheus.GaugeVec
+
+	mu      sync.RWMutex
+	rules   []*alertRule
+	history []AlertEvent
+}
+
+type alertRule struct {
+	AlertRule
+	expr *Expr
+
+	state    string
+	activeAt time.Time
+	firedAt  time.Time
+	value    float64
+}
+
+// Alert is an alert pending or firing, as served by the API.
+type Alert struct {
+	Name        string     `json:"name"`
+	Severity    string     `json:"severity"`
+	Description string     `json:"description,omitempty"`
+	Expr        string     `json:"expr"`
+	State       string     `json:"state"`
+	ActiveAt    time.Time  `json:"activeAt"`
+	FiredAt     *time.Time `json:"firedAt,omitempty"`
+	Value       float64    `json:"value"`
+}
+
+// AlertEvent is an alert firing or resolving, as served by the API.
+type AlertEvent struct {
+	Name     string    `json:"name"`
+	Severity string    `json:"severity"`
+	State    string    `json:"state"`
+	Time     time.Time `json:"time"`
+	Value    float64   `json:"value"`
+}
+
+// NewAlertEngine returns an engine evaluating the rules of cfg, which must
+// have been validated, registering sbms_alert_active with reg.
+func NewAlertEngine(cfg *AlertsConfig, reg prometheus.Registerer) (*AlertEngine, error) {
+	e := &AlertEngine{
+		now: time.Now,
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sbms",
+			Subsystem: "alert",
+			Name:      "active",
+			Help:      "Whether the alert is firing.",
+		}, []string{"alertname"}),
+	}
+	if err := e.Reload(cfg); err != nil {
+		return nil, err
+	}
+	reg.MustRegister(e.active)
+	return e, nil
+}
+
+// Reload replaces the rules by those of cfg. Rules keep their state when
+// their name and expression are unchanged.
+func (e *AlertEngine) Reload(cfg *AlertsConfig) error {
+	rules, err := compileAlertRules(cfg)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := map[string]*alertRule{}
+	for _, r := range e.rules {
+		old[r.Alert] = r
+	}
+	for _, r := range rules {
+		if o := old[r.Alert]; o != nil && o.Expr == r.Expr {
+			r.state, r.activeAt, r.firedAt, r.value = o.state, o.activeAt, o.firedAt, o.value
+		}
+		delete(old, r.Alert)
+		e.active.WithLabelValues(r.Alert).Set(boolAsFloat(r.state == AlertFiring))
+	}
+	for name := range old {
+		e.active.DeleteLabelValues(name)
+	}
+	e.rules = rules
+	return nil
+}
+
+// Run evaluates the rules against the states received from sub until it is
+// closed.
+func (e *AlertEngine) Run(sub *Subscription) {
+	for st := range sub.C {
+		e.evaluate(st)
+	}
+}
+
+func (e *AlertEngine) evaluate(st State) {
+	now := e.now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range e.rules {
+		// Rules on the values keep their state while the device is down,
+		// the values being the ones of the last frame.
+		if !st.Up && r.expr.values {
+			continue
+		}
+
+		value := r.expr.Eval(&st)
+		switch {
+		case value == 0 && r.state == AlertFiring:
+			log.Infof("Alert %s resolved", r.Alert)
+			e.record(r, AlertResolved, now, value)
+			r.state = AlertInactive
+		case value == 0:
+			r.state = AlertInactive
+		case r.state == AlertInactive:
+			r.state, r.activeAt = AlertPending, now
+		}
+		r.value = value
+
+		if r.state == AlertPending && now.Sub(r.activeAt) >= r.For {
+			log.Warnf("Alert %s firing, %s is %v", r.Alert, r.Expr, value)
+			r.state, r.firedAt = AlertFiring, now
+			e.record(r, AlertFiring, now, value)
+		}
+		e.active.WithLabelValues(r.Alert).Set(boolAsFloat(r.state == AlertFiring))
+	}
+}
+
+func (e *AlertEngine) record(r *alertRule, state string, t time.Time, value float64) {
+	e.history = append(e.history, AlertEvent{Name: r.Alert, Severity: r.Severity, State: state, Time: t, Value: value})
+	if len(e.history) > alertHistorySize {
+		e.history = e.history[len(e.history)-alertHistorySize:]
+	}
+}
+
+type apiAlerts struct {
+	Alerts  []Alert      `json:"alerts"`
+	History []AlertEvent `json:"history"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// ServeHTTP serves the pending and firing alerts, and the last firing and
+// resolved events, oldest first.
+func (e *AlertEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, apiAlerts{Error: "method not allowed"})
+		return
+	}
+
+	e.mu.RLock()
+	res := apiAlerts{Alerts: []Alert{}, History: append([]AlertEvent{}, e.history...)}
+	for _, r := range e.rules {
+		if r.state == AlertInactive {
+			continue
+		}
+		a := Alert{
+			Name:        r.Alert,
+			Severity:    r.Severity,
+			Description: r.Description,
+			Expr:        r.Expr,
+			State:       r.state,
+			ActiveAt:    r.activeAt,
+			Value:       r.value,
+		}
+		if r.state == AlertFiring {
+			firedAt := r.firedAt
+			a.FiredAt = &firedAt
+		}
+		res.Alerts = append(res.Alerts, a)
+	}
+	e.mu.RUnlock()
+
+	writeJSON(w, http.StatusOK, res)
+}
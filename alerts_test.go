@@ -0,0 +1,170 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAlertEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.yml")
+	err = ioutil.WriteFile(path, []byte(`
+rules:
+  - alert: LowStateOfCharge
+    expr: state_of_charge < 50
+    for: 1m
+    severity: critical
+    description: The battery is below half.
+  - alert: CellImbalance
+    expr: cell_spread > 0.005
+  - alert: DeviceDown
+    expr: not up
+    for: 30s
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadAlertsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewAlertEngine(cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := new(Values)
+	if err := v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(")); err != nil {
+		t.Fatal(err)
+	}
+	low := *v
+	low.StateOfCharge = 40
+
+	start := time.Date(2019, 11, 14, 12, 0, 0, 0, time.UTC)
+	for _, s := range []struct {
+		after time.Duration
+		st    State
+	}{
+		{0, State{Up: true, Values: *v}},
+		{10 * time.Second, State{Up: false, Values: *v}},
+		{50 * time.Second, State{Up: false, Values: *v}},
+		{60 * time.Second, State{Up: true, Values: low}},
+	} {
+		e.now = func() time.Time { return start.Add(s.after) }
+		e.evaluate(s.st)
+	}
+
+	for name, want := range map[string]float64{"LowStateOfCharge": 0, "CellImbalance": 1, "DeviceDown": 0} {
+		if got := testutil.ToFloat64(e.active.WithLabelValues(name)); got != want {
+			t.Errorf("unexpected sbms_alert_active of %s: got %v, want %v", name, got, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/alerts", nil))
+	golden := `testdata/alerts.json`
+	if *update {
+		if err := ioutil.WriteFile(golden, rec.Body.Bytes(), 0644); err != nil {
+			t.Fatalf("unexpected error: %q", err)
+		}
+	}
+	want, _ := ioutil.ReadFile(golden)
+	if diff := cmp.Diff(string(want), rec.Body.String()); diff != "" {
+		t.Errorf("response does not match golden file %s (-want +got):\n%s", golden, diff)
+	}
+}
+
+func TestAlertEngineReload(t *testing.T) {
+	e, err := NewAlertEngine(&AlertsConfig{Rules: []AlertRule{
+		{Alert: "Down", Expr: "not up"},
+		{Alert: "Low", Expr: "state_of_charge < 20"},
+	}}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.evaluate(State{Up: false})
+
+	// Down keeps firing, Low changed and starts over.
+	err = e.Reload(&AlertsConfig{Rules: []AlertRule{
+		{Alert: "Down", Expr: "not up", Severity: "critical"},
+		{Alert: "Low", Expr: "state_of_charge < 30"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{AlertFiring, AlertInactive} {
+		if r := e.rules[i]; r.state != want {
+			t.Errorf("got %s %s after reload, want %s", r.Alert, r.state, want)
+		}
+	}
+	if e.rules[0].Severity != "critical" {
+		t.Errorf("got severity %q after reload, want critical", e.rules[0].Severity)
+	}
+	if got := testutil.ToFloat64(e.active.WithLabelValues("Down")); got != 1 {
+		t.Errorf("got sbms_alert_active of Down %v, want 1", got)
+	}
+
+	if err := e.Reload(&AlertsConfig{Rules: []AlertRule{{Alert: "Low", Expr: "soc"}}}); err == nil {
+		t.Error("got no error reloading an invalid rule")
+	}
+	if len(e.rules) != 2 {
+		t.Errorf("got %d rules after a failed reload, want 2", len(e.rules))
+	}
+}
+
+func TestLoadAlertsFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.yml")
+
+	testCases := []struct {
+		desc    string
+		content string
+		err     string
+	}{
+		{"no name", `rules: [{expr: up}]`, `rule 1 has no alert name`},
+		{"duplicate", `rules: [{alert: A, expr: up}, {alert: A, expr: up}]`, `duplicate alert "A"`},
+		{"bad expression", `rules: [{alert: A, expr: soc < 20}]`, `alert "A": unknown identifier "soc"`},
+		{"unknown key", `rules: [{alert: A, expr: up, labels: {}}]`, `field labels not found`},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, []byte(tC.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadAlertsFile(path)
+			if err == nil || !strings.Contains(err.Error(), tC.err) {
+				t.Errorf("unexpected error: got %v, want %q", err, tC.err)
+			}
+		})
+	}
+}
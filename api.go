@@ -0,0 +1,76 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+type apiValues struct {
+	Up       bool                 `json:"up"`
+	Date     *time.Time           `json:"date,omitempty"`
+	Received *time.Time           `json:"received,omitempty"`
+	Values   map[string]fieldJSON `json:"values,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+// NewAPIHandler returns the handler serving the JSON API under /api/v1/.
+func NewAPIHandler(exp *Exporter) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/values", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSON(w, http.StatusMethodNotAllowed, apiValues{Error: "method not allowed"})
+			return
+		}
+
+		res := newAPIValues(exp.State())
+		if !res.Up {
+			writeJSON(w, http.StatusServiceUnavailable, res)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+	mux.Handle("/api/v1/stream", newStreamHandler(exp))
+	return mux
+}
+
+func newAPIValues(st State) apiValues {
+	if !st.Up {
+		res := apiValues{Error: "device is down"}
+		if !st.Received.IsZero() {
+			res.Date = &st.Values.Date
+			res.Received = &st.Received
+		}
+		return res
+	}
+	return apiValues{
+		Up:       true,
+		Date:     &st.Values.Date,
+		Received: &st.Received,
+		Values:   valuesJSON(&st.Values),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorln("Error writing API response:", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAPIValues(t *testing.T) {
+	exp := NewExporter(prometheus.NewRegistry())
+	exp.now = func() time.Time { return time.Date(2019, 11, 14, 23, 2, 11, 0, time.UTC) }
+	api := NewAPIHandler(exp)
+	wg := sync.WaitGroup{}
+	w, r := net.Pipe()
+
+	wg.Add(1)
+	go func() {
+		err := exp.Export(context.Background(), r)
+		if err != io.EOF {
+			t.Errorf("unexpected error: %q", err)
+		}
+		wg.Done()
+	}()
+
+	ensureAPIResponse(t, api, "GET", http.StatusServiceUnavailable, `{"up":false,"error":"device is down"}`+"\n")
+	receiveData(t, w, `testdata/example1.sbms`)
+	ensureAPIResponseGolden(t, api, http.StatusOK, `testdata/example1.api.json`)
+	receiveData(t, w, `testdata/too-short.sbms`)
+	ensureAPIResponse(t, api, "GET", http.StatusServiceUnavailable, `{"up":false,"date":"2016-04-24T15:41:33Z","received":"2019-11-14T23:02:11Z","error":"device is down"}`+"\n")
+	ensureAPIResponse(t, api, "POST", http.StatusMethodNotAllowed, `{"up":false,"error":"method not allowed"}`+"\n")
+
+	w.Close()
+	wg.Wait()
+}
+
+func ensureAPIResponse(t *testing.T, h http.Handler, method string, code int, want string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, "/api/v1/values", nil))
+
+	if got := rec.Code; got != code {
+		t.Errorf("unexpected status code: got %d, want %d", got, code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("unexpected content type: %q", got)
+	}
+	if diff := cmp.Diff(want, rec.Body.String()); diff != "" {
+		t.Errorf("body mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func ensureAPIResponseGolden(t *testing.T, h http.Handler, code int, golden string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/values", nil))
+
+	if *update {
+		if err := ioutil.WriteFile(golden, rec.Body.Bytes(), 0644); err != nil {
+			t.Fatalf("unexpected error: %q", err)
+		}
+	}
+	want, _ := ioutil.ReadFile(golden)
+	ensureAPIResponse(t, h, "GET", code, string(want))
+}
@@ -0,0 +1,334 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// configCommands are the commands whose flags can be set in a configuration
+// file.
+var configCommands = []string{"serve", "check-config"}
+
+// parseArgs parses the command line args. The flags of the serve and
+// check-config commands not given there take their value from the
+// configuration file, if any.
+func parseArgs(args []string) (*kingpin.Application, string, *options, error) {
+	o := &options{}
+	app := newApp(o)
+	command, err := app.Parse(args)
+	if err != nil || o.serve.configFile == "" {
+		o.serve.values = flagValues(app, command)
+		return app, command, o, err
+	}
+
+	settings, err := LoadConfigFile(o.serve.configFile, newApp(&options{}))
+	if err != nil {
+		return app, command, o, fmt.Errorf("error loading config file: %v", err)
+	}
+	o = &options{}
+	app = newApp(o)
+	for name, values := range settings {
+		for _, f := range configFlags(app, name) {
+			f.Default(values...)
+		}
+	}
+	command, err = app.Parse(args)
+	o.serve.values = flagValues(app, command)
+	return app, command, o, err
+}
+
+// LoadConfigFile reads a configuration file and returns the values of the
+// flags of app it sets, keyed by flag name. Keys of the file are flag names,
+// those of nested mappings being joined with dots, so that
+//
+//	mqtt:
+//	  broker: tcp://localhost:1883
+//	influxdb.tag:
+//	  site: cabin
+//
+// is --mqtt.broker=tcp://localhost:1883 --influxdb.tag=site=cabin.
+// Repeatable flags take sequences.
+func LoadConfigFile(path string, app *kingpin.Application) (map[string][]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var content map[interface{}]interface{}
+	if err := yaml.Unmarshal(b, &content); err != nil {
+		return nil, err
+	}
+	settings := map[string][]string{}
+	if err := flattenConfig(app, "", content, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func flattenConfig(app *kingpin.Application, prefix string, v interface{}, settings map[string][]string) error {
+	flags := configFlags(app, prefix)
+	m, isMap := v.(map[interface{}]interface{})
+	if isMap && len(flags) == 0 {
+		byName := map[string]interface{}{}
+		var names []string
+		for k, x := range m {
+			name := fmt.Sprint(k)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			byName[name] = x
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := flattenConfig(app, name, byName[name], settings); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(flags) == 0 {
+		return fmt.Errorf("unknown setting %q", prefix)
+	}
+
+	var values []string
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for k, x := range v {
+			values = append(values, fmt.Sprintf("%v=%s", k, configScalar(x)))
+		}
+		sort.Strings(values)
+	case []interface{}:
+		for _, x := range v {
+			values = append(values, configScalar(x))
+		}
+	default:
+		values = []string{configScalar(v)}
+	}
+
+	// Setting the values on app tells whether they are valid, app being
+	// thrown away once the file is read.
+	value := flags[0].Model().Value
+	if r, ok := value.(interface{ IsCumulative() bool }); (!ok || !r.IsCumulative()) && len(values) != 1 {
+		return fmt.Errorf("%s: expected a single value", prefix)
+	}
+	for _, x := range values {
+		if err := value.Set(x); err != nil {
+			return fmt.Errorf("%s: %v", prefix, err)
+		}
+	}
+	settings[prefix] = values
+	return nil
+}
+
+func configScalar(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// configFlags returns the flags of app a configuration file sets under name.
+func configFlags(app *kingpin.Application, name string) []*kingpin.FlagClause {
+	var flags []*kingpin.FlagClause
+	switch {
+	case name == "" || name == "config.file":
+	case strings.HasPrefix(name, "log."):
+		if f := app.GetFlag(name); f != nil {
+			flags = append(flags, f)
+		}
+	default:
+		for _, cmd := range configCommands {
+			if f := app.GetCommand(cmd).GetFlag(name); f != nil {
+				flags = append(flags, f)
+			}
+		}
+	}
+	return flags
+}
+
+// flagValues returns the values of the flags of command and of the logging
+// flags, keyed by name.
+func flagValues(app *kingpin.Application, command string) map[string]string {
+	values := map[string]string{}
+	var flags []*kingpin.FlagModel
+	if cmd := app.GetCommand(command); cmd != nil {
+		flags = cmd.Model().Flags
+	}
+	for _, f := range append(flags, app.Model().Flags...) {
+		if f.Value != nil {
+			values[f.Name] = f.Value.String()
+		}
+	}
+	return values
+}
+
+// Reloader re-reads the command line flags and the configuration file,
+// applying the changes to the web configuration, alert rules, hooks, webhook
+// and Alertmanager settings, and to the log level. Other changes need a
+// restart, the serial port in particular is never reopened.
+type Reloader struct {
+	args []string
+	// opts are the options the exporter was started with.
+	opts *serveOptions
+
+	web          *WebServer
+	alerts       *AlertEngine
+	hooks        *HookRunner
+	webhook      *WebhookNotifier
+	alertmanager *AlertmanagerClient
+	applyLogging func(level, format string) error
+
+	mu          sync.Mutex
+	success     prometheus.Gauge
+	successTime prometheus.Gauge
+}
+
+// NewReloader returns a reloader of the exporter started with the command
+// line args and the options o, registering the metrics of the reloads with
+// reg. The components to reload are set once created.
+func NewReloader(args []string, o *serveOptions, reg prometheus.Registerer) *Reloader {
+	r := &Reloader{
+		args:         args,
+		opts:         o,
+		applyLogging: applyLogging,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sbms",
+			Subsystem: "config",
+			Name:      "last_reload_successful",
+			Help:      "Whether the last configuration reload succeeded.",
+		}),
+		successTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sbms",
+			Subsystem: "config",
+			Name:      "last_reload_success_timestamp_seconds",
+			Help:      "The unix time of the last successful configuration reload.",
+		}),
+	}
+	reg.MustRegister(r.success, r.successTime)
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+	return r
+}
+
+// Reload reloads the configuration, leaving it untouched when it is
+// invalid.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log.Infoln("Reloading configuration")
+	if err := r.reload(); err != nil {
+		log.Errorln("Error reloading configuration:", err)
+		r.success.Set(0)
+		return err
+	}
+	log.Infoln("Configuration reloaded")
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+	return nil
+}
+
+func (r *Reloader) reload() error {
+	_, _, opts, err := parseArgs(r.args)
+	if err != nil {
+		return err
+	}
+	o := &opts.serve
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	var names []string
+	for name, value := range o.values {
+		if value != r.opts.values[name] && !r.reloadable(name, o) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Warnf("Ignoring the change of --%s, which needs a restart", name)
+	}
+
+	if r.web != nil && o.web != nil {
+		if err := r.web.Reload(o.web); err != nil {
+			return err
+		}
+	}
+	if r.alerts != nil && o.alerts != nil {
+		if err := r.alerts.Reload(o.alerts); err != nil {
+			return err
+		}
+	}
+	if r.hooks != nil && o.hooks != nil {
+		r.hooks.Reload(o.hooks)
+	}
+	if r.webhook != nil && len(o.webhook.URLs) > 0 {
+		if err := r.webhook.Reload(o.webhook); err != nil {
+			return err
+		}
+	}
+	if r.alertmanager != nil && len(o.alertmanager.URLs) > 0 {
+		r.alertmanager.Reload(o.alertmanager)
+	}
+	// Logging is applied last, so a failed reload logs as configured before.
+	if err := r.applyLogging(opts.logLevel, opts.logFormat); err != nil {
+		return err
+	}
+	r.opts.values = o.values
+	return nil
+}
+
+// reloadable tells whether a change of the flag name to the options o can
+// be applied without a restart. Components disabled at startup cannot be
+// enabled, nor enabled ones disabled.
+func (r *Reloader) reloadable(name string, o *serveOptions) bool {
+	switch {
+	case strings.HasPrefix(name, "log."):
+		return true
+	case name == "web.config.file":
+		return r.web != nil && o.web != nil
+	case name == "alerts.file":
+		return r.alerts != nil && o.alerts != nil
+	case name == "hooks.file":
+		return r.hooks != nil && o.hooks != nil
+	case strings.HasPrefix(name, "webhook."):
+		return r.webhook != nil && len(o.webhook.URLs) > 0
+	case strings.HasPrefix(name, "alertmanager."):
+		return r.alertmanager != nil && len(o.alertmanager.URLs) > 0
+	}
+	return false
+}
+
+// ServeHTTP reloads the configuration on POST requests.
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload configuration: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeConfigFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseArgsConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sbms.yml")
+	writeConfigFile(t, path, `
+serial-port: /dev/ttyUSB0
+mqtt:
+  broker: tcp://localhost:1883
+  topic-prefix: file
+  qos: 1
+influxdb.tag:
+  site: cabin
+  rack: 2
+webhook:
+  url:
+    - http://a
+    - http://b
+  timeout: 1m
+csv.max-size: 10MB
+`)
+
+	_, command, o, err := parseArgs([]string{"--config.file=" + path, "--mqtt.topic-prefix=cli"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command != "serve" {
+		t.Errorf("got command %q, want serve", command)
+	}
+	if err := o.serve.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &o.serve
+	if s.serialPort != "/dev/ttyUSB0" || s.mqtt.Broker != "tcp://localhost:1883" || s.mqtt.QoS != 1 {
+		t.Errorf("got serial port %q, broker %q and QoS %d from the file", s.serialPort, s.mqtt.Broker, s.mqtt.QoS)
+	}
+	if s.mqtt.TopicPrefix != "cli" {
+		t.Errorf("got topic prefix %q, want the one of the command line", s.mqtt.TopicPrefix)
+	}
+	if s.mqtt.ClientID != "sbms_exporter" {
+		t.Errorf("got client ID %q, want the default", s.mqtt.ClientID)
+	}
+	if diff := cmp.Diff(map[string]string{"site": "cabin", "rack": "2"}, s.influxDB.Tags); diff != "" {
+		t.Errorf("InfluxDB tags differ (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"http://a", "http://b"}, s.webhook.URLs); diff != "" {
+		t.Errorf("webhook URLs differ (-want +got):\n%s", diff)
+	}
+	if s.webhook.Timeout != time.Minute || s.csv.MaxSize != 10<<20 {
+		t.Errorf("got webhook timeout %v and CSV max size %d", s.webhook.Timeout, s.csv.MaxSize)
+	}
+
+	// check-config reads the same file.
+	_, command, o, err = parseArgs([]string{"check-config", "--config.file=" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command != "check-config" || o.serve.serialPort != "/dev/ttyUSB0" {
+		t.Errorf("got command %q and serial port %q", command, o.serve.serialPort)
+	}
+}
+
+func TestServeOptionsValidate(t *testing.T) {
+	for _, tC := range []struct {
+		desc string
+		args []string
+		err  string
+	}{
+		{"valid", nil, ""},
+		{"negative replay speed", []string{"--replay-speed=-1"}, `--replay-speed must not be negative`},
+		{"root telemetry path", []string{"--telemetry-path=/"}, `--telemetry-path "/" clashes`},
+		{"api telemetry path", []string{"--telemetry-path=/api/v1/"}, `--telemetry-path "/api/v1/" clashes`},
+		{"ready telemetry path", []string{"--telemetry-path=/-/ready"}, `--telemetry-path "/-/ready" clashes`},
+		{"relative telemetry path", []string{"--telemetry-path=metrics"}, `--telemetry-path "metrics" clashes`},
+		{"influxdb batch size", []string{"--influxdb.url=http://a", "--influxdb.batch-size=0"}, `--influxdb.batch-size must be at least 1`},
+		{"influxdb flush interval", []string{"--influxdb.url=http://a", "--influxdb.flush-interval=0s"}, `--influxdb.flush-interval must be positive`},
+		{"remote write batch size", []string{"--remote-write.url=http://a", "--remote-write.batch-size=0"}, `--remote-write.batch-size must be at least 1`},
+		{"remote write flush interval", []string{"--remote-write.url=http://a", "--remote-write.flush-interval=-1s"}, `--remote-write.flush-interval must be positive`},
+		{"remote write segment size", []string{"--remote-write.url=http://a", "--remote-write.segment-size=0B"}, `--remote-write.segment-size must be positive`},
+		{"remote write max segments", []string{"--remote-write.url=http://a", "--remote-write.max-segments=0"}, `--remote-write.max-segments must be at least 1`},
+		{"pushgateway interval", []string{"--pushgateway.url=http://a", "--pushgateway.interval=0s"}, `--pushgateway.interval must be positive`},
+		{"pushgateway grouping name", []string{"--pushgateway.url=http://a", "--pushgateway.grouping=cabin-id=1"}, `invalid --pushgateway.grouping label name "cabin-id"`},
+		{"pushgateway grouping job", []string{"--pushgateway.url=http://a", "--pushgateway.grouping=job=sbms"}, `invalid --pushgateway.grouping label name "job"`},
+		{"pushgateway grouping empty value", []string{"--pushgateway.url=http://a", "--pushgateway.grouping=instance="}, `invalid --pushgateway.grouping value "" of instance`},
+		{"pushgateway grouping slash", []string{"--pushgateway.url=http://a", "--pushgateway.grouping=instance=cabin/1"}, `invalid --pushgateway.grouping value "cabin/1" of instance`},
+		{"otlp interval", []string{"--otlp.endpoint=http://a", "--otlp.interval=0s"}, `--otlp.interval must be positive`},
+		{"webhook down after", []string{"--webhook.url=http://a", "--webhook.down-after=-1s"}, `--webhook.down-after must not be negative`},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, _, o, err := parseArgs(append([]string{"--serial-port=/dev/ttyUSB0"}, tC.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = o.serve.validate()
+			switch {
+			case tC.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tC.err != "" && (err == nil || !strings.Contains(err.Error(), tC.err)):
+				t.Errorf("got error %v, want %q", err, tC.err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sbms.yml")
+
+	for _, tC := range []struct {
+		desc    string
+		content string
+		err     string
+	}{
+		{"not yaml", `mqtt: [`, `yaml:`},
+		{"unknown", `mqtt: {brokr: x}`, `unknown setting "mqtt.brokr"`},
+		{"config file", `config.file: other.yml`, `unknown setting "config.file"`},
+		{"invalid enum", `mqtt.qos: 5`, `mqtt.qos: enum value must be one of 0,1,2, got '5'`},
+		{"invalid duration", `webhook.timeout: soon`, `webhook.timeout: time: invalid duration`},
+		{"list", `serial-port: [a, b]`, `serial-port: expected a single value`},
+		{"invalid map", `influxdb.tag: [site]`, `influxdb.tag: expected KEY=VALUE got 'site'`},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			writeConfigFile(t, path, tC.content)
+			_, err := LoadConfigFile(path, newApp(&options{}))
+			if err == nil || !strings.Contains(err.Error(), tC.err) {
+				t.Errorf("got error %v, want %q", err, tC.err)
+			}
+		})
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sbms.yml")
+	alertsPath := filepath.Join(dir, "alerts.yml")
+	writeConfigFile(t, path, "serial-port: /dev/ttyUSB0\nalerts.file: "+alertsPath+"\n")
+	writeConfigFile(t, alertsPath, "rules: [{alert: Low, expr: state_of_charge < 20}]")
+
+	args := []string{"--config.file=" + path}
+	_, _, o, err := parseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.serve.validate(); err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	r := NewReloader(args, &o.serve, reg)
+	if r.alerts, err = NewAlertEngine(o.serve.alerts, reg); err != nil {
+		t.Fatal(err)
+	}
+
+	reload := func(method string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, "/-/reload", nil))
+		return rec.Code
+	}
+	alertNames := func() []string {
+		var names []string
+		for _, rule := range r.alerts.rules {
+			names = append(names, rule.Alert)
+		}
+		return names
+	}
+
+	var levels []string
+	r.applyLogging = func(level, format string) error {
+		levels = append(levels, level)
+		return nil
+	}
+
+	writeConfigFile(t, path, "serial-port: /dev/ttyUSB0\nalerts.file: "+alertsPath+"\nlog.level: warn\n")
+	writeConfigFile(t, alertsPath, "rules: [{alert: Low, expr: state_of_charge < 20}, {alert: Down, expr: not up}]")
+	if code := reload(http.MethodPost); code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", code)
+	}
+	if diff := cmp.Diff([]string{"Low", "Down"}, alertNames()); diff != "" {
+		t.Errorf("alerts differ after reload (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"warn"}, levels); diff != "" {
+		t.Errorf("log levels differ after reload (-want +got):\n%s", diff)
+	}
+	if got := r.opts.values["log.level"]; got != "warn" {
+		t.Errorf("got log.level %q in the options after reload, want warn", got)
+	}
+
+	// An invalid configuration is not applied, the log level included.
+	writeConfigFile(t, path, "serial-port: /dev/ttyUSB0\nalerts.file: "+alertsPath+"\nlog.level: debug\n")
+	writeConfigFile(t, alertsPath, "rules: [{alert: Low, expr: state_of_charge <}]")
+	if code := reload(http.MethodPost); code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", code)
+	}
+	if diff := cmp.Diff([]string{"Low", "Down"}, alertNames()); diff != "" {
+		t.Errorf("alerts differ after a failed reload (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"warn"}, levels); diff != "" {
+		t.Errorf("log levels differ after a failed reload (-want +got):\n%s", diff)
+	}
+	if got := r.opts.values["log.level"]; got != "warn" {
+		t.Errorf("got log.level %q in the options after a failed reload, want warn", got)
+	}
+	if got := testutil.ToFloat64(r.success); got != 0 {
+		t.Errorf("got sbms_config_last_reload_successful %v, want 0", got)
+	}
+
+	if code := reload(http.MethodGet); code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for GET, want 405", code)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// csvBuffer is the number of frames the CSV logger can lag behind, which
+// covers a stalled disk for about an hour of frames.
+const csvBuffer = 1024
+
+// csvDateLayout is the date of the files, named sbms-2006-01-02.csv.
+const csvDateLayout = "2006-01-02"
+
+// CSVColumns returns the columns a CSVLogger can write: the host time at
+// which a frame was received followed by every field of decode, derived
+// ones included.
+func CSVColumns() []string {
+	columns := []string{"time"}
+	for _, f := range valuesFields {
+		columns = append(columns, f.name)
+	}
+	return columns
+}
+
+// CSVLogConfig configures a CSVLogger.
+type CSVLogConfig struct {
+	// Dir is the directory the files are written to.
+	Dir string
+	// Columns are the columns written, in order, among CSVColumns.
+	Columns []string
+	// Compress tells whether the files of past days are gzipped.
+	Compress bool
+	// MaxAge is the age past which the files of past days are deleted, and
+	// MaxSize the total size past which the oldest ones are. Zero keeps
+	// them.
+	MaxAge  time.Duration
+	MaxSize int64
+}
+
+// CSVLogger writes every decoded frame to a CSV file per day, named after
+// the local date at which frames were received.
+type CSVLogger struct {
+	cfg     CSVLogConfig
+	columns []func(st *State) string
+	now     func() time.Time
+
+	f    *os.File
+	w    *csv.Writer
+	day  string
+	wg   sync.WaitGroup
+	busy chan struct{}
+}
+
+// NewCSVLogger returns a logger writing to the directory of cfg, which is
+// created if needed.
+func NewCSVLogger(cfg CSVLogConfig) (*CSVLogger, error) {
+	l := &CSVLogger{cfg: cfg, now: time.Now, busy: make(chan struct{}, 1)}
+	for _, name := range cfg.Columns {
+		c := csvColumn(name)
+		if c == nil {
+			return nil, fmt.Errorf("unknown CSV column %q, want one of %s", name, strings.Join(CSVColumns(), ", "))
+		}
+		l.columns = append(l.columns, c)
+	}
+	if len(l.columns) == 0 {
+		return nil, fmt.Errorf("no CSV column")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Run writes the decoded frames received from sub until it is closed.
+// Compression and retention run aside, so a slow disk only ever delays the
+// writes; the exporter itself never waits on the logger.
+func (l *CSVLogger) Run(sub *Subscription) {
+	defer func() {
+		l.close()
+		l.wg.Wait()
+	}()
+
+	l.maintain()
+	for st := range sub.C {
+		if !st.Up {
+			continue
+		}
+		if err := l.write(&st); err != nil {
+			log.Errorln("Error writing CSV log:", err)
+		}
+	}
+}
+
+func (l *CSVLogger) write(st *State) error {
+	day := st.Received.Local().Format(csvDateLayout)
+	if day != l.day {
+		rotated := l.f != nil
+		l.close()
+		if err := l.open(day); err != nil {
+			return err
+		}
+		if rotated {
+			l.maintain()
+		}
+	}
+
+	record := make([]string, len(l.columns))
+	for i, c := range l.columns {
+		record[i] = c(st)
+	}
+	l.w.Write(record)
+	l.w.Flush()
+	return l.w.Error()
+}
+
+// open opens the file of day, writing the header when it is new.
+func (l *CSVLogger) open(day string) error {
+	f, err := os.OpenFile(filepath.Join(l.cfg.Dir, "sbms-"+day+".csv"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f, l.w, l.day = f, csv.NewWriter(f), day
+	if fi.Size() == 0 {
+		l.w.Write(l.cfg.Columns)
+	}
+	return nil
+}
+
+func (l *CSVLogger) close() {
+	if l.f == nil {
+		return
+	}
+	if err := l.f.Close(); err != nil {
+		log.Errorln("Error closing CSV log:", err)
+	}
+	l.f, l.w = nil, nil
+}
+
+// maintain compresses and deletes the files of past days in the background,
+// unless it is already running.
+func (l *CSVLogger) maintain() {
+	if !l.cfg.Compress && l.cfg.MaxAge <= 0 && l.cfg.MaxSize <= 0 {
+		return
+	}
+	select {
+	case l.busy <- struct{}{}:
+	default:
+		return
+	}
+
+	today := l.day
+	if today == "" {
+		today = l.now().Format(csvDateLayout)
+	}
+	l.wg.Add(1)
+	go func() {
+		defer func() {
+			<-l.busy
+			l.wg.Done()
+		}()
+		if err := l.cleanup(today); err != nil {
+			log.Errorln("Error cleaning up CSV logs:", err)
+		}
+	}()
+}
+
+// cleanup compresses and deletes the files of the days before today.
+func (l *CSVLogger) cleanup(today string) error {
+	paths, err := filepath.Glob(filepath.Join(l.cfg.Dir, "sbms-*.csv*"))
+	if err != nil {
+		return err
+	}
+
+	type file struct {
+		path string
+		day  time.Time
+		size int64
+	}
+	var files []file
+	for _, path := range paths {
+		name := strings.TrimPrefix(filepath.Base(path), "sbms-")
+		if !strings.HasSuffix(name, ".csv") && !strings.HasSuffix(name, ".csv.gz") {
+			continue
+		}
+		day, err := time.ParseInLocation(csvDateLayout, strings.SplitN(name, ".", 2)[0], time.Local)
+		if err != nil {
+			continue
+		}
+		if l.cfg.Compress && strings.HasSuffix(path, ".csv") && day.Format(csvDateLayout) < today {
+			if err := gzipFile(path); err != nil {
+				return err
+			}
+			path += ".gz"
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{path, day, fi.Size()})
+	}
+
+	// Newest first, the file of today never being deleted.
+	sort.Slice(files, func(i, j int) bool { return files[i].day.After(files[j].day) })
+	var total int64
+	for _, f := range files {
+		total += f.size
+		if f.day.Format(csvDateLayout) >= today {
+			continue
+		}
+		tooOld := l.cfg.MaxAge > 0 && f.day.AddDate(0, 0, 1).Before(l.now().Add(-l.cfg.MaxAge))
+		tooBig := l.cfg.MaxSize > 0 && total > l.cfg.MaxSize
+		if tooOld || tooBig {
+			if err := os.Remove(f.path); err != nil {
+				return err
+			}
+			total -= f.size
+		}
+	}
+	return nil
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = out.Chmod(0644)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// csvColumn returns the formatter of the column name, or nil if there is
+// none.
+func csvColumn(name string) func(st *State) string {
+	if name == "time" {
+		return func(st *State) string { return st.Received.Format(time.RFC3339) }
+	}
+	for _, f := range valuesFields {
+		if f.name == name {
+			value := f.value
+			return func(st *State) string { return csvFormat(value(&st.Values)) }
+		}
+	}
+	return nil
+}
+
+// csvFormat formats a field for spreadsheets, rounding floats.
+func csvFormat(value interface{}) string {
+	switch v := roundValue(value).(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		return strings.Join(v, " ")
+	}
+	return fmt.Sprint(value)
+}
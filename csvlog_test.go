@@ -0,0 +1,150 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCSVLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csvlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file old enough to be deleted, and a file left uncompressed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "sbms-2019-10-01.csv.gz"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sbms-2019-11-10.csv"), []byte("time\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := ioutil.ReadFile(`testdata/example1.sbms`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := new(Values)
+	if err := v.ReadFrom(bytes.TrimSpace(frame)); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewCSVLogger(CSVLogConfig{
+		Dir:      dir,
+		Columns:  []string{"time", "state_of_charge", "battery_voltage", "battery_power", "status_flags"},
+		Compress: true,
+		MaxAge:   30 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day1 := time.Date(2019, 11, 14, 23, 59, 58, 0, time.Local)
+	day2 := day1.Add(4 * time.Second)
+	l.now = func() time.Time { return day2 }
+
+	hub := NewHub()
+	sub := hub.Subscribe(csvBuffer)
+	for _, st := range []State{
+		{Up: true, Values: *v, Received: day1},
+		{Up: false, Values: *v, Received: day1},
+		{Up: true, Values: *v, Received: day2},
+	} {
+		hub.Publish(st)
+	}
+	hub.Close()
+	l.Run(sub)
+
+	var names []string
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	want := []string{"sbms-2019-11-10.csv.gz", "sbms-2019-11-14.csv.gz", "sbms-2019-11-15.csv"}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Fatalf("files mismatch (-want +got):\n%s", diff)
+	}
+
+	row := func(t time.Time) string {
+		return t.Format(time.RFC3339) + ",100,27.709,16.376019,CFET DFET\n"
+	}
+	header := "time,state_of_charge,battery_voltage,battery_power,status_flags\n"
+
+	f, err := os.Open(filepath.Join(dir, "sbms-2019-11-14.csv.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(header+row(day1), string(got)); diff != "" {
+		t.Errorf("day 1 mismatch (-want +got):\n%s", diff)
+	}
+
+	got, _ = ioutil.ReadFile(filepath.Join(dir, "sbms-2019-11-15.csv"))
+	if diff := cmp.Diff(header+row(day2), string(got)); diff != "" {
+		t.Errorf("day 2 mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCSVLoggerMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csvlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"sbms-2019-11-11.csv", "sbms-2019-11-12.csv", "sbms-2019-11-13.csv", "sbms-2019-11-14.csv"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := NewCSVLogger(CSVLogConfig{Dir: dir, Columns: []string{"time"}, MaxSize: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.cleanup("2019-11-14"); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	if diff := cmp.Diff([]string{"sbms-2019-11-13.csv", "sbms-2019-11-14.csv"}, names); diff != "" {
+		t.Errorf("files mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := NewCSVLogger(CSVLogConfig{Dir: dir, Columns: []string{"voltage"}}); err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/prometheus/common/log"
+)
+
+// NewDashboardHandler returns the handler serving the live dashboard on /.
+// The page only relies on the JSON API and links to metricsPath.
+func NewDashboardHandler(metricsPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, struct{ MetricsPath string }{metricsPath}); err != nil {
+			log.Errorln("Error rendering dashboard:", err)
+		}
+	})
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>SBMS Exporter</title>
+<style>
+  body { margin: 0; font-family: sans-serif; background: #f4f5f7; color: #222; }
+  header { display: flex; align-items: center; gap: 1em; padding: .8em 1.2em; background: #263238; color: #fff; }
+  header h1 { font-size: 1.2em; margin: 0; flex: 1; }
+  header a { color: #b0bec5; }
+  main { display: grid; grid-template-columns: repeat(auto-fit, minmax(18em, 1fr)); gap: 1em; padding: 1em; }
+  section { background: #fff; border-radius: 4px; padding: 1em; box-shadow: 0 1px 2px rgba(0,0,0,.15); }
+  h2 { font-size: .9em; text-transform: uppercase; color: #607d8b; margin: 0 0 .8em; }
+  .badge { padding: .2em .6em; border-radius: 3px; font-size: .85em; background: #c62828; }
+  .badge.up { background: #2e7d32; }
+  .big { font-size: 2.4em; font-weight: bold; }
+  .muted { color: #78909c; font-size: .85em; }
+  .bar { height: 1.2em; background: #eceff1; border-radius: 3px; overflow: hidden; }
+  .bar > div { height: 100%; background: #43a047; transition: width .5s; }
+  table { width: 100%; border-collapse: collapse; }
+  td { padding: .25em 0; }
+  td:last-child { text-align: right; font-variant-numeric: tabular-nums; }
+  .cell { display: grid; grid-template-columns: 2em 1fr 4.5em; align-items: center; gap: .5em; margin: .3em 0; }
+  .cell .bar > div { background: #1e88e5; }
+  .cell.balancing .bar > div { background: #fb8c00; }
+  .cell span:last-child { text-align: right; font-variant-numeric: tabular-nums; }
+  .flags { display: flex; flex-wrap: wrap; gap: .4em; }
+  .flag { padding: .2em .5em; border-radius: 3px; font-size: .8em; background: #eceff1; color: #90a4ae; }
+  .flag.on { background: #2e7d32; color: #fff; }
+  .flag.on.alarm { background: #c62828; }
+</style>
+</head>
+<body>
+<header>
+  <h1>SBMS Exporter</h1>
+  <span id="updated" class="muted"></span>
+  <span id="up" class="badge">down</span>
+  <a href="{{.MetricsPath}}">Metrics</a>
+</header>
+<main>
+  <section>
+    <h2>State of charge</h2>
+    <div class="big"><span id="soc">-</span> %</div>
+    <div class="bar"><div id="soc-bar" style="width: 0"></div></div>
+    <p id="charging" class="muted"></p>
+  </section>
+  <section>
+    <h2>Battery</h2>
+    <table>
+      <tr><td>Voltage</td><td id="battery_voltage">-</td></tr>
+      <tr><td>Current</td><td id="battery_current">-</td></tr>
+      <tr><td>Power</td><td id="battery_power">-</td></tr>
+      <tr><td>Cell spread</td><td id="cell_spread">-</td></tr>
+    </table>
+  </section>
+  <section>
+    <h2>Cells</h2>
+    <div id="cells"></div>
+    <p class="muted">Cells more than 10 mV above the lowest one while charging are highlighted as balancing.</p>
+  </section>
+  <section>
+    <h2>PV and load</h2>
+    <table>
+      <tr><td>PV1</td><td id="pv1">-</td></tr>
+      <tr><td>PV2</td><td id="pv2">-</td></tr>
+      <tr><td>PV total</td><td id="pv">-</td></tr>
+      <tr><td>External load</td><td id="load">-</td></tr>
+    </table>
+  </section>
+  <section>
+    <h2>Temperatures</h2>
+    <table>
+      <tr><td>Internal</td><td id="internal_temperature">-</td></tr>
+      <tr><td>External</td><td id="external_temperature">-</td></tr>
+    </table>
+  </section>
+  <section>
+    <h2>Status</h2>
+    <div id="flags" class="flags"></div>
+    <p class="muted">Status word <span id="status">-</span></p>
+  </section>
+</main>
+<script>
+(function() {
+  var CELLS = 8, CELL_MIN = 2.5, CELL_MAX = 3.8, BALANCING_DELTA = 0.010;
+  var FLAGS = ["OV", "OVLK", "UV", "UVLK", "IOT", "COC", "DOC", "DSC", "CELF", "OPEN", "LVC", "ECCF", "CFET", "EOC", "DFET"];
+  var INFO_FLAGS = { CFET: true, DFET: true, EOC: true };
+
+  function $(id) { return document.getElementById(id); }
+  function fixed(v, digits, unit) { return v.toFixed(digits) + " " + unit; }
+
+  var cells = [];
+  for (var i = 1; i <= CELLS; i++) {
+    var row = document.createElement("div");
+    row.className = "cell";
+    row.innerHTML = "<span>" + i + "</span><div class=\"bar\"><div></div></div><span>-</span>";
+    $("cells").appendChild(row);
+    cells.push(row);
+  }
+  var flags = {};
+  FLAGS.forEach(function(name) {
+    var el = document.createElement("span");
+    el.className = "flag" + (INFO_FLAGS[name] ? "" : " alarm");
+    el.textContent = name;
+    $("flags").appendChild(el);
+    flags[name] = el;
+  });
+
+  function render(res) {
+    $("up").textContent = res.up ? "up" : "down";
+    $("up").className = "badge" + (res.up ? " up" : "");
+    if (res.received) {
+      $("updated").textContent = "device " + res.date + ", received " + new Date(res.received).toLocaleTimeString();
+    }
+    if (!res.up) {
+      return;
+    }
+
+    var v = {};
+    Object.keys(res.values).forEach(function(k) { v[k] = res.values[k].value; });
+
+    $("soc").textContent = v.state_of_charge;
+    $("soc-bar").style.width = v.state_of_charge + "%";
+    $("charging").textContent = v.charging ? "Charging" : "Discharging";
+
+    var volts = [];
+    for (var i = 1; i <= CELLS; i++) {
+      volts.push(v["cell" + i + "_voltage"]);
+    }
+    var min = Math.min.apply(null, volts), max = Math.max.apply(null, volts);
+    volts.forEach(function(volt, i) {
+      var pct = Math.max(0, Math.min(100, (volt - CELL_MIN) / (CELL_MAX - CELL_MIN) * 100));
+      cells[i].querySelector(".bar > div").style.width = pct + "%";
+      cells[i].lastChild.textContent = fixed(volt, 3, "V");
+      cells[i].className = "cell" + (v.charging && volt - min > BALANCING_DELTA ? " balancing" : "");
+    });
+
+    $("battery_voltage").textContent = fixed(v.battery_voltage, 2, "V");
+    $("battery_current").textContent = fixed(v.battery_current, 2, "A");
+    $("battery_power").textContent = fixed(v.battery_power, 1, "W");
+    $("cell_spread").textContent = fixed((max - min) * 1000, 0, "mV");
+    $("pv1").textContent = fixed(v.pv1_current * v.battery_voltage, 1, "W") + " (" + fixed(v.pv1_current, 2, "A") + ")";
+    $("pv2").textContent = fixed(v.pv2_current * v.battery_voltage, 1, "W") + " (" + fixed(v.pv2_current, 2, "A") + ")";
+    $("pv").textContent = fixed((v.pv1_current + v.pv2_current) * v.battery_voltage, 1, "W");
+    $("load").textContent = fixed(v.external_load_current * v.battery_voltage, 1, "W") + " (" + fixed(v.external_load_current, 2, "A") + ")";
+    $("internal_temperature").textContent = fixed(v.internal_temperature, 1, "°C");
+    $("external_temperature").textContent = fixed(v.external_temperature, 1, "°C");
+
+    $("status").textContent = v.status;
+    FLAGS.forEach(function(name) {
+      flags[name].classList.toggle("on", v.status_flags.indexOf(name) >= 0);
+    });
+  }
+
+  fetch("api/v1/values").then(function(r) { return r.json(); }).then(render);
+  new EventSource("api/v1/stream").onmessage = function(e) { render(JSON.parse(e.data)); };
+})();
+</script>
+</body>
+</html>
+`))
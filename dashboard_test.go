@@ -0,0 +1,45 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	h := NewDashboardHandler("/custom/metrics")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("unexpected status code: got %d, want %d", got, want)
+	}
+	if got, want := rec.Header().Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+		t.Errorf("unexpected content type: got %q, want %q", got, want)
+	}
+	for _, want := range []string{`href="/custom/metrics"`, `EventSource("api/v1/stream")`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("dashboard does not contain %s", want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("unexpected status code: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Output formats of the decode command.
+const (
+	FormatTable      = "table"
+	FormatJSON       = "json"
+	FormatPrometheus = "prometheus"
+)
+
+// ErrDecodeFailed is returned by Decode when at least one frame could not be
+// decoded.
+var ErrDecodeFailed = errors.New("some frames could not be decoded")
+
+type valuesField struct {
+	name  string
+	unit  string
+	value func(v *Values) interface{}
+}
+
+// valuesFields lists, in display order, every value decoded from a frame
+// followed by the derived ones.
+var valuesFields = []valuesField{
+	{"date", "", func(v *Values) interface{} { return v.Date }},
+	{"state_of_charge", "%", func(v *Values) interface{} { return v.StateOfCharge }},
+	{"cell1_voltage", "V", func(v *Values) interface{} { return v.Cell1Voltage }},
+	{"cell2_voltage", "V", func(v *Values) interface{} { return v.Cell2Voltage }},
+	{"cell3_voltage", "V", func(v *Values) interface{} { return v.Cell3Voltage }},
+	{"cell4_voltage", "V", func(v *Values) interface{} { return v.Cell4Voltage }},
+	{"cell5_voltage", "V", func(v *Values) interface{} { return v.Cell5Voltage }},
+	{"cell6_voltage", "V", func(v *Values) interface{} { return v.Cell6Voltage }},
+	{"cell7_voltage", "V", func(v *Values) interface{} { return v.Cell7Voltage }},
+	{"cell8_voltage", "V", func(v *Values) interface{} { return v.Cell8Voltage }},
+	{"internal_temperature", "°C", func(v *Values) interface{} { return v.InternalTemp }},
+	{"external_temperature", "°C", func(v *Values) interface{} { return v.ExternalTemp }},
+	{"charging", "", func(v *Values) interface{} { return v.Charging }},
+	{"battery_current", "A", func(v *Values) interface{} { return v.BatteryCurrent }},
+	{"pv1_current", "A", func(v *Values) interface{} { return v.PV1Current }},
+	{"pv2_current", "A", func(v *Values) interface{} { return v.PV2Current }},
+	{"external_load_current", "A", func(v *Values) interface{} { return v.ExtLoadCurrent }},
+	{"adc2", "", func(v *Values) interface{} { return v.ADC2 }},
+	{"adc3", "", func(v *Values) interface{} { return v.ADC3 }},
+	{"adc4", "", func(v *Values) interface{} { return v.ADC4 }},
+	{"heat1", "", func(v *Values) interface{} { return v.Heat1 }},
+	{"heat2", "", func(v *Values) interface{} { return v.Heat2 }},
+	{"status", "", func(v *Values) interface{} { return v.Status }},
+	{"status_flags", "", func(v *Values) interface{} { return v.StatusFlags() }},
+	{"battery_voltage", "V", func(v *Values) interface{} { return v.BatteryVoltage() }},
+	{"battery_power", "W", func(v *Values) interface{} { return v.BatteryPower() }},
+}
+
+// valuesFloat returns a getter of the numeric field name of valuesFields,
+// booleans being 0 or 1, or nil if there is none.
+func valuesFloat(name string) func(v *Values) float64 {
+	for _, f := range valuesFields {
+		if f.name != name {
+			continue
+		}
+		value := f.value
+		switch value(new(Values)).(type) {
+		case float64:
+			return func(v *Values) float64 { return value(v).(float64) }
+		case int:
+			return func(v *Values) float64 { return float64(value(v).(int)) }
+		case bool:
+			return func(v *Values) float64 { return boolAsFloat(value(v).(bool)) }
+		}
+	}
+	return nil
+}
+
+// milli and deci return x in the integer milli and deci units of the
+// device, e.g. mV and tenths of °C.
+func milli(x float64) int64 {
+	return int64(math.Round(x * 1000))
+}
+
+func deci(x float64) int64 {
+	return int64(math.Round(x * 10))
+}
+
+type fieldJSON struct {
+	Value interface{} `json:"value"`
+	Unit  string      `json:"unit,omitempty"`
+}
+
+// valuesJSON returns every field of v, keyed by name, along with its unit.
+func valuesJSON(v *Values) map[string]fieldJSON {
+	m := make(map[string]fieldJSON, len(valuesFields))
+	for _, f := range valuesFields {
+		m[f.name] = fieldJSON{Value: roundValue(f.value(v)), Unit: f.unit}
+	}
+	return m
+}
+
+// roundValue rounds floats to the microunit, hiding the noise of derived
+// values such as 27.709000000000003.
+func roundValue(value interface{}) interface{} {
+	if x, ok := value.(float64); ok {
+		return math.Round(x*1e6) / 1e6
+	}
+	return value
+}
+
+// Decode decodes every frame and prints it to w in the given format. Frames
+// that cannot be decoded are reported to errw, pointing to the offending
+// byte, and make Decode return ErrDecodeFailed once every frame was tried.
+func Decode(w, errw io.Writer, format string, frames [][]byte) error {
+	failed, printed := false, 0
+	// The metrics of every frame are written at once, as the families of
+	// the text format cannot be repeated.
+	var metrics []*Values
+	for i, frame := range frames {
+		v := new(Values)
+		if err := v.ReadFrom(frame); err != nil {
+			failed = true
+			reportDecodeError(errw, i+1, frame, err)
+			continue
+		}
+
+		var err error
+		switch format {
+		case FormatJSON:
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(valuesJSON(v))
+		case FormatPrometheus:
+			metrics = append(metrics, v)
+		default:
+			if printed > 0 {
+				fmt.Fprintln(w)
+			}
+			err = writeValuesTable(w, v)
+		}
+		if err != nil {
+			return err
+		}
+		printed++
+	}
+	if len(metrics) > 0 {
+		if err := writeValuesMetrics(w, metrics...); err != nil {
+			return err
+		}
+	}
+
+	if failed {
+		return ErrDecodeFailed
+	}
+	return nil
+}
+
+func writeValuesTable(w io.Writer, v *Values) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tVALUE\tUNIT")
+	for _, f := range valuesFields {
+		value := roundValue(f.value(v))
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", f.name, value, f.unit)
+	}
+	return tw.Flush()
+}
+
+// writeValuesMetrics writes the metrics of frames in the text format. The
+// samples of several frames are grouped by family, each timestamped with the
+// date of its frame.
+func writeValuesMetrics(w io.Writer, frames ...*Values) error {
+	var families []*dto.MetricFamily
+	byName := map[string]*dto.MetricFamily{}
+	for _, v := range frames {
+		reg := prometheus.NewRegistry()
+		exp := NewExporter(reg)
+		exp.up.Set(1)
+		exp.ensureExporterRegistered()
+		exp.set(v)
+
+		mfs, err := reg.Gather()
+		if err != nil {
+			return err
+		}
+		for _, mf := range mfs {
+			if len(frames) > 1 {
+				for _, m := range mf.Metric {
+					m.TimestampMs = proto.Int64(v.Date.UnixNano() / int64(time.Millisecond))
+				}
+			}
+			if f := byName[mf.GetName()]; f != nil {
+				f.Metric = append(f.Metric, mf.Metric...)
+				continue
+			}
+			byName[mf.GetName()] = mf
+			families = append(families, mf)
+		}
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reportDecodeError(w io.Writer, n int, frame []byte, err error) {
+	offset := len(frame)
+	switch e := err.(type) {
+	case *DecodeError:
+		offset = e.Offset
+	default:
+		if err == ErrDataLength {
+			err = fmt.Errorf("%v: got %d bytes, want 59", err, len(frame))
+			if len(frame) > 59 {
+				offset = 59
+			}
+		}
+	}
+
+	// Escape the frame so the caret lines up even with control characters.
+	quoted := make([]string, len(frame))
+	pad := 0
+	for i, c := range frame {
+		q := strconv.Quote(string([]byte{c}))
+		quoted[i] = q[1 : len(q)-1]
+		if i < offset {
+			pad += len(quoted[i])
+		}
+	}
+
+	fmt.Fprintf(w, "frame %d: %v\n", n, err)
+	fmt.Fprintf(w, "  %s\n", strings.Join(quoted, ""))
+	fmt.Fprintf(w, "  %s^\n", strings.Repeat(" ", pad))
+}
+
+func runDecode(r io.Reader, w, errw io.Writer, format string, args []string) error {
+	var frames [][]byte
+	for _, arg := range args {
+		frames = append(frames, bytes.TrimSpace([]byte(arg)))
+	}
+	if len(args) == 0 {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			if line := bytes.TrimSpace(s.Bytes()); len(line) > 0 {
+				frames = append(frames, append([]byte(nil), line...))
+			}
+		}
+		if s.Err() != nil {
+			return s.Err()
+		}
+	}
+	return Decode(w, errw, format, frames)
+}
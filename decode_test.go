@@ -0,0 +1,127 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestDecode(t *testing.T) {
+	testCases := []struct {
+		format string
+		golden string
+	}{
+		{format: FormatTable, golden: `testdata/decode.table`},
+		{format: FormatJSON, golden: `testdata/decode.json`},
+		{format: FormatPrometheus, golden: `testdata/example1.decoded.metrics`},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.format, func(t *testing.T) {
+			f, err := os.Open(`testdata/example1.sbms`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			out, errOut := new(bytes.Buffer), new(bytes.Buffer)
+			if err := runDecode(f, out, errOut, tC.format, nil); err != nil {
+				t.Fatalf("unexpected error: %q", err)
+			}
+			if errOut.Len() > 0 {
+				t.Errorf("unexpected error output: %s", errOut)
+			}
+
+			if *update {
+				if err := ioutil.WriteFile(tC.golden, out.Bytes(), 0644); err != nil {
+					t.Fatalf("unexpected error: %q", err)
+				}
+			}
+			want, _ := ioutil.ReadFile(tC.golden)
+			if diff := cmp.Diff(string(want), out.String()); diff != "" {
+				t.Errorf("output does not match golden file %s (-want +got):\n%s", tC.golden, diff)
+			}
+		})
+	}
+}
+
+func TestDecodeMetricsOfSeveralFrames(t *testing.T) {
+	var frames []string
+	for _, path := range []string{`testdata/example1.sbms`, `testdata/example2.sbms`} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, string(b))
+	}
+
+	out := new(bytes.Buffer)
+	if err := runDecode(nil, out, ioutil.Discard, FormatPrometheus, frames); err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	mfs, err := new(expfmt.TextParser).TextToMetricFamilies(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("invalid text format: %v", err)
+	}
+	soc := mfs["sbms_battery_soc"]
+	if soc == nil || len(soc.Metric) != 2 || soc.Metric[0].GetTimestampMs() == soc.Metric[1].GetTimestampMs() {
+		t.Errorf("got %v, want a sample of each frame", soc)
+	}
+
+	golden := `testdata/decode.metrics`
+	if *update {
+		if err := ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatalf("unexpected error: %q", err)
+		}
+	}
+	want, _ := ioutil.ReadFile(golden)
+	if diff := cmp.Diff(string(want), out.String()); diff != "" {
+		t.Errorf("output does not match golden file %s (-want +got):\n%s", golden, diff)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	frames := []string{
+		"3';2LD$,I)I*I+I+--TOO-SHORT",
+		"3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(\x01",
+		"3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####\t>##################%N(",
+	}
+
+	out, errOut := new(bytes.Buffer), new(bytes.Buffer)
+	if err := runDecode(nil, out, errOut, FormatTable, frames); err != ErrDecodeFailed {
+		t.Errorf("unexpected error: got %q, want %q", err, ErrDecodeFailed)
+	}
+	if out.Len() > 0 {
+		t.Errorf("unexpected output: %s", out)
+	}
+
+	want := `frame 1: invalid data length: got 27 bytes, want 59
+  3';2LD$,I)I*I+I+--TOO-SHORT
+                             ^
+frame 2: invalid data length: got 60 bytes, want 59
+  3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(\x01
+                                                             ^
+frame 3: invalid byte '\t' at offset 36
+  3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####\t>##################%N(
+                                      ^
+`
+	if diff := cmp.Diff(want, errOut.String()); diff != "" {
+		t.Errorf("error output mismatch (-want +got):\n%s", diff)
+	}
+}
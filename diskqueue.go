@@ -0,0 +1,357 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// diskQueueHeaderSize is the size of the header preceding every record: the
+// length of the record followed by its CRC32 (Castagnoli) checksum.
+const diskQueueHeaderSize = 8
+
+// diskQueueMaxRecord bounds the size of a record, so a corrupt header cannot
+// make the reader allocate an unreasonable amount of memory.
+const diskQueueMaxRecord = 64 << 20
+
+var diskQueueCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptRecord is returned when a record header or checksum is invalid.
+var errCorruptRecord = errors.New("corrupt record")
+
+// DiskQueue is a persistent FIFO of records, appended to numbered segment
+// files in a directory, in the spirit of a write-ahead log. Records are only
+// removed once committed by the reader, so they survive restarts. Appends and
+// commits are synced to disk before returning, so they also survive power
+// losses.
+type DiskQueue struct {
+	dir         string
+	segmentSize int64
+	maxSegments int
+
+	mu    sync.Mutex
+	w     *os.File
+	wseg  int
+	wsize int64
+	rseg  int
+	roff  int64
+}
+
+// DiskQueueCursor is the position of the next record to read.
+type DiskQueueCursor struct {
+	Segment int
+	Offset  int64
+}
+
+// OpenDiskQueue opens the queue stored in dir, creating it if needed.
+// Segments are cut once they reach segmentSize bytes and the oldest ones are
+// dropped, unread or not, when there are more than maxSegments.
+func OpenDiskQueue(dir string, segmentSize int64, maxSegments int) (*DiskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &DiskQueue{dir: dir, segmentSize: segmentSize, maxSegments: maxSegments}
+
+	segs, err := q.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) > 0 {
+		q.wseg = segs[len(segs)-1]
+		q.rseg = segs[0]
+	}
+
+	if err := q.readCursor(); err != nil {
+		return nil, err
+	}
+	if err := q.openWriteSegment(); err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		q.w.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Append adds a record at the end of the queue.
+func (q *DiskQueue) Append(rec []byte) error {
+	if len(rec) > diskQueueMaxRecord {
+		return fmt.Errorf("record of %d bytes is too large", len(rec))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.wsize > 0 && q.wsize+int64(diskQueueHeaderSize+len(rec)) > q.segmentSize {
+		if err := q.cut(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, diskQueueHeaderSize+len(rec))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(rec)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(rec, diskQueueCRC))
+	copy(buf[diskQueueHeaderSize:], rec)
+
+	n, err := q.w.Write(buf)
+	q.wsize += int64(n)
+	if err != nil {
+		return err
+	}
+	return q.w.Sync()
+}
+
+// Read returns up to max records from the head of the queue, along with the
+// cursor to commit once they are processed.
+func (q *DiskQueue) Read(max int) ([][]byte, DiskQueueCursor, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var recs [][]byte
+	seg, off := q.rseg, q.roff
+	for len(recs) < max && seg <= q.wseg {
+		f, err := os.Open(q.segmentPath(seg))
+		if os.IsNotExist(err) {
+			seg, off = seg+1, 0
+			continue
+		}
+		if err != nil {
+			return nil, DiskQueueCursor{q.rseg, q.roff}, err
+		}
+
+		r := io.NewSectionReader(f, off, 1<<62)
+		for len(recs) < max {
+			rec, err := readDiskQueueRecord(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// Nothing after a corrupt record can be trusted.
+				log.Warnf("Skipping the rest of queue segment %d at offset %d: %v", seg, off, err)
+				break
+			}
+			recs = append(recs, rec)
+			off += int64(diskQueueHeaderSize + len(rec))
+		}
+		f.Close()
+
+		if len(recs) < max && seg < q.wseg {
+			seg, off = seg+1, 0
+			continue
+		}
+		break
+	}
+
+	return recs, DiskQueueCursor{seg, off}, nil
+}
+
+// Commit moves the head of the queue to c, removing the segments that were
+// fully read.
+func (q *DiskQueue) Commit(c DiskQueueCursor) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if c.Segment < q.rseg || (c.Segment == q.rseg && c.Offset < q.roff) {
+		// The records were dropped in the meantime to make room.
+		return nil
+	}
+	for seg := q.rseg; seg < c.Segment; seg++ {
+		if err := os.Remove(q.segmentPath(seg)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	q.rseg, q.roff = c.Segment, c.Offset
+	return q.writeCursor()
+}
+
+// Close closes the segment being written.
+func (q *DiskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.w.Close()
+}
+
+func (q *DiskQueue) cut() error {
+	if err := q.w.Close(); err != nil {
+		return err
+	}
+	q.wseg++
+	if err := q.openWriteSegment(); err != nil {
+		return err
+	}
+	if err := syncDir(q.dir); err != nil {
+		return err
+	}
+
+	if drop := q.wseg - q.rseg + 1 - q.maxSegments; drop > 0 {
+		log.Warnf("Queue in %s is full, dropping %d unsent segments", q.dir, drop)
+		for seg := q.rseg; seg < q.rseg+drop; seg++ {
+			if err := os.Remove(q.segmentPath(seg)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		q.rseg, q.roff = q.rseg+drop, 0
+		return q.writeCursor()
+	}
+	return nil
+}
+
+// openWriteSegment opens the last segment for appending, truncating any
+// torn record left by a crash.
+func (q *DiskQueue) openWriteSegment() error {
+	f, err := os.OpenFile(q.segmentPath(q.wseg), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	var valid int64
+	r := io.NewSectionReader(f, 0, 1<<62)
+	for {
+		rec, err := readDiskQueueRecord(r)
+		if err != nil {
+			break
+		}
+		valid += int64(diskQueueHeaderSize + len(rec))
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	q.w, q.wsize = f, valid
+	return nil
+}
+
+func (q *DiskQueue) segments() ([]int, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	for _, fi := range files {
+		if seg, err := strconv.Atoi(fi.Name()); err == nil && !fi.IsDir() {
+			segs = append(segs, seg)
+		}
+	}
+	sort.Ints(segs)
+	return segs, nil
+}
+
+func (q *DiskQueue) segmentPath(seg int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%08d", seg))
+}
+
+func (q *DiskQueue) readCursor() error {
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, "cursor"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var seg int
+	var off int64
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d %d", &seg, &off); err != nil {
+		return fmt.Errorf("invalid queue cursor: %v", err)
+	}
+	// Segments before the first one left were already committed, and a
+	// cursor past the last one is stale.
+	if seg >= q.rseg && seg <= q.wseg {
+		q.rseg, q.roff = seg, off
+	}
+	return nil
+}
+
+func (q *DiskQueue) writeCursor() error {
+	return writeFileSync(filepath.Join(q.dir, "cursor"), []byte(fmt.Sprintf("%d %d\n", q.rseg, q.roff)))
+}
+
+// writeFileSync replaces the file at path with data, atomically and durably.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the entries of dir, making the files created or renamed in
+// it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func readDiskQueueRecord(r io.Reader) ([]byte, error) {
+	var hdr [diskQueueHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errCorruptRecord
+		}
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[0:])
+	if n > diskQueueMaxRecord {
+		return nil, errCorruptRecord
+	}
+	rec := make([]byte, n)
+	if _, err := io.ReadFull(r, rec); err != nil {
+		return nil, errCorruptRecord
+	}
+	if crc32.Checksum(rec, diskQueueCRC) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, errCorruptRecord
+	}
+	return rec, nil
+}
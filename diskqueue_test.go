@@ -0,0 +1,158 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func readDiskQueue(t *testing.T, q *DiskQueue, max int) ([]string, DiskQueueCursor) {
+	t.Helper()
+	recs, c, err := q.Read(max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rec := range recs {
+		got = append(got, string(rec))
+	}
+	return got, c
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two 4-byte records fit in a segment.
+	q, err := OpenDiskQueue(dir, 24, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"} {
+		if err := q.Append([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, c := readDiskQueue(t, q, 3)
+	if diff := cmp.Diff([]string{"aaaa", "bbbb", "cccc"}, got); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+	// Not committed, so read again.
+	got, _ = readDiskQueue(t, q, 1)
+	if diff := cmp.Diff([]string{"aaaa"}, got); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+	if err := q.Commit(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000")); !os.IsNotExist(err) {
+		t.Errorf("committed segment not removed: %v", err)
+	}
+	q.Close()
+
+	// Reopening resumes after the committed records.
+	q, err = OpenDiskQueue(dir, 24, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Append([]byte("ffff")); err != nil {
+		t.Fatal(err)
+	}
+	got, c = readDiskQueue(t, q, 10)
+	if diff := cmp.Diff([]string{"dddd", "eeee", "ffff"}, got); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+	if err := q.Commit(c); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readDiskQueue(t, q, 10); len(got) != 0 {
+		t.Errorf("unexpected records after commit: %q", got)
+	}
+}
+
+func TestDiskQueueTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := OpenDiskQueue(dir, 1024, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Append([]byte("aaaa"))
+	q.Append([]byte("bbbb"))
+	q.Close()
+
+	// Simulate a crash in the middle of the second record.
+	if err := os.Truncate(filepath.Join(dir, "00000000"), 14); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = OpenDiskQueue(dir, 1024, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.Append([]byte("cccc"))
+	got, _ := readDiskQueue(t, q, 10)
+	if diff := cmp.Diff([]string{"aaaa", "cccc"}, got); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDiskQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// One record per segment, at most two segments.
+	q, err := OpenDiskQueue(dir, 12, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	_, stale := readDiskQueue(t, q, 10)
+	for _, rec := range []string{"aaaa", "bbbb", "cccc", "dddd"} {
+		q.Append([]byte(rec))
+	}
+
+	got, c := readDiskQueue(t, q, 10)
+	if diff := cmp.Diff([]string{"cccc", "dddd"}, got); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+	// A cursor from before the drop is ignored.
+	if err := q.Commit(stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Commit(c); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readDiskQueue(t, q, 10); len(got) != 0 {
+		t.Errorf("unexpected records after commit: %q", got)
+	}
+}
@@ -16,7 +16,10 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -45,6 +48,32 @@ type Exporter struct {
 	extLoadVolts      prometheus.Gauge
 	extLoadAmperes    prometheus.Gauge
 	extLoadWatts      prometheus.Gauge
+
+	now   func() time.Time
+	hub   *Hub
+	mu    sync.RWMutex
+	state State
+}
+
+// State is a snapshot of the last frame received by an Exporter.
+type State struct {
+	// Up tells whether the last frame received could be decoded.
+	Up bool
+	// Values holds the last frame successfully decoded.
+	Values Values
+	// Received is the host time at which Values was received.
+	Received time.Time
+	// Time is the host time at which the state was reached, that is the
+	// time at which the last line was read or the source ended.
+	Time time.Time
+	// Err is the error which stopped the reading of the source, io.EOF
+	// when it ended or the error of the context when Export was cancelled,
+	// and nil while it is being read.
+	Err error
+	// DecodeErr is the last error decoding a line, at host time
+	// DecodeErrTime, kept once frames are decoded again.
+	DecodeErr     error
+	DecodeErrTime time.Time
 }
 
 // NewExporter TODO
@@ -52,6 +81,8 @@ func NewExporter(registry prometheus.Registerer) *Exporter {
 	m := &Exporter{
 		registry:   registry,
 		registered: false,
+		now:        time.Now,
+		hub:        NewHub(),
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: "sbms",
 			Name:      "up",
@@ -180,70 +211,139 @@ func NewExporter(registry prometheus.Registerer) *Exporter {
 	return m
 }
 
-// Export TODO
-func (m *Exporter) Export(r io.Reader) error {
-	s := bufio.NewScanner(r)
+// Export reads frames from r, one per line, until it ends, fails or ctx is
+// done, and returns why: io.EOF, the error of r or the error of ctx. The
+// metrics and the subscribers follow every line read. As reads cannot be
+// interrupted, a cancelled Export leaves r being read aside until the
+// caller closes it.
+func (m *Exporter) Export(ctx context.Context, r io.Reader) error {
 	v := new(Values)
-	down := func() {
+	down := func(err, decodeErr error) {
 		m.up.Set(0)
 		m.ensureExporterCleared()
+		m.mu.Lock()
+		m.state.Up = false
+		m.state.Err = err
+		m.state.Time = m.now()
+		if decodeErr != nil {
+			m.state.DecodeErr, m.state.DecodeErrTime = decodeErr, m.state.Time
+		}
+		st := m.state
+		m.mu.Unlock()
+		m.hub.Publish(st)
 	}
 	up := func() {
 		m.up.Set(1)
 		m.ensureExporterRegistered()
+		now := m.now()
+		m.mu.Lock()
+		st := State{Up: true, Values: *v, Received: now, Time: now, DecodeErr: m.state.DecodeErr, DecodeErrTime: m.state.DecodeErrTime}
+		m.state = st
+		m.mu.Unlock()
+		m.hub.Publish(st)
 	}
 
-	defer down()
+	lines := make(chan []byte)
+	done := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			select {
+			case lines <- append([]byte(nil), s.Bytes()...):
+			case <-stop:
+				return
+			}
+		}
+		done <- s.Err()
+	}()
 
-	for s.Scan() {
-		if err := v.ReadFrom(bytes.TrimSpace(s.Bytes())); err != nil {
-			down()
-			continue
+	var err error
+	for err == nil {
+		select {
+		case line := <-lines:
+			if err := v.ReadFrom(bytes.TrimSpace(line)); err != nil {
+				down(nil, err)
+				continue
+			}
+			// Subscribers reading the metrics see those of the frame.
+			m.set(v)
+			up()
+		case err = <-done:
+			if err == nil {
+				err = io.EOF
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
+	}
+	down(err, nil)
+	return err
+}
 
-		battVolts := v.Cell1Voltage + v.Cell2Voltage + v.Cell3Voltage + v.Cell4Voltage + v.Cell5Voltage + v.Cell6Voltage + v.Cell7Voltage + v.Cell8Voltage
+// State returns a snapshot of the last frame received.
+func (m *Exporter) State() State {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
 
-		up()
+// Subscribe returns a subscription to the states resulting from every line
+// read from the source, whether it could be decoded or not.
+func (m *Exporter) Subscribe(buffer int) *Subscription {
+	return m.hub.Subscribe(buffer)
+}
 
-		m.updated.Set(float64(v.Date.Unix()))
-		m.status.Set(float64(v.Status))
-		m.batteryCharging.Set(boolAsFloat(v.Charging))
-		m.batterySOC.Set(float64(v.StateOfCharge))
-		m.batteryVolts.Set(battVolts)
-		m.batteryAmperes.Set(v.BatteryCurrent)
-		m.batteryWatts.Set(v.BatteryCurrent * battVolts)
-		m.cellVolts.With(prometheus.Labels{"cell": "1"}).Set(v.Cell1Voltage)
-		m.cellVolts.With(prometheus.Labels{"cell": "2"}).Set(v.Cell2Voltage)
-		m.cellVolts.With(prometheus.Labels{"cell": "3"}).Set(v.Cell3Voltage)
-		m.cellVolts.With(prometheus.Labels{"cell": "4"}).Set(v.Cell4Voltage)
-		m.cellVolts.With(prometheus.Labels{"cell": "5"}).Set(v.Cell5Voltage)
-		m.cellVolts.With(prometheus.Labels{"cell": "6"}).Set(v.Cell6Voltage)
-		m.cellVolts.With(prometheus.Labels{"cell": "7"}).Set(v.Cell7Voltage)
-		m.cellVolts.With(prometheus.Labels{"cell": "8"}).Set(v.Cell8Voltage)
-		m.pvVolts.Set(battVolts)
-		m.pvAmperes.With(prometheus.Labels{"pv": "1"}).Set(v.PV1Current)
-		m.pvAmperes.With(prometheus.Labels{"pv": "2"}).Set(v.PV2Current)
-		m.pvWatts.With(prometheus.Labels{"pv": "1"}).Set(v.PV1Current * battVolts)
-		m.pvWatts.With(prometheus.Labels{"pv": "2"}).Set(v.PV2Current * battVolts)
-		m.pvAmperesCombined.Set(v.PV1Current + v.PV2Current)
-		m.pvWattsCombined.Set(v.PV1Current*battVolts + v.PV2Current*battVolts)
-		m.thermistorCelsius.With(prometheus.Labels{"sensor": "internal"}).Set(v.InternalTemp)
-		m.thermistorCelsius.With(prometheus.Labels{"sensor": "external"}).Set(v.ExternalTemp)
-		m.adcValues.With(prometheus.Labels{"adc": "2"}).Set(float64(v.ADC2))
-		m.adcValues.With(prometheus.Labels{"adc": "3"}).Set(float64(v.ADC3))
-		m.adcValues.With(prometheus.Labels{"adc": "4"}).Set(float64(v.ADC4))
-		m.heatValues.With(prometheus.Labels{"heat": "1"}).Set(float64(v.Heat1))
-		m.heatValues.With(prometheus.Labels{"heat": "2"}).Set(float64(v.Heat2))
-		m.extLoadVolts.Set(battVolts)
-		m.extLoadAmperes.Set(v.ExtLoadCurrent)
-		m.extLoadWatts.Set(v.ExtLoadCurrent * battVolts)
+// mirror makes the metrics of m reflect st, for outputs keeping a private
+// exporter in sync with the states they receive. Their metrics are then the
+// same as the scraped ones.
+func (m *Exporter) mirror(st State) {
+	if !st.Up {
+		m.up.Set(0)
+		m.ensureExporterCleared()
+		return
 	}
+	m.up.Set(1)
+	m.ensureExporterRegistered()
+	m.set(&st.Values)
+}
 
-	if s.Err() != nil {
-		return s.Err()
-	}
+func (m *Exporter) set(v *Values) {
+	battVolts := v.BatteryVoltage()
 
-	return io.EOF
+	m.updated.Set(float64(v.Date.Unix()))
+	m.status.Set(float64(v.Status))
+	m.batteryCharging.Set(boolAsFloat(v.Charging))
+	m.batterySOC.Set(float64(v.StateOfCharge))
+	m.batteryVolts.Set(battVolts)
+	m.batteryAmperes.Set(v.BatteryCurrent)
+	m.batteryWatts.Set(v.BatteryPower())
+	m.cellVolts.With(prometheus.Labels{"cell": "1"}).Set(v.Cell1Voltage)
+	m.cellVolts.With(prometheus.Labels{"cell": "2"}).Set(v.Cell2Voltage)
+	m.cellVolts.With(prometheus.Labels{"cell": "3"}).Set(v.Cell3Voltage)
+	m.cellVolts.With(prometheus.Labels{"cell": "4"}).Set(v.Cell4Voltage)
+	m.cellVolts.With(prometheus.Labels{"cell": "5"}).Set(v.Cell5Voltage)
+	m.cellVolts.With(prometheus.Labels{"cell": "6"}).Set(v.Cell6Voltage)
+	m.cellVolts.With(prometheus.Labels{"cell": "7"}).Set(v.Cell7Voltage)
+	m.cellVolts.With(prometheus.Labels{"cell": "8"}).Set(v.Cell8Voltage)
+	m.pvVolts.Set(battVolts)
+	m.pvAmperes.With(prometheus.Labels{"pv": "1"}).Set(v.PV1Current)
+	m.pvAmperes.With(prometheus.Labels{"pv": "2"}).Set(v.PV2Current)
+	m.pvWatts.With(prometheus.Labels{"pv": "1"}).Set(v.PV1Current * battVolts)
+	m.pvWatts.With(prometheus.Labels{"pv": "2"}).Set(v.PV2Current * battVolts)
+	m.pvAmperesCombined.Set(v.PV1Current + v.PV2Current)
+	m.pvWattsCombined.Set(v.PV1Current*battVolts + v.PV2Current*battVolts)
+	m.thermistorCelsius.With(prometheus.Labels{"sensor": "internal"}).Set(v.InternalTemp)
+	m.thermistorCelsius.With(prometheus.Labels{"sensor": "external"}).Set(v.ExternalTemp)
+	m.adcValues.With(prometheus.Labels{"adc": "2"}).Set(float64(v.ADC2))
+	m.adcValues.With(prometheus.Labels{"adc": "3"}).Set(float64(v.ADC3))
+	m.adcValues.With(prometheus.Labels{"adc": "4"}).Set(float64(v.ADC4))
+	m.heatValues.With(prometheus.Labels{"heat": "1"}).Set(float64(v.Heat1))
+	m.heatValues.With(prometheus.Labels{"heat": "2"}).Set(float64(v.Heat2))
+	m.extLoadVolts.Set(battVolts)
+	m.extLoadAmperes.Set(v.ExtLoadCurrent)
+	m.extLoadWatts.Set(v.ExtLoadCurrent * battVolts)
 }
 
 func (m *Exporter) ensureExporterRegistered() {
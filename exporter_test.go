@@ -15,6 +15,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"io"
 	"io/ioutil"
@@ -38,7 +39,7 @@ func TestMonitor(t *testing.T) {
 
 	wg.Add(1)
 	go func() {
-		err := exp.Export(r)
+		err := exp.Export(context.Background(), r)
 		if err != io.EOF {
 			t.Errorf("unexpected error: %q", err)
 		}
@@ -67,7 +68,7 @@ func TestWhitespace(t *testing.T) {
 
 	wg.Add(1)
 	go func() {
-		err := exp.Export(r)
+		err := exp.Export(context.Background(), r)
 		if err != io.EOF {
 			t.Errorf("unexpected error: %q", err)
 		}
@@ -81,6 +82,40 @@ func TestWhitespace(t *testing.T) {
 	wg.Wait()
 }
 
+func TestExportCancel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	exp := NewExporter(reg)
+	sub := exp.Subscribe(outputBuffer)
+	ctx, cancel := context.WithCancel(context.Background())
+	w, r := net.Pipe()
+	defer w.Close()
+
+	errc := make(chan error)
+	go func() {
+		errc <- exp.Export(ctx, r)
+	}()
+	receiveData(t, w, `testdata/example1.sbms`)
+	ensureMetricsEquals(t, reg, `testdata/example1.metrics`)
+
+	// The pipe is still open, but Export returns.
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("unexpected error: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Export did not return once cancelled")
+	}
+	ensureMetricsEquals(t, reg, `testdata/down.metrics`)
+
+	<-sub.C
+	if st := <-sub.C; st.Up || st.Err != context.Canceled {
+		t.Errorf("unexpected last state: got up %v and error %v", st.Up, st.Err)
+	}
+	r.Close()
+}
+
 func receiveData(t *testing.T, w io.Writer, sbms string) {
 	t.Helper()
 
@@ -0,0 +1,368 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expr is a compiled expression over a State, such as
+//
+//	cell_spread > 0.05 and not charging
+//
+// Operands are numbers and the identifiers listed by exprIdentifiers, all
+// evaluating to numbers, booleans being 0 or 1. Operators are, by increasing
+// precedence: or, and, not, the comparisons (== != < <= > >=), + and -, * and
+// /, and unary minus. An expression holds when it evaluates to anything but
+// 0.
+type Expr struct {
+	src  string
+	eval func(st *State) float64
+	// values tells whether the expression uses the values of the frame,
+	// which are meaningless while the device is down.
+	values bool
+}
+
+// exprIdentifier returns the getter of an identifier, and whether it reads
+// the values of the frame, or nil if there is no such identifier.
+func exprIdentifier(name string) (func(st *State) float64, bool) {
+	if name == "up" {
+		return func(st *State) float64 { return boolAsFloat(st.Up) }, false
+	}
+	if f := valuesFloat(name); f != nil {
+		return func(st *State) float64 { return f(&st.Values) }, true
+	}
+	switch name {
+	case "cell_min_voltage":
+		return func(st *State) float64 { min, _ := cellRange(&st.Values); return min }, true
+	case "cell_max_voltage":
+		return func(st *State) float64 { _, max := cellRange(&st.Values); return max }, true
+	case "cell_spread":
+		return func(st *State) float64 { min, max := cellRange(&st.Values); return max - min }, true
+	}
+	for i, flag := range statusFlagNames {
+		if name == "status_"+strings.ToLower(flag) {
+			bit := 1 << uint(i)
+			return func(st *State) float64 { return boolAsFloat(st.Values.Status&bit != 0) }, true
+		}
+	}
+	return nil, false
+}
+
+// exprIdentifiers returns every identifier an expression can use.
+func exprIdentifiers() []string {
+	names := []string{"up"}
+	for _, f := range valuesFields {
+		if valuesFloat(f.name) != nil {
+			names = append(names, f.name)
+		}
+	}
+	names = append(names, "cell_min_voltage", "cell_max_voltage", "cell_spread")
+	for _, flag := range statusFlagNames {
+		names = append(names, "status_"+strings.ToLower(flag))
+	}
+	return names
+}
+
+// cellRange returns the lowest and highest cell voltages.
+func cellRange(v *Values) (float64, float64) {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, cell := range []float64{v.Cell1Voltage, v.Cell2Voltage, v.Cell3Voltage, v.Cell4Voltage, v.Cell5Voltage, v.Cell6Voltage, v.Cell7Voltage, v.Cell8Voltage} {
+		min, max = math.Min(min, cell), math.Max(max, cell)
+	}
+	return min, max
+}
+
+// ParseExpr compiles an expression.
+func ParseExpr(src string) (*Expr, error) {
+	toks, err := exprTokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	e := &Expr{src: src}
+	p.expr = e
+	if e.eval, err = p.or(); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != exprEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos+1)
+	}
+	return e, nil
+}
+
+// Eval evaluates the expression against st.
+func (e *Expr) Eval(st *State) float64 {
+	return e.eval(st)
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+type exprTokenKind int
+
+const (
+	exprEOF exprTokenKind = iota
+	exprNumber
+	exprIdent
+	exprOp
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+func exprTokenize(src string) ([]exprToken, error) {
+	var toks []exprToken
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' || c == '.' }
+	isLetter := func(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' }
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+		case isDigit(c):
+			for i < len(src) && isDigit(src[i]) {
+				i++
+			}
+			toks = append(toks, exprToken{exprNumber, src[start:i], start})
+		case isLetter(c):
+			for i < len(src) && (isLetter(src[i]) || isDigit(src[i]) && src[i] != '.') {
+				i++
+			}
+			kind := exprIdent
+			switch src[start:i] {
+			case "and", "or", "not":
+				kind = exprOp
+			}
+			toks = append(toks, exprToken{kind, src[start:i], start})
+		case strings.HasPrefix(src[i:], "<=") || strings.HasPrefix(src[i:], ">=") ||
+			strings.HasPrefix(src[i:], "==") || strings.HasPrefix(src[i:], "!="):
+			i += 2
+			toks = append(toks, exprToken{exprOp, src[start:i], start})
+		case strings.IndexByte("()+-*/<>", c) >= 0:
+			i++
+			toks = append(toks, exprToken{exprOp, src[start:i], start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i+1)
+		}
+	}
+	return append(toks, exprToken{exprEOF, "end of expression", len(src)}), nil
+}
+
+// exprParser is a recursive descent parser, one method per precedence
+// level, building closures.
+type exprParser struct {
+	toks []exprToken
+	i    int
+	expr *Expr
+}
+
+type exprFunc = func(st *State) float64
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.i]
+}
+
+// accept consumes the next token if it is one of the operators ops.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != exprOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.i++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) or() (exprFunc, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("or"); !ok {
+			return l, nil
+		}
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		a, b := l, r
+		l = func(st *State) float64 { return boolAsFloat(a(st) != 0 || b(st) != 0) }
+	}
+}
+
+func (p *exprParser) and() (exprFunc, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("and"); !ok {
+			return l, nil
+		}
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		a, b := l, r
+		l = func(st *State) float64 { return boolAsFloat(a(st) != 0 && b(st) != 0) }
+	}
+}
+
+func (p *exprParser) not() (exprFunc, error) {
+	if _, ok := p.accept("not"); ok {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(st *State) float64 { return boolAsFloat(x(st) == 0) }, nil
+	}
+	return p.comparison()
+}
+
+func (p *exprParser) comparison() (exprFunc, error) {
+	l, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return l, nil
+	}
+	r, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	var cmp func(a, b float64) bool
+	switch op {
+	case "==":
+		cmp = func(a, b float64) bool { return a == b }
+	case "!=":
+		cmp = func(a, b float64) bool { return a != b }
+	case "<":
+		cmp = func(a, b float64) bool { return a < b }
+	case "<=":
+		cmp = func(a, b float64) bool { return a <= b }
+	case ">":
+		cmp = func(a, b float64) bool { return a > b }
+	default:
+		cmp = func(a, b float64) bool { return a >= b }
+	}
+	return func(st *State) float64 { return boolAsFloat(cmp(l(st), r(st))) }, nil
+}
+
+func (p *exprParser) sum() (exprFunc, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return l, nil
+		}
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		a, b := l, r
+		if op == "+" {
+			l = func(st *State) float64 { return a(st) + b(st) }
+		} else {
+			l = func(st *State) float64 { return a(st) - b(st) }
+		}
+	}
+}
+
+func (p *exprParser) product() (exprFunc, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/")
+		if !ok {
+			return l, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		a, b := l, r
+		if op == "*" {
+			l = func(st *State) float64 { return a(st) * b(st) }
+		} else {
+			l = func(st *State) float64 { return a(st) / b(st) }
+		}
+	}
+}
+
+func (p *exprParser) unary() (exprFunc, error) {
+	if _, ok := p.accept("-"); ok {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(st *State) float64 { return -x(st) }, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprFunc, error) {
+	t := p.peek()
+	switch {
+	case t.kind == exprNumber:
+		p.i++
+		x, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.text, t.pos+1)
+		}
+		return func(*State) float64 { return x }, nil
+	case t.kind == exprIdent:
+		p.i++
+		f, values := exprIdentifier(t.text)
+		if f == nil {
+			return nil, fmt.Errorf("unknown identifier %q at position %d, expected one of %s", t.text, t.pos+1, strings.Join(exprIdentifiers(), ", "))
+		}
+		p.expr.values = p.expr.values || values
+		return f, nil
+	case t.kind == exprOp && t.text == "(":
+		p.i++
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			t := p.peek()
+			return nil, fmt.Errorf("expected \")\" at position %d, got %q", t.pos+1, t.text)
+		}
+		return x, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos+1)
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	v := new(Values)
+	if err := v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(")); err != nil {
+		t.Fatal(err)
+	}
+	st := &State{Up: true, Values: *v}
+
+	testCases := []struct {
+		expr   string
+		want   float64
+		values bool
+	}{
+		{"1 + 2 * 3", 7, false},
+		{"(1 + 2) * 3", 9, false},
+		{"-2 - -3", 1, false},
+		{"10 / 4", 2.5, false},
+		{"up", 1, false},
+		{"not up or 1 > 2", 0, false},
+		{"state_of_charge", 100, true},
+		{"state_of_charge >= 100 and charging == 1", 1, true},
+		{"cell_max_voltage", 3.466, true},
+		{"cell_min_voltage", 3.457, true},
+		{"cell_spread > 0.005", 1, true},
+		{"status_cfet and status_dfet and not status_uv", 1, true},
+		{"battery_voltage - (cell1_voltage+cell2_voltage+cell3_voltage+cell4_voltage+cell5_voltage+cell6_voltage+cell7_voltage+cell8_voltage)", 0, true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.expr, func(t *testing.T) {
+			e, err := ParseExpr(tC.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Eval(st); math.Abs(got-tC.want) > 1e-9 {
+				t.Errorf("unexpected value: got %v, want %v", got, tC.want)
+			}
+			if e.values != tC.values {
+				t.Errorf("unexpected use of values: got %v, want %v", e.values, tC.values)
+			}
+		})
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	testCases := []struct {
+		expr string
+		err  string
+	}{
+		{"", `unexpected "end of expression" at position 1`},
+		{"soc < 20", `unknown identifier "soc" at position 1`},
+		{"status_flags", `unknown identifier "status_flags" at position 1, expected one of up, state_of_charge,`},
+		{"soc", `, cell_spread, status_`},
+		{"(1 + 2", `expected ")" at position 7`},
+		{"1 2", `unexpected "2" at position 3`},
+		{"1 & 2", `unexpected character '&' at position 3`},
+		{"1..2", `invalid number "1..2" at position 1`},
+		{"1 < 2 == 1", `unexpected "==" at position 7`},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.expr, func(t *testing.T) {
+			_, err := ParseExpr(tC.expr)
+			if err == nil || !strings.Contains(err.Error(), tC.err) {
+				t.Errorf("unexpected error: got %v, want %q", err, tC.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthStatus is the body of the /-/healthy and /-/ready responses.
+type healthStatus struct {
+	Status string `json:"status"`
+	// Source is open while it is being read, and closed once it ended or
+	// failed.
+	Source    string     `json:"source"`
+	Up        bool       `json:"up"`
+	LastFrame *time.Time `json:"lastFrame,omitempty"`
+	// Reason tells why the exporter is not ready.
+	Reason string `json:"reason,omitempty"`
+	// Error is the error which stopped the reading of the source.
+	Error string `json:"error,omitempty"`
+	// DecodeError is the last error decoding a line, at DecodeErrorTime.
+	DecodeError     string     `json:"decodeError,omitempty"`
+	DecodeErrorTime *time.Time `json:"decodeErrorTime,omitempty"`
+}
+
+// NewHealthHandler returns the handler serving /-/healthy and /-/ready. The
+// exporter is healthy as long as it answers, and ready while the source is
+// open and a valid frame was received within maxAge.
+func NewHealthHandler(exp *Exporter, maxAge time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		res := newHealthStatus(exp.State())
+		res.Status = "healthy"
+		writeJSON(w, http.StatusOK, res)
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		st := exp.State()
+		res := newHealthStatus(st)
+		switch age := exp.now().Sub(st.Received); {
+		case st.Err != nil:
+			res.Reason = "source closed"
+		case st.Received.IsZero():
+			res.Reason = "no valid frame received"
+		case age > maxAge:
+			res.Reason = fmt.Sprintf("no valid frame received for %v", age.Round(time.Second))
+		}
+		if res.Reason != "" {
+			res.Status = "not ready"
+			writeJSON(w, http.StatusServiceUnavailable, res)
+			return
+		}
+		res.Status = "ready"
+		writeJSON(w, http.StatusOK, res)
+	})
+	return mux
+}
+
+func newHealthStatus(st State) healthStatus {
+	res := healthStatus{Source: "open", Up: st.Up}
+	if st.Err != nil {
+		res.Source, res.Error = "closed", st.Err.Error()
+	}
+	if !st.Received.IsZero() {
+		res.LastFrame = &st.Received
+	}
+	if st.DecodeErr != nil {
+		res.DecodeError, res.DecodeErrorTime = st.DecodeErr.Error(), &st.DecodeErrTime
+	}
+	return res
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHealthHandler(t *testing.T) {
+	exp := NewExporter(prometheus.NewRegistry())
+	now := time.Date(2019, 11, 14, 23, 2, 11, 0, time.UTC)
+	exp.now = func() time.Time { return now }
+	h := NewHealthHandler(exp, time.Minute)
+	sub := exp.Subscribe(outputBuffer)
+	w, r := net.Pipe()
+	go exp.Export(context.Background(), r)
+
+	ensure := func(path string, code int, want string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != code {
+			t.Errorf("got status %d for %s, want %d", rec.Code, path, code)
+		}
+		if diff := cmp.Diff(want, rec.Body.String()); diff != "" {
+			t.Errorf("%s body mismatch (-want +got):\n%s", path, diff)
+		}
+	}
+
+	ensure("/-/healthy", http.StatusOK, `{"status":"healthy","source":"open","up":false}`+"\n")
+	ensure("/-/ready", http.StatusServiceUnavailable, `{"status":"not ready","source":"open","up":false,"reason":"no valid frame received"}`+"\n")
+
+	receiveData(t, w, "testdata/example1.sbms")
+	<-sub.C
+	ensure("/-/ready", http.StatusOK, `{"status":"ready","source":"open","up":true,"lastFrame":"2019-11-14T23:02:11Z"}`+"\n")
+
+	// Invalid frames do not refresh the last frame, but are reported.
+	now = now.Add(30 * time.Second)
+	receiveData(t, w, "testdata/too-short.sbms")
+	<-sub.C
+	ensure("/-/ready", http.StatusOK, `{"status":"ready","source":"open","up":false,"lastFrame":"2019-11-14T23:02:11Z","decodeError":"invalid data length","decodeErrorTime":"2019-11-14T23:02:41Z"}`+"\n")
+	now = now.Add(45 * time.Second)
+	ensure("/-/ready", http.StatusServiceUnavailable, `{"status":"not ready","source":"open","up":false,"lastFrame":"2019-11-14T23:02:11Z","reason":"no valid frame received for 1m15s","decodeError":"invalid data length","decodeErrorTime":"2019-11-14T23:02:41Z"}`+"\n")
+
+	// The last decode error is kept once frames are decoded again.
+	receiveData(t, w, "testdata/example1.sbms")
+	<-sub.C
+	ensure("/-/ready", http.StatusOK, `{"status":"ready","source":"open","up":true,"lastFrame":"2019-11-14T23:03:26Z","decodeError":"invalid data length","decodeErrorTime":"2019-11-14T23:02:41Z"}`+"\n")
+
+	w.Close()
+	<-sub.C
+	ensure("/-/ready", http.StatusServiceUnavailable, `{"status":"not ready","source":"closed","up":false,"lastFrame":"2019-11-14T23:03:26Z","reason":"source closed","error":"EOF","decodeError":"invalid data length","decodeErrorTime":"2019-11-14T23:02:41Z"}`+"\n")
+	ensure("/-/healthy", http.StatusOK, `{"status":"healthy","source":"closed","up":false,"lastFrame":"2019-11-14T23:03:26Z","error":"EOF","decodeError":"invalid data length","decodeErrorTime":"2019-11-14T23:02:41Z"}`+"\n")
+}
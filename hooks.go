@@ -0,0 +1,339 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultHookTimeout is the timeout of hook commands when none is set.
+const defaultHookTimeout = time.Minute
+
+// HooksConfig is the content of a hooks file.
+type HooksConfig struct {
+	Hooks []Hook `yaml:"hooks"`
+}
+
+// Hook runs a command when a field of the decoded frames crosses a
+// threshold, and another one when it crosses back a second threshold. The
+// gap between the two thresholds is the hysteresis.
+type Hook struct {
+	Name  string `yaml:"name"`
+	Field string `yaml:"field"`
+
+	Activate   HookCondition `yaml:"activate"`
+	Deactivate HookCondition `yaml:"deactivate"`
+
+	// MinActive and MinInactive are the shortest times the hook stays in a
+	// state before it can leave it.
+	MinActive   time.Duration `yaml:"min_active"`
+	MinInactive time.Duration `yaml:"min_inactive"`
+	// Timeout is the time after which commands are killed.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// HookCondition is a threshold the field must stay below or above for some
+// time before the command is run.
+type HookCondition struct {
+	Below   *float64      `yaml:"below"`
+	Above   *float64      `yaml:"above"`
+	For     time.Duration `yaml:"for"`
+	Command []string      `yaml:"command"`
+}
+
+func (c *HookCondition) met(x float64) bool {
+	if c.Below != nil {
+		return x < *c.Below
+	}
+	return x > *c.Above
+}
+
+// LoadHooksFile reads and validates a hooks file.
+func LoadHooksFile(path string) (*HooksConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &HooksConfig{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *HooksConfig) validate() error {
+	names := map[string]bool{}
+	for i := range cfg.Hooks {
+		h := &cfg.Hooks[i]
+		if h.Name == "" {
+			return fmt.Errorf("hook %d has no name", i+1)
+		}
+		if names[h.Name] {
+			return fmt.Errorf("duplicate hook %q", h.Name)
+		}
+		names[h.Name] = true
+
+		if valuesFloat(h.Field) == nil {
+			return fmt.Errorf("hook %q: unknown or non-numeric field %q", h.Name, h.Field)
+		}
+		a, d := &h.Activate, &h.Deactivate
+		if (a.Below == nil) == (a.Above == nil) || (d.Below == nil) == (d.Above == nil) {
+			return fmt.Errorf("hook %q: activate and deactivate need one of below or above", h.Name)
+		}
+		// The deactivation threshold must be on the other side of the
+		// activation one, so both conditions never hold at once.
+		switch {
+		case a.Below != nil && (d.Above == nil || *d.Above < *a.Below):
+			return fmt.Errorf("hook %q: deactivate needs to be above %v", h.Name, *a.Below)
+		case a.Above != nil && (d.Below == nil || *d.Below > *a.Above):
+			return fmt.Errorf("hook %q: deactivate needs to be below %v", h.Name, *a.Above)
+		}
+		if len(a.Command) == 0 && len(d.Command) == 0 {
+			return fmt.Errorf("hook %q has no command", h.Name)
+		}
+		if h.Timeout <= 0 {
+			h.Timeout = defaultHookTimeout
+		}
+	}
+	return nil
+}
+
+// HookRunner evaluates hooks against every decoded frame and runs their
+// commands.
+type HookRunner struct {
+	mu    sync.Mutex
+	hooks []*hookState
+
+	active      *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+	lastChange  *prometheus.GaugeVec
+}
+
+type hookState struct {
+	Hook
+	value func(v *Values) float64
+
+	active bool
+	// since is the time of the last transition, and pending the time since
+	// which the condition of the next one holds, zero when it does not.
+	since   time.Time
+	pending time.Time
+}
+
+// NewHookRunner returns a runner of the hooks of cfg, registering the
+// metrics of their state with reg.
+func NewHookRunner(cfg *HooksConfig, reg prometheus.Registerer) *HookRunner {
+	r := &HookRunner{
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sbms",
+			Subsystem: "hook",
+			Name:      "active",
+			Help:      "Whether the hook is active.",
+		}, []string{"hook"}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sbms",
+			Subsystem: "hook",
+			Name:      "transitions_total",
+			Help:      "Number of times the hook became active or inactive.",
+		}, []string{"hook", "state"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sbms",
+			Subsystem: "hook",
+			Name:      "command_failures_total",
+			Help:      "Number of hook commands that failed or timed out.",
+		}, []string{"hook"}),
+		lastChange: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sbms",
+			Subsystem: "hook",
+			Name:      "last_transition_timestamp_seconds",
+			Help:      "The unix time of the last transition of the hook.",
+		}, []string{"hook"}),
+	}
+	reg.MustRegister(r.active, r.transitions, r.failures, r.lastChange)
+	r.Reload(cfg)
+	return r
+}
+
+// Reload replaces the hooks by those of cfg, which must have been validated.
+// Hooks keep their state when their name and field are unchanged, so their
+// commands do not run again; the others start inactive.
+func (r *HookRunner) Reload(cfg *HooksConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := map[string]*hookState{}
+	for _, h := range r.hooks {
+		old[h.Name] = h
+	}
+	r.hooks = nil
+	for _, h := range cfg.Hooks {
+		s := &hookState{Hook: h, value: valuesFloat(h.Field)}
+		if o := old[h.Name]; o != nil && o.Field == h.Field {
+			s.active, s.since, s.pending = o.active, o.since, o.pending
+		}
+		delete(old, h.Name)
+		r.hooks = append(r.hooks, s)
+		r.active.WithLabelValues(h.Name).Set(boolAsFloat(s.active))
+		r.transitions.WithLabelValues(h.Name, "active")
+		r.transitions.WithLabelValues(h.Name, "inactive")
+		r.failures.WithLabelValues(h.Name)
+	}
+	for name := range old {
+		r.active.DeleteLabelValues(name)
+		r.transitions.DeleteLabelValues(name, "active")
+		r.transitions.DeleteLabelValues(name, "inactive")
+		r.failures.DeleteLabelValues(name)
+		r.lastChange.DeleteLabelValues(name)
+	}
+}
+
+// Run evaluates the hooks against the states received from sub until it is
+// closed, then waits for the commands running. Frames are evaluated at the
+// time they were received, and the commands of each hook run one at a time
+// in the background, so that a slow command neither holds up the states nor
+// the other hooks. Commands are dropped, with a warning, when too many of a
+// hook are waiting.
+func (r *HookRunner) Run(sub *Subscription) {
+	var wg sync.WaitGroup
+	workers := map[string]chan hookCommand{}
+	for st := range sub.C {
+		for _, c := range r.evaluate(st) {
+			w := workers[c.hook.Name]
+			if w == nil {
+				w = make(chan hookCommand, outputBuffer)
+				workers[c.hook.Name] = w
+				wg.Add(1)
+				go func() {
+					for c := range w {
+						r.run(c)
+					}
+					wg.Done()
+				}()
+			}
+			select {
+			case w <- c:
+			default:
+				log.Warnf("Dropping the %s command of hook %s, %d already waiting", c.state, c.hook.Name, len(w))
+			}
+		}
+	}
+	for _, w := range workers {
+		close(w)
+	}
+	wg.Wait()
+}
+
+// hookCommand is a command to run on a transition of a hook.
+type hookCommand struct {
+	hook    *hookState
+	state   string
+	value   float64
+	command []string
+}
+
+// evaluate updates the hooks with st and returns the commands to run, which
+// run without holding the lock so that reloads do not wait for them.
+func (r *HookRunner) evaluate(st State) []hookCommand {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cmds []hookCommand
+	for _, h := range r.hooks {
+		// A closed source is no evidence, conditions have to hold again
+		// once the device is back. Lines that could not be decoded do not
+		// tell anything either way.
+		if st.Err != nil {
+			h.pending = time.Time{}
+			continue
+		}
+		if !st.Up {
+			continue
+		}
+
+		x := h.value(&st.Values)
+		next, minTime := &h.Activate, h.MinInactive
+		if h.active {
+			next, minTime = &h.Deactivate, h.MinActive
+		}
+		if !next.met(x) {
+			h.pending = time.Time{}
+			continue
+		}
+		if h.pending.IsZero() {
+			h.pending = st.Received
+		}
+		if st.Received.Sub(h.pending) < next.For || st.Received.Sub(h.since) < minTime {
+			continue
+		}
+
+		h.active, h.since, h.pending = !h.active, st.Received, time.Time{}
+		state := "inactive"
+		if h.active {
+			state = "active"
+		}
+		log.Infof("Hook %s is now %s, %s is %v", h.Name, state, h.Field, x)
+		r.active.WithLabelValues(h.Name).Set(boolAsFloat(h.active))
+		r.transitions.WithLabelValues(h.Name, state).Inc()
+		r.lastChange.WithLabelValues(h.Name).Set(float64(st.Received.UnixNano()) / 1e9)
+
+		if len(next.Command) > 0 {
+			cmds = append(cmds, hookCommand{hook: h, state: state, value: x, command: next.Command})
+		}
+	}
+	return cmds
+}
+
+func (r *HookRunner) run(c hookCommand) {
+	if err := runHookCommand(c.hook, c.state, c.value, c.command); err != nil {
+		log.Errorf("Error running command of hook %s: %v", c.hook.Name, err)
+		r.failures.WithLabelValues(c.hook.Name).Inc()
+	}
+}
+
+// runHookCommand runs a command with the state of the hook in its
+// environment, killing it after the timeout of the hook.
+func runHookCommand(h *hookState, state string, x float64, command []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SBMS_HOOK="+h.Name,
+		"SBMS_HOOK_STATE="+state,
+		"SBMS_FIELD="+h.Field,
+		"SBMS_VALUE="+strconv.FormatFloat(x, 'f', -1, 64),
+	)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", h.Timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeHooksFile(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "hooks.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHookRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	cfg, err := LoadHooksFile(writeHooksFile(t, dir, `
+hooks:
+  - name: shed_loads
+    field: state_of_charge
+    activate:
+      below: 30
+      for: 2m
+      command: [sh, -c, 'echo "$SBMS_HOOK $SBMS_HOOK_STATE $SBMS_FIELD=$SBMS_VALUE" >> `+out+`']
+    deactivate:
+      above: 60
+      command: [sh, -c, 'echo "$SBMS_HOOK $SBMS_HOOK_STATE $SBMS_FIELD=$SBMS_VALUE" >> `+out+`']
+    min_active: 10m
+  - name: slow
+    field: charging
+    activate:
+      above: 0.5
+      command: [sleep, "10"]
+    deactivate:
+      below: 0.5
+    timeout: 10ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewHookRunner(cfg, prometheus.NewRegistry())
+
+	start := time.Date(2019, 11, 14, 12, 0, 0, 0, time.UTC)
+	states := []struct {
+		after time.Duration
+		soc   int
+		up    bool
+		err   error
+	}{
+		{0, 50, true, nil},
+		{time.Minute, 25, true, nil},
+		{2 * time.Minute, 25, true, nil},
+		{2*time.Minute + 30*time.Second, 25, false, io.EOF}, // a closed source resets the pending condition
+		{3 * time.Minute, 25, true, nil},
+		{4 * time.Minute, 25, true, nil},
+		{4*time.Minute + 30*time.Second, 25, false, nil}, // a garbled line does not
+		{5 * time.Minute, 20, true, nil},                 // active
+		{6 * time.Minute, 70, true, nil},                 // not active for 10m yet
+		{14 * time.Minute, 65, true, nil},
+		{16 * time.Minute, 50, true, nil}, // inside the hysteresis
+		{20 * time.Minute, 61, true, nil}, // inactive
+	}
+	for _, s := range states {
+		st := State{Up: s.up, Values: Values{StateOfCharge: s.soc, Charging: true}, Received: start.Add(s.after), Err: s.err}
+		for _, c := range r.evaluate(st) {
+			r.run(c)
+		}
+	}
+
+	got, _ := ioutil.ReadFile(out)
+	want := "shed_loads active state_of_charge=20\nshed_loads inactive state_of_charge=61\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("commands mismatch (-want +got):\n%s", diff)
+	}
+
+	if v := testutil.ToFloat64(r.transitions.WithLabelValues("shed_loads", "active")); v != 1 {
+		t.Errorf("unexpected active transitions: %v", v)
+	}
+	if v := testutil.ToFloat64(r.active.WithLabelValues("shed_loads")); v != 0 {
+		t.Errorf("unexpected active state: %v", v)
+	}
+	if v := testutil.ToFloat64(r.lastChange.WithLabelValues("shed_loads")); v != float64(start.Add(20*time.Minute).Unix()) {
+		t.Errorf("unexpected last transition: %v", v)
+	}
+	if v := testutil.ToFloat64(r.active.WithLabelValues("slow")); v != 1 {
+		t.Errorf("unexpected active state of the slow hook: %v", v)
+	}
+	if v := testutil.ToFloat64(r.failures.WithLabelValues("slow")); v != 1 {
+		t.Errorf("timed out command not counted as a failure: %v", v)
+	}
+}
+
+func TestHookRunnerSlowCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := LoadHooksFile(writeHooksFile(t, dir, `
+hooks:
+  - name: slow
+    field: charging
+    activate:
+      above: 0.5
+      command: [sleep, "10"]
+    deactivate:
+      below: 0.5
+    timeout: 1s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewHookRunner(cfg, prometheus.NewRegistry())
+	hub := NewHub()
+	sub := hub.Subscribe(outputBuffer)
+	done := make(chan struct{})
+	go func() {
+		r.Run(sub)
+		close(done)
+	}()
+
+	// The hook is evaluated while its command runs.
+	now := time.Now()
+	hub.Publish(State{Up: true, Values: Values{Charging: true}, Received: now})
+	hub.Publish(State{Up: true, Values: Values{Charging: false}, Received: now.Add(time.Second)})
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for testutil.ToFloat64(r.transitions.WithLabelValues("slow", "inactive")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the hook was not evaluated while its command ran")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hub.Close()
+	<-done
+	if v := testutil.ToFloat64(r.failures.WithLabelValues("slow")); v != 1 {
+		t.Errorf("timed out command not counted as a failure: %v", v)
+	}
+}
+
+func TestLoadHooksFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		desc    string
+		content string
+		err     string
+	}{
+		{"unknown field", `hooks: [{name: a, field: soc, activate: {below: 1, command: [true]}, deactivate: {above: 2}}]`, `unknown or non-numeric field "soc"`},
+		{"text field", `hooks: [{name: a, field: status_flags, activate: {below: 1, command: [true]}, deactivate: {above: 2}}]`, `unknown or non-numeric field`},
+		{"no threshold", `hooks: [{name: a, field: state_of_charge, activate: {command: [true]}, deactivate: {above: 2}}]`, `need one of below or above`},
+		{"overlap", `hooks: [{name: a, field: state_of_charge, activate: {below: 30, command: [true]}, deactivate: {above: 20}}]`, `deactivate needs to be above 30`},
+		{"same direction", `hooks: [{name: a, field: state_of_charge, activate: {below: 30, command: [true]}, deactivate: {below: 60}}]`, `deactivate needs to be above 30`},
+		{"no command", `hooks: [{name: a, field: state_of_charge, activate: {below: 30}, deactivate: {above: 60}}]`, `has no command`},
+		{"duplicate", `hooks: [{name: a, field: state_of_charge, activate: {below: 30, command: [true]}, deactivate: {above: 60}}, {name: a, field: state_of_charge, activate: {below: 30, command: [true]}, deactivate: {above: 60}}]`, `duplicate hook "a"`},
+		{"unknown key", `hooks: [{name: a, field: state_of_charge, activate: {below: 30, command: [true]}, deactivate: {above: 60}, foo: 1}]`, `field foo not found`},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := LoadHooksFile(writeHooksFile(t, dir, tC.content))
+			if err == nil || !strings.Contains(err.Error(), tC.err) {
+				t.Errorf("unexpected error: got %v, want %q", err, tC.err)
+			}
+		})
+	}
+}
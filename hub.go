@@ -0,0 +1,97 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+)
+
+// outputBuffer is the number of states an output can lag behind before it
+// starts missing some.
+const outputBuffer = 64
+
+// Hub fans out the states published by an Exporter to its subscribers.
+// Publishing never blocks: a subscriber that falls behind misses states
+// rather than holding up the reader loop.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscription receives the states published to a Hub on C. C is closed
+// when either the subscription or the hub is closed.
+type Subscription struct {
+	C <-chan State
+
+	c   chan State
+	hub *Hub
+}
+
+// NewHub returns an empty Hub.
+func NewHub() *Hub {
+	return &Hub{subs: map[*Subscription]struct{}{}}
+}
+
+// Subscribe returns a new subscription buffering up to buffer states.
+func (h *Hub) Subscribe(buffer int) *Subscription {
+	c := make(chan State, buffer)
+	s := &Subscription{C: c, c: c, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(c)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+// Publish sends st to every subscriber with room left in its buffer.
+func (h *Hub) Publish(st State) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		select {
+		case s.c <- st:
+		default:
+		}
+	}
+}
+
+// Close closes every subscription. Later subscriptions are closed
+// right away.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	for s := range h.subs {
+		close(s.c)
+		delete(h.subs, s)
+	}
+	h.closed = true
+}
+
+// Close stops the subscription and closes C.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if _, ok := s.hub.subs[s]; ok {
+		close(s.c)
+		delete(s.hub.subs, s)
+	}
+}
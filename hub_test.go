@@ -0,0 +1,60 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	fast := hub.Subscribe(3)
+	slow := hub.Subscribe(1)
+	gone := hub.Subscribe(1)
+	gone.Close()
+
+	for soc := 1; soc <= 3; soc++ {
+		hub.Publish(State{Up: true, Values: Values{StateOfCharge: soc}})
+	}
+	hub.Close()
+
+	for _, tC := range []struct {
+		name string
+		sub  *Subscription
+		want []int
+	}{
+		{name: "fast", sub: fast, want: []int{1, 2, 3}},
+		{name: "slow", sub: slow, want: []int{1}},
+		{name: "gone", sub: gone, want: nil},
+		{name: "late", sub: hub.Subscribe(1), want: nil},
+	} {
+		var got []int
+		for st := range tC.sub.C {
+			got = append(got, st.Values.StateOfCharge)
+		}
+		if len(got) != len(tC.want) {
+			t.Errorf("%s: unexpected states: got %v, want %v", tC.name, got, tC.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tC.want[i] {
+				t.Errorf("%s: unexpected states: got %v, want %v", tC.name, got, tC.want)
+				break
+			}
+		}
+	}
+
+	// Closing a subscription of a closed hub is a no-op.
+	fast.Close()
+}
@@ -0,0 +1,183 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// ImportStats summarizes an import.
+type ImportStats struct {
+	Imported   int
+	Skipped    int
+	Duplicates int
+}
+
+// Import decodes the records of SBMS microSD data logs read from rs and
+// writes them to w in the OpenMetrics text format, each sample timestamped
+// with the date reported by the device. The output is meant to be fed to
+// `promtool tsdb create-blocks-from openmetrics`.
+//
+// Records that cannot be decoded are skipped. Records sharing the same
+// device date are collapsed into the last one read, as Prometheus rejects
+// duplicate samples.
+func Import(w io.Writer, rs ...io.Reader) (ImportStats, error) {
+	var stats ImportStats
+	var records []Values
+
+	for _, r := range rs {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			line := bytes.TrimSpace(s.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var v Values
+			if err := v.ReadFrom(line); err != nil {
+				stats.Skipped++
+				continue
+			}
+			records = append(records, v)
+		}
+		if s.Err() != nil {
+			return stats, s.Err()
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Date.Before(records[j].Date)
+	})
+	deduped := records[:0]
+	for i := range records {
+		if n := len(deduped); n > 0 && deduped[n-1].Date.Equal(records[i].Date) {
+			deduped[n-1] = records[i]
+			stats.Duplicates++
+			continue
+		}
+		deduped = append(deduped, records[i])
+	}
+	records = deduped
+
+	reg := prometheus.NewRegistry()
+	exp := NewExporter(reg)
+	reg.Unregister(exp.up)
+	exp.ensureExporterRegistered()
+
+	// OpenMetrics wants the points of a series to be contiguous, so they are
+	// buffered per series and written out once every record is processed.
+	var families []*dto.MetricFamily
+	series := map[string][]string{}
+	points := map[string]*bytes.Buffer{}
+
+	for i := range records {
+		exp.set(&records[i])
+		mfs, err := reg.Gather()
+		if err != nil {
+			return stats, err
+		}
+		ts := strconv.FormatInt(records[i].Date.Unix(), 10)
+		for _, mf := range mfs {
+			if _, ok := series[mf.GetName()]; !ok {
+				families = append(families, mf)
+			}
+			for _, m := range mf.Metric {
+				key := mf.GetName() + openMetricsLabels(m.Label)
+				buf, ok := points[key]
+				if !ok {
+					buf = new(bytes.Buffer)
+					points[key] = buf
+					series[mf.GetName()] = append(series[mf.GetName()], key)
+				}
+				buf.WriteString(key + " " + strconv.FormatFloat(m.GetGauge().GetValue(), 'g', -1, 64) + " " + ts + "\n")
+			}
+		}
+		stats.Imported++
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, mf := range families {
+		bw.WriteString("# HELP " + mf.GetName() + " " + escapeOpenMetrics(mf.GetHelp()) + "\n")
+		bw.WriteString("# TYPE " + mf.GetName() + " gauge\n")
+		for _, key := range series[mf.GetName()] {
+			points[key].WriteTo(bw)
+		}
+	}
+	bw.WriteString("# EOF\n")
+
+	return stats, bw.Flush()
+}
+
+func runImport(files []string, output string) error {
+	var rs []io.Reader
+	for _, file := range files {
+		if file == "-" {
+			rs = append(rs, os.Stdin)
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rs = append(rs, f)
+	}
+
+	w := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	stats, err := Import(w, rs...)
+	if output != "" {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Imported %d records (%d undecodable skipped, %d duplicates dropped)", stats.Imported, stats.Skipped, stats.Duplicates)
+	return nil
+}
+
+func openMetricsLabels(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	ls := make([]string, 0, len(labels))
+	for _, l := range labels {
+		ls = append(ls, l.GetName()+`="`+escapeOpenMetrics(l.GetValue())+`"`)
+	}
+	return "{" + strings.Join(ls, ",") + "}"
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeOpenMetrics(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestImport(t *testing.T) {
+	f, err := os.Open(`testdata/sdcard.log`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := new(bytes.Buffer)
+	stats, err := Import(b, f)
+	if err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+
+	if diff := cmp.Diff(ImportStats{Imported: 2, Skipped: 1, Duplicates: 1}, stats); diff != "" {
+		t.Errorf("stats mismatch (-want +got):\n%s", diff)
+	}
+
+	golden := `testdata/sdcard.openmetrics`
+	if *update {
+		if err := ioutil.WriteFile(golden, b.Bytes(), 0644); err != nil {
+			t.Fatalf("unexpected error: %q", err)
+		}
+	}
+
+	want, _ := ioutil.ReadFile(golden)
+	if diff := cmp.Diff(string(want), b.String()); diff != "" {
+		t.Errorf("output does not match golden file %s (-want +got):\n%s", golden, diff)
+	}
+}
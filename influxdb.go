@@ -0,0 +1,253 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// InfluxDBConfig configures an InfluxDBWriter.
+type InfluxDBConfig struct {
+	// URL is the base URL of the server, e.g. http://localhost:8086.
+	URL string
+	// Version selects the write API: 1 for /write, 2 for /api/v2/write.
+	Version int
+
+	// Database, RetentionPolicy, Username and Password are used by the v1
+	// API.
+	Database        string
+	RetentionPolicy string
+	Username        string
+	Password        string
+
+	// Org, Bucket and Token are used by the v2 API.
+	Org    string
+	Bucket string
+	Token  string
+
+	Measurement string
+	Tags        map[string]string
+
+	// BatchSize is the number of points sent per request.
+	BatchSize int
+	// FlushInterval is the longest time a point waits before being sent.
+	FlushInterval time.Duration
+	// BufferSize is the number of points kept while the server is
+	// unreachable. The oldest points are dropped beyond that.
+	BufferSize int
+	Timeout    time.Duration
+}
+
+// InfluxDBWriter writes every decoded frame to InfluxDB as a point in line
+// protocol, timestamped with the device date.
+type InfluxDBWriter struct {
+	cfg    InfluxDBConfig
+	client *http.Client
+	now    func() time.Time
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	backoff    time.Duration
+	retryAt    time.Time
+
+	points [][]byte
+}
+
+// NewInfluxDBWriter returns a writer sending points to the server described
+// by cfg.
+func NewInfluxDBWriter(cfg InfluxDBConfig) *InfluxDBWriter {
+	return &InfluxDBWriter{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		now:        time.Now,
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+	}
+}
+
+// Run buffers the frames received from sub and writes them in batches until
+// sub is closed, at which point the remaining points are flushed once.
+func (w *InfluxDBWriter) Run(sub *Subscription) {
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				w.retryAt = time.Time{}
+				w.flush()
+				if n := len(w.points); n > 0 {
+					log.Warnf("Dropping %d InfluxDB points on exit", n)
+				}
+				return
+			}
+			if !st.Up {
+				continue
+			}
+			w.add(influxDBLine(w.cfg.Measurement, w.cfg.Tags, &st.Values))
+			if len(w.points) >= w.cfg.BatchSize {
+				w.flush()
+			}
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *InfluxDBWriter) add(point []byte) {
+	w.points = append(w.points, point)
+	if dropped := len(w.points) - w.cfg.BufferSize; dropped > 0 {
+		log.Warnf("InfluxDB buffer full, dropping %d oldest points", dropped)
+		w.points = append(w.points[:0], w.points[dropped:]...)
+	}
+}
+
+// flush writes the buffered points in batches, stopping at the first failure
+// so the remaining points are retried once the backoff has elapsed.
+func (w *InfluxDBWriter) flush() {
+	if w.now().Before(w.retryAt) {
+		return
+	}
+
+	for len(w.points) > 0 {
+		n := len(w.points)
+		if n > w.cfg.BatchSize {
+			n = w.cfg.BatchSize
+		}
+
+		retry, err := w.write(w.points[:n])
+		if err != nil && retry {
+			w.backoff *= 2
+			if w.backoff == 0 {
+				w.backoff = w.minBackoff
+			}
+			if w.backoff > w.maxBackoff {
+				w.backoff = w.maxBackoff
+			}
+			w.retryAt = w.now().Add(w.backoff)
+			log.Warnf("Error writing to InfluxDB, retrying in %s: %v", w.backoff, err)
+			return
+		}
+		if err != nil {
+			log.Errorf("Error writing to InfluxDB, dropping %d points: %v", n, err)
+		}
+
+		w.backoff = 0
+		w.points = append(w.points[:0], w.points[n:]...)
+	}
+}
+
+// write sends points and tells, on failure, whether they should be retried.
+func (w *InfluxDBWriter) write(points [][]byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.writeURL(), bytes.NewReader(bytes.Join(points, []byte{'\n'})))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.cfg.Version == 2 {
+		req.Header.Set("Authorization", "Token "+w.cfg.Token)
+	} else if w.cfg.Username != "" {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode/100 == 5:
+		return true, fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(body))
+	default:
+		return false, fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+}
+
+func (w *InfluxDBWriter) writeURL() string {
+	q := url.Values{}
+	q.Set("precision", "s")
+	if w.cfg.Version == 2 {
+		q.Set("org", w.cfg.Org)
+		q.Set("bucket", w.cfg.Bucket)
+		return strings.TrimSuffix(w.cfg.URL, "/") + "/api/v2/write?" + q.Encode()
+	}
+	q.Set("db", w.cfg.Database)
+	if w.cfg.RetentionPolicy != "" {
+		q.Set("rp", w.cfg.RetentionPolicy)
+	}
+	return strings.TrimSuffix(w.cfg.URL, "/") + "/write?" + q.Encode()
+}
+
+var (
+	influxDBKeyEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxDBStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// influxDBLine returns v as a point in line protocol with a precision of a
+// second.
+func influxDBLine(measurement string, tags map[string]string, v *Values) []byte {
+	b := new(bytes.Buffer)
+	b.WriteString(strings.NewReplacer(",", `\,`, " ", `\ `).Replace(measurement))
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("," + influxDBKeyEscaper.Replace(k) + "=" + influxDBKeyEscaper.Replace(tags[k]))
+	}
+
+	sep := byte(' ')
+	for _, f := range valuesFields {
+		var value string
+		switch fv := f.value(v).(type) {
+		case time.Time:
+			// The device date is the point timestamp.
+			continue
+		case int:
+			value = strconv.Itoa(fv) + "i"
+		case float64:
+			value = strconv.FormatFloat(fv, 'f', -1, 64)
+		case bool:
+			value = strconv.FormatBool(fv)
+		case []string:
+			value = `"` + influxDBStringEscaper.Replace(strings.Join(fv, ",")) + `"`
+		default:
+			value = `"` + influxDBStringEscaper.Replace(fmt.Sprint(fv)) + `"`
+		}
+		b.WriteByte(sep)
+		b.WriteString(influxDBKeyEscaper.Replace(f.name) + "=" + value)
+		sep = ','
+	}
+
+	b.WriteString(" " + strconv.FormatInt(v.Date.Unix(), 10))
+	return b.Bytes()
+}
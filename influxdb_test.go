@@ -0,0 +1,164 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const influxDBExample1 = `sbms,site=cabin\ 1 state_of_charge=100i,cell1_voltage=3.464,cell2_voltage=3.465,cell3_voltage=3.466,cell4_voltage=3.466,cell5_voltage=3.457,cell6_voltage=3.46,cell7_voltage=3.466,cell8_voltage=3.465,internal_temperature=25.6,external_temperature=-45,charging=true,battery_current=0.591,pv1_current=0,pv2_current=0.937,external_load_current=0,adc2=0i,adc3=0i,adc4=0i,heat1=0i,heat2=0i,status=20480i,status_flags="CFET,DFET",battery_voltage=27.709000000000003,battery_power=16.376019 1461512493`
+
+type influxDBRequest struct {
+	Path  string
+	Query string
+	Auth  string
+	Body  string
+}
+
+type influxDBServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	requests []influxDBRequest
+}
+
+func newInfluxDBServer(failures int) *influxDBServer {
+	s := &influxDBServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.failures > 0 {
+			s.failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.requests = append(s.requests, influxDBRequest{Path: r.URL.Path, Query: r.URL.RawQuery, Auth: r.Header.Get("Authorization"), Body: string(body)})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func (s *influxDBServer) Requests() []influxDBRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]influxDBRequest(nil), s.requests...)
+}
+
+func TestInfluxDBLine(t *testing.T) {
+	v := new(Values)
+	if err := v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := string(influxDBLine("sbms", map[string]string{"site": "cabin 1"}, v))
+	if diff := cmp.Diff(influxDBExample1, got); diff != "" {
+		t.Errorf("line mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestInfluxDBWriter(t *testing.T) {
+	testCases := []struct {
+		name string
+		cfg  InfluxDBConfig
+		want influxDBRequest
+	}{
+		{
+			name: "v1",
+			cfg:  InfluxDBConfig{Version: 1, Database: "sbms", RetentionPolicy: "forensics", Username: "user", Password: "pass"},
+			want: influxDBRequest{Path: "/write", Query: "db=sbms&precision=s&rp=forensics", Auth: "Basic dXNlcjpwYXNz"},
+		},
+		{
+			name: "v2",
+			cfg:  InfluxDBConfig{Version: 2, Org: "home", Bucket: "sbms", Token: "secret"},
+			want: influxDBRequest{Path: "/api/v2/write", Query: "bucket=sbms&org=home&precision=s", Auth: "Token secret"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			srv := newInfluxDBServer(0)
+			defer srv.Close()
+
+			tC.cfg.URL = srv.URL
+			tC.cfg.Measurement = "sbms"
+			tC.cfg.Tags = map[string]string{"site": "cabin 1"}
+			tC.cfg.BatchSize = 2
+			tC.cfg.FlushInterval = time.Hour
+			tC.cfg.BufferSize = 10
+			w := NewInfluxDBWriter(tC.cfg)
+
+			hub := NewHub()
+			sub := hub.Subscribe(outputBuffer)
+			v := new(Values)
+			v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N("))
+			for _, st := range []State{{Up: true, Values: *v}, {Up: false}, {Up: true, Values: *v}, {Up: true, Values: *v}} {
+				hub.Publish(st)
+			}
+			hub.Close()
+			w.Run(sub)
+
+			want := []influxDBRequest{tC.want, tC.want}
+			want[0].Body = influxDBExample1 + "\n" + influxDBExample1
+			want[1].Body = influxDBExample1
+			if diff := cmp.Diff(want, srv.Requests()); diff != "" {
+				t.Errorf("requests mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestInfluxDBWriterRetry(t *testing.T) {
+	srv := newInfluxDBServer(2)
+	defer srv.Close()
+
+	w := NewInfluxDBWriter(InfluxDBConfig{URL: srv.URL, Version: 1, Database: "sbms", Measurement: "sbms", BatchSize: 2, BufferSize: 3})
+	now := time.Date(2019, 11, 14, 23, 2, 11, 0, time.UTC)
+	w.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		w.add([]byte{byte('a' + i)})
+	}
+
+	w.flush()
+	if got, want := w.backoff, time.Second; got != want {
+		t.Errorf("unexpected backoff: got %s, want %s", got, want)
+	}
+	w.flush() // Still backing off.
+	now = now.Add(time.Second)
+	w.flush()
+	if got, want := w.backoff, 2*time.Second; got != want {
+		t.Errorf("unexpected backoff: got %s, want %s", got, want)
+	}
+	now = now.Add(2 * time.Second)
+	w.flush()
+
+	var bodies []string
+	for _, req := range srv.Requests() {
+		bodies = append(bodies, req.Body)
+	}
+	if diff := cmp.Diff([]string{"b\nc", "d"}, bodies); diff != "" {
+		t.Errorf("bodies mismatch (-want +got):\n%s", diff)
+	}
+	if w.backoff != 0 || len(w.points) != 0 {
+		t.Errorf("unexpected state after recovery: backoff %s, %d points", w.backoff, len(w.points))
+	}
+}
@@ -15,49 +15,789 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+// options are the values of the command line flags and arguments.
+type options struct {
+	logLevel     string
+	logFormat    string
+	serve        serveOptions
+	importFiles  []string
+	importOutput string
+	decodeFormat string
+	decodeFrames []string
+}
+
+// serveOptions are the flags of the serve and check-config commands.
+type serveOptions struct {
+	configFile             string
+	metricsPath            string
+	listenAddress          string
+	serialPort             string
+	recordFile             string
+	recordMaxSize          units.Base2Bytes
+	recordMaxFiles         int
+	replayFile             string
+	replaySpeed            float64
+	mqtt                   MQTTConfig
+	mqttQoS                string
+	influxDB               InfluxDBConfig
+	remoteWrite            RemoteWriteConfig
+	remoteWriteSegmentSize units.Base2Bytes
+	pushgateway            PushgatewayConfig
+	otlp                   OTLPConfig
+	nutListenAddress       string
+	nut                    NUTConfig
+	modbusListenAddress    string
+	snmpListenAddress      string
+	snmp                   SNMPConfig
+	snmpEngineID           string
+	textfile               TextfileConfig
+	csv                    CSVLogConfig
+	csvColumns             string
+	csvMaxSize             units.Base2Bytes
+	hooksFile              string
+	alertsFile             string
+	webhook                WebhookConfig
+	webhookTemplateFile    string
+	alertmanager           AlertmanagerConfig
+	oneshot                bool
+	oneshotTimeout         time.Duration
+	shutdownTimeout        time.Duration
+	readyMaxFrameAge       time.Duration
+	webConfigFile          string
+
+	// web, hooks and alerts are the content of the web config, hooks and
+	// alerts files, read by validate.
+	web    *WebConfig
+	hooks  *HooksConfig
+	alerts *AlertsConfig
+	// values are the values of the flags, as strings, keyed by name.
+	values map[string]string
+}
+
+// newApp returns the command line application, binding its flags and
+// arguments to o.
+func newApp(o *options) *kingpin.Application {
+	app := kingpin.New("sbms_exporter", "")
+	addServeFlags(app.Command("serve", "Serve metrics read from the device (default).").Default(), &o.serve)
+	addServeFlags(app.Command("check-config", "Check the flags and the configuration file of the serve command, and exit."), &o.serve)
+
+	importCmd := app.Command("import", "Convert SBMS microSD data logs to OpenMetrics for backfilling with promtool.")
+	importCmd.Arg("files", "Data log files to import (- for stdin).").Required().StringsVar(&o.importFiles)
+	importCmd.Flag("output", "File to write the OpenMetrics to (default stdout).").Short('o').StringVar(&o.importOutput)
+	decodeCmd := app.Command("decode", "Decode frames given as arguments, or read from stdin, and print their values.")
+	decodeCmd.Flag("format", "Output format.").Short('f').Default(FormatTable).EnumVar(&o.decodeFormat, FormatTable, FormatJSON, FormatPrometheus)
+	decodeCmd.Arg("frames", "Frames to decode (default: one per line on stdin).").StringsVar(&o.decodeFrames)
+
+	// The logging flags of the log package would apply on every parse,
+	// including those of reloads which fail.
+	app.Flag("log.level", "Only log messages with the given severity or above. Valid levels: [debug, info, warn, error, fatal]").Default("info").StringVar(&o.logLevel)
+	app.Flag("log.format", `Set the log target and format. Example: "logger:syslog?appname=bob&local=7" or "logger:stdout?json=true"`).Default("logger:stderr").StringVar(&o.logFormat)
+	app.Version(version.Print("sbms_exporter"))
+	app.HelpFlag.Short('h')
+	return app
+}
+
+// applyLogging sets the level and the format of the logs.
+func applyLogging(level, format string) error {
+	if err := log.Base().SetLevel(level); err != nil {
+		return err
+	}
+	return log.Base().SetFormat(format)
+}
+
+func addServeFlags(cmd *kingpin.CmdClause, o *serveOptions) {
+	// Map flags need their maps allocated.
+	o.influxDB.Tags = map[string]string{}
+	o.remoteWrite.Labels = map[string]string{}
+	o.pushgateway.Grouping = map[string]string{}
+	o.otlp.Headers = map[string]string{}
+	o.otlp.Attributes = map[string]string{}
+	o.alertmanager.Labels = map[string]string{}
+
+	cmd.Flag("config.file", "YAML file of flag values, keyed by flag name, e.g. mqtt: {broker: tcp://localhost:1883}. Flags given on the command line take precedence.").StringVar(&o.configFile)
+	cmd.Flag("telemetry-path", "Path under which to expose metrics.").Default("/metrics").StringVar(&o.metricsPath)
+	cmd.Flag("listen-address", "Address to listen on for web interface and telemetry.").Default(":9101").StringVar(&o.listenAddress)
+	cmd.Flag("web.config.file", "YAML file configuring TLS and basic authentication of the HTTP server (disabled when empty).").StringVar(&o.webConfigFile)
+	cmd.Flag("ready.max-frame-age", "Age of the last valid frame past which /-/ready reports the exporter as not ready.").Default("1m").DurationVar(&o.readyMaxFrameAge)
+	cmd.Flag("serial-port", "The serial port to read metrics from.").StringVar(&o.serialPort)
+	cmd.Flag("record-file", "Append every raw line received, with its host receive time, to this file.").StringVar(&o.recordFile)
+	cmd.Flag("record-max-size", "Size after which the record file is rotated (0 disables rotation).").Default("10MB").BytesVar(&o.recordMaxSize)
+	cmd.Flag("record-max-files", "Number of rotated record files to keep.").Default("5").IntVar(&o.recordMaxFiles)
+	cmd.Flag("replay-file", "Replay a file written with --record-file instead of reading a serial port.").StringVar(&o.replayFile)
+	cmd.Flag("replay-speed", "Replay speed factor (1 is real time, 0 is as fast as possible).").Default("1").Float64Var(&o.replaySpeed)
+	cmd.Flag("mqtt.broker", "MQTT broker to publish frames to, e.g. tcp://localhost:1883 (disabled when empty).").StringVar(&o.mqtt.Broker)
+	cmd.Flag("mqtt.client-id", "MQTT client identifier.").Default("sbms_exporter").StringVar(&o.mqtt.ClientID)
+	cmd.Flag("mqtt.username", "MQTT username.").StringVar(&o.mqtt.Username)
+	cmd.Flag("mqtt.password", "MQTT password.").StringVar(&o.mqtt.Password)
+	cmd.Flag("mqtt.topic-prefix", "Topic under which frames and availability are published.").Default("sbms").StringVar(&o.mqtt.TopicPrefix)
+	cmd.Flag("mqtt.discovery-prefix", "Home Assistant discovery prefix (disabled when empty).").Default("homeassistant").StringVar(&o.mqtt.DiscoveryPrefix)
+	cmd.Flag("mqtt.device-id", "Identifier of the device in Home Assistant.").Default("sbms").StringVar(&o.mqtt.DeviceID)
+	cmd.Flag("mqtt.qos", "QoS of published messages.").Default("0").EnumVar(&o.mqttQoS, "0", "1", "2")
+	cmd.Flag("mqtt.retain", "Retain frame messages.").BoolVar(&o.mqtt.Retain)
+	cmd.Flag("influxdb.url", "InfluxDB server to write every frame to, e.g. http://localhost:8086 (disabled when empty).").StringVar(&o.influxDB.URL)
+	cmd.Flag("influxdb.version", "InfluxDB write API version.").Default("1").IntVar(&o.influxDB.Version)
+	cmd.Flag("influxdb.database", "InfluxDB v1 database.").Default("sbms").StringVar(&o.influxDB.Database)
+	cmd.Flag("influxdb.retention-policy", "InfluxDB v1 retention policy.").StringVar(&o.influxDB.RetentionPolicy)
+	cmd.Flag("influxdb.username", "InfluxDB v1 username.").StringVar(&o.influxDB.Username)
+	cmd.Flag("influxdb.password", "InfluxDB v1 password.").StringVar(&o.influxDB.Password)
+	cmd.Flag("influxdb.org", "InfluxDB v2 organization.").StringVar(&o.influxDB.Org)
+	cmd.Flag("influxdb.bucket", "InfluxDB v2 bucket.").Default("sbms").StringVar(&o.influxDB.Bucket)
+	cmd.Flag("influxdb.token", "InfluxDB v2 token.").StringVar(&o.influxDB.Token)
+	cmd.Flag("influxdb.measurement", "InfluxDB measurement.").Default("sbms").StringVar(&o.influxDB.Measurement)
+	cmd.Flag("influxdb.tag", "Tag added to every point (repeatable), e.g. site=cabin.").StringMapVar(&o.influxDB.Tags)
+	cmd.Flag("influxdb.batch-size", "Number of points written per request.").Default("60").IntVar(&o.influxDB.BatchSize)
+	cmd.Flag("influxdb.flush-interval", "Longest time a point waits before being written.").Default("10s").DurationVar(&o.influxDB.FlushInterval)
+	cmd.Flag("influxdb.buffer-size", "Number of points kept while InfluxDB is unreachable.").Default("86400").IntVar(&o.influxDB.BufferSize)
+	cmd.Flag("influxdb.timeout", "Timeout of write requests.").Default("10s").DurationVar(&o.influxDB.Timeout)
+	cmd.Flag("remote-write.url", "Prometheus remote write endpoint to push samples to, e.g. http://prometheus:9090/api/v1/write (disabled when empty).").StringVar(&o.remoteWrite.URL)
+	cmd.Flag("remote-write.label", "Label added to every series (repeatable), e.g. instance=cabin. job defaults to sbms.").StringMapVar(&o.remoteWrite.Labels)
+	cmd.Flag("remote-write.username", "Remote write basic auth username.").StringVar(&o.remoteWrite.Username)
+	cmd.Flag("remote-write.password", "Remote write basic auth password.").StringVar(&o.remoteWrite.Password)
+	cmd.Flag("remote-write.bearer-token", "Remote write bearer token.").StringVar(&o.remoteWrite.BearerToken)
+	cmd.Flag("remote-write.queue-dir", "Directory of the on-disk queue of samples not sent yet.").Default("data/remote-write").StringVar(&o.remoteWrite.QueueDir)
+	cmd.Flag("remote-write.segment-size", "Size of the queue segment files.").Default("1MB").BytesVar(&o.remoteWriteSegmentSize)
+	cmd.Flag("remote-write.max-segments", "Number of queue segments kept while the endpoint is unreachable.").Default("100").IntVar(&o.remoteWrite.MaxSegments)
+	cmd.Flag("remote-write.batch-size", "Number of frames sent per request.").Default("60").IntVar(&o.remoteWrite.BatchSize)
+	cmd.Flag("remote-write.flush-interval", "Interval at which queued samples are sent.").Default("10s").DurationVar(&o.remoteWrite.FlushInterval)
+	cmd.Flag("remote-write.timeout", "Timeout of remote write requests.").Default("30s").DurationVar(&o.remoteWrite.Timeout)
+	cmd.Flag("pushgateway.url", "Pushgateway to push metrics to, e.g. http://pushgateway:9091 (disabled when empty).").StringVar(&o.pushgateway.URL)
+	cmd.Flag("pushgateway.job", "Job label of the pushed group.").Default("sbms").StringVar(&o.pushgateway.Job)
+	cmd.Flag("pushgateway.grouping", "Grouping label of the pushed group (repeatable), e.g. instance=cabin.").StringMapVar(&o.pushgateway.Grouping)
+	cmd.Flag("pushgateway.username", "Pushgateway basic auth username.").StringVar(&o.pushgateway.Username)
+	cmd.Flag("pushgateway.password", "Pushgateway basic auth password.").StringVar(&o.pushgateway.Password)
+	cmd.Flag("pushgateway.interval", "Interval at which metrics are pushed, on top of the pushes when the device goes up or down.").Default("15s").DurationVar(&o.pushgateway.Interval)
+	cmd.Flag("pushgateway.timeout", "Timeout of push requests.").Default("10s").DurationVar(&o.pushgateway.Timeout)
+	cmd.Flag("otlp.endpoint", "OTLP endpoint to export metrics to, e.g. http://collector:4318/v1/metrics for http/protobuf or collector:4317 for grpc (disabled when empty).").StringVar(&o.otlp.Endpoint)
+	cmd.Flag("otlp.protocol", "OTLP protocol.").Default(OTLPProtocolHTTP).EnumVar(&o.otlp.Protocol, OTLPProtocolHTTP, OTLPProtocolGRPC)
+	cmd.Flag("otlp.insecure", "Disable TLS for the grpc protocol.").BoolVar(&o.otlp.Insecure)
+	cmd.Flag("otlp.header", "Header sent with every export (repeatable), e.g. api-key=secret.").StringMapVar(&o.otlp.Headers)
+	cmd.Flag("otlp.resource-attribute", "Resource attribute identifying the device (repeatable), e.g. device.id=cabin.").StringMapVar(&o.otlp.Attributes)
+	cmd.Flag("otlp.interval", "Interval at which metrics are exported.").Default("15s").DurationVar(&o.otlp.Interval)
+	cmd.Flag("otlp.timeout", "Timeout of export requests.").Default("10s").DurationVar(&o.otlp.Timeout)
+	cmd.Flag("nut.listen-address", "Address on which to serve the NUT upsd protocol, e.g. :3493 (disabled when empty).").StringVar(&o.nutListenAddress)
+	cmd.Flag("nut.ups", "Name of the UPS presented over NUT.").Default("sbms").StringVar(&o.nut.UPS)
+	cmd.Flag("nut.description", "Description of the UPS presented over NUT.").Default("SBMS battery").StringVar(&o.nut.Description)
+	cmd.Flag("nut.low-charge", "State of charge (%) at or below which the battery is reported low.").Default("20").IntVar(&o.nut.LowCharge)
+	cmd.Flag("nut.username", "Username required to log in over NUT, and to act as the primary or force a shutdown (read-only access for everyone when empty).").StringVar(&o.nut.Username)
+	cmd.Flag("nut.password", "Password required to log in over NUT.").StringVar(&o.nut.Password)
+	cmd.Flag("modbus.listen-address", "Address on which to serve Modbus TCP, e.g. :502 (disabled when empty).").StringVar(&o.modbusListenAddress)
+	cmd.Flag("snmp.listen-address", "UDP address on which to serve SNMP, e.g. :161 (disabled when empty).").StringVar(&o.snmpListenAddress)
+	cmd.Flag("snmp.community", "SNMPv2c community (v2c disabled when empty).").StringVar(&o.snmp.Community)
+	cmd.Flag("snmp.user", "SNMPv3 user name (v3 disabled when empty).").StringVar(&o.snmp.User.Name)
+	cmd.Flag("snmp.auth-protocol", "SNMPv3 authentication protocol, MD5 or SHA (noAuthNoPriv when empty).").EnumVar(&o.snmp.User.AuthProtocol, "", "MD5", "SHA")
+	cmd.Flag("snmp.auth-password", "SNMPv3 authentication password.").StringVar(&o.snmp.User.AuthPassword)
+	cmd.Flag("snmp.priv-protocol", "SNMPv3 privacy protocol, DES or AES (authNoPriv when empty).").EnumVar(&o.snmp.User.PrivProtocol, "", "DES", "AES")
+	cmd.Flag("snmp.priv-password", "SNMPv3 privacy password.").StringVar(&o.snmp.User.PrivPassword)
+	cmd.Flag("snmp.engine-id", "SNMPv3 engine ID in hexadecimal (default derived from the host name).").StringVar(&o.snmpEngineID)
+	cmd.Flag("snmp.boots-file", "File storing the number of times the SNMPv3 engine started.").Default("data/snmp-boots").StringVar(&o.snmp.BootsFile)
+	cmd.Flag("snmp.trap-target", "Address to send SNMP traps to (repeatable), e.g. nms:162.").StringsVar(&o.snmp.TrapTargets)
+	cmd.Flag("snmp.trap-version", "SNMP version of the traps.").Default("2c").EnumVar(&o.snmp.TrapVersion, "2c", "3")
+	cmd.Flag("textfile", "File to write the metrics to for the node_exporter textfile collector, e.g. /var/lib/node_exporter/sbms.prom (disabled when empty).").StringVar(&o.textfile.Path)
+	cmd.Flag("textfile.interval", "Interval at which the textfile is rewritten, on top of the writes when the device goes up or down (0 rewrites it on every frame).").Default("0s").DurationVar(&o.textfile.Interval)
+	cmd.Flag("csv.dir", "Directory to write a CSV file of the decoded frames to every day (disabled when empty).").StringVar(&o.csv.Dir)
+	cmd.Flag("csv.columns", "Comma-separated columns of the CSV files, among "+strings.Join(CSVColumns(), ", ")+".").Default(strings.Join(CSVColumns(), ",")).StringVar(&o.csvColumns)
+	cmd.Flag("csv.compress", "Gzip the CSV files of past days.").BoolVar(&o.csv.Compress)
+	cmd.Flag("csv.max-age", "Age past which CSV files are deleted (0 keeps them).").Default("0s").DurationVar(&o.csv.MaxAge)
+	cmd.Flag("csv.max-size", "Total size past which the oldest CSV files are deleted (0 keeps them).").Default("0").BytesVar(&o.csvMaxSize)
+	cmd.Flag("hooks.file", "YAML file of hooks running commands when decoded values cross thresholds (disabled when empty).").StringVar(&o.hooksFile)
+	cmd.Flag("alerts.file", "YAML file of alert rules evaluated on the decoded values, served under /api/v1/alerts (disabled when empty).").StringVar(&o.alertsFile)
+	cmd.Flag("webhook.url", "URL to POST notifications to when the device goes up or down, the serial port disconnects or the status bits change (repeatable).").StringsVar(&o.webhook.URLs)
+	cmd.Flag("webhook.template-file", "File of the text/template of the notification payloads (default a JSON document).").StringVar(&o.webhookTemplateFile)
+	cmd.Flag("webhook.timeout", "Timeout of notification requests.").Default("10s").DurationVar(&o.webhook.Timeout)
+	cmd.Flag("webhook.retries", "Number of times a failed notification is retried.").Default("3").IntVar(&o.webhook.Retries)
+	cmd.Flag("webhook.dedup-window", "Time during which a notification identical to the last one is not sent again.").Default("5m").DurationVar(&o.webhook.DedupWindow)
+	cmd.Flag("webhook.rate-limit", "Maximum number of notifications sent every --webhook.rate-period (0 disables rate limiting).").Default("10").IntVar(&o.webhook.RateLimit)
+	cmd.Flag("webhook.rate-period", "Period of the rate limit.").Default("1h").DurationVar(&o.webhook.RatePeriod)
+	cmd.Flag("webhook.down-after", "Time the device must keep sending lines that cannot be decoded before it is notified down (0 notifies it at once).").Default("1m").DurationVar(&o.webhook.DownAfter)
+	cmd.Flag("alertmanager.url", "Base URL of an Alertmanager to send the alarms reported by the device to, e.g. http://alertmanager:9093 (repeatable).").StringsVar(&o.alertmanager.URLs)
+	cmd.Flag("alertmanager.label", "Label added to the alarms sent to Alertmanager, e.g. instance=cabin (repeatable).").StringMapVar(&o.alertmanager.Labels)
+	cmd.Flag("alertmanager.interval", "Interval at which active alarms are sent again to Alertmanager.").Default("1m").DurationVar(&o.alertmanager.Interval)
+	cmd.Flag("alertmanager.timeout", "Timeout of requests to Alertmanager.").Default("10s").DurationVar(&o.alertmanager.Timeout)
+	cmd.Flag("shutdown-timeout", "Time given to the outputs to flush and to the HTTP server to finish its requests on SIGINT or SIGTERM.").Default("10s").DurationVar(&o.shutdownTimeout)
+	cmd.Flag("oneshot", "Print the metrics of the first valid frame to stdout and exit.").BoolVar(&o.oneshot)
+	cmd.Flag("oneshot.timeout", "Time to wait for a valid frame in --oneshot mode.").Default("30s").DurationVar(&o.oneshotTimeout)
+}
+
+// validate checks the options and fills the configurations derived from
+// them, so that configuration errors are reported before anything starts.
+func (o *serveOptions) validate() error {
+	switch {
+	case o.serialPort != "" && o.replayFile != "":
+		return errors.New("--serial-port and --replay-file are mutually exclusive")
+	case o.serialPort == "" && o.replayFile == "":
+		return errors.New("one of --serial-port or --replay-file is required")
+	case o.replaySpeed < 0:
+		return errors.New("--replay-speed must not be negative")
+	}
+
+	// The API, the dashboard and the /-/ endpoints have fixed paths.
+	switch p := o.metricsPath; {
+	case !strings.HasPrefix(p, "/") || p == "/" || strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/-/"):
+		return fmt.Errorf("--telemetry-path %q clashes with the paths of the API, the dashboard or the /-/ endpoints", p)
+	}
+
+	o.mqtt.QoS = o.mqttQoS[0] - '0'
+	if o.influxDB.URL != "" {
+		switch {
+		case o.influxDB.Version != 1 && o.influxDB.Version != 2:
+			return errors.New("--influxdb.version must be 1 or 2")
+		case o.influxDB.BatchSize < 1:
+			return errors.New("--influxdb.batch-size must be at least 1")
+		case o.influxDB.BufferSize < 1:
+			return errors.New("--influxdb.buffer-size must be at least 1")
+		case o.influxDB.FlushInterval <= 0:
+			return errors.New("--influxdb.flush-interval must be positive")
+		}
+	}
+
+	o.remoteWrite.SegmentSize = int64(o.remoteWriteSegmentSize)
+	if o.remoteWrite.URL != "" {
+		switch {
+		case o.remoteWrite.BatchSize < 1:
+			return errors.New("--remote-write.batch-size must be at least 1")
+		case o.remoteWrite.FlushInterval <= 0:
+			return errors.New("--remote-write.flush-interval must be positive")
+		case o.remoteWrite.SegmentSize <= 0:
+			return errors.New("--remote-write.segment-size must be positive")
+		case o.remoteWrite.MaxSegments < 1:
+			return errors.New("--remote-write.max-segments must be at least 1")
+		}
+	}
+	if _, ok := o.remoteWrite.Labels["job"]; !ok {
+		o.remoteWrite.Labels["job"] = "sbms"
+	}
+	if o.pushgateway.URL != "" {
+		if o.pushgateway.Interval <= 0 {
+			return errors.New("--pushgateway.interval must be positive")
+		}
+		// Grouping labels are path segments of the group URL.
+		names := make([]string, 0, len(o.pushgateway.Grouping))
+		for name := range o.pushgateway.Grouping {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch value := o.pushgateway.Grouping[name]; {
+			case !model.LabelName(name).IsValid() || name == "job":
+				return fmt.Errorf("invalid --pushgateway.grouping label name %q", name)
+			case value == "" || strings.Contains(value, "/"):
+				return fmt.Errorf("invalid --pushgateway.grouping value %q of %s, which must not be empty nor contain a /", value, name)
+			}
+		}
+	}
+	if _, ok := o.otlp.Attributes["service.name"]; !ok {
+		o.otlp.Attributes["service.name"] = "sbms_exporter"
+	}
+	if o.otlp.Endpoint != "" && o.otlp.Interval <= 0 {
+		return errors.New("--otlp.interval must be positive")
+	}
+
+	engineID, err := hex.DecodeString(o.snmpEngineID)
+	if err != nil {
+		return fmt.Errorf("invalid --snmp.engine-id: %v", err)
+	}
+	o.snmp.EngineID = engineID
+
+	o.csv.Columns = strings.Split(o.csvColumns, ",")
+	o.csv.MaxSize = int64(o.csvMaxSize)
+	if o.csv.Dir != "" {
+		for _, name := range o.csv.Columns {
+			if csvColumn(name) == nil {
+				return fmt.Errorf("unknown CSV column %q, want one of %s", name, strings.Join(CSVColumns(), ", "))
+			}
+		}
+	}
+
+	if o.webConfigFile != "" {
+		if o.web, err = LoadWebConfigFile(o.webConfigFile); err != nil {
+			return fmt.Errorf("error loading web config file: %v", err)
+		}
+	}
+	if o.hooksFile != "" {
+		if o.hooks, err = LoadHooksFile(o.hooksFile); err != nil {
+			return fmt.Errorf("error loading hooks file: %v", err)
+		}
+	}
+	if o.alertsFile != "" {
+		if o.alerts, err = LoadAlertsFile(o.alertsFile); err != nil {
+			return fmt.Errorf("error loading alerts file: %v", err)
+		}
+	}
+
+	if o.webhookTemplateFile != "" {
+		b, err := ioutil.ReadFile(o.webhookTemplateFile)
+		if err != nil {
+			return fmt.Errorf("error reading webhook template: %v", err)
+		}
+		o.webhook.Template = string(b)
+	}
+	if len(o.webhook.URLs) > 0 {
+		if _, err := NewWebhookNotifier(o.webhook); err != nil {
+			return fmt.Errorf("error parsing webhook template: %v", err)
+		}
+		if o.webhook.DownAfter < 0 {
+			return errors.New("--webhook.down-after must not be negative")
+		}
+	}
+
+	if len(o.alertmanager.URLs) > 0 && o.alertmanager.Interval <= 0 {
+		return errors.New("--alertmanager.interval must be positive")
+	}
+	if o.readyMaxFrameAge <= 0 {
+		return errors.New("--ready.max-frame-age must be positive")
+	}
+	return nil
+}
+
+// Exit codes, following sysexits.h.
+const (
+	exitDecode = 65 // EX_DATAERR
+	exitIO     = 74 // EX_IOERR
+	exitConfig = 78 // EX_CONFIG
+)
+
+// shutdownSignals make the exporter shut down gracefully.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// fatal logs args and exits with code.
+func fatal(code int, args ...interface{}) {
+	log.Errorln(args...)
+	os.Exit(code)
+}
+
 func main() {
-	metricsPath := kingpin.Flag("telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-	listenAddress := kingpin.Flag("listen-address", "Address to listen on for web interface and telemetry.").Default(":9101").String()
-	serialPort := kingpin.Flag("serial-port", "The serial port to read metrics from.").Required().File()
-
-	log.AddFlags(kingpin.CommandLine)
-	kingpin.Version(version.Print("sbms_exporter"))
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
-
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>SBMS Exporter</title></head>
-             <body>
-             <h1>SBMS Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
-
-	srv := &http.Server{Addr: *listenAddress}
+	app, command, opts, err := parseArgs(os.Args[1:])
+	if err == nil {
+		err = applyLogging(opts.logLevel, opts.logFormat)
+	}
+	if err != nil {
+		app.Errorf("%v", err)
+		os.Exit(exitConfig)
+	}
+
+	switch command {
+	case "import":
+		if err := runImport(opts.importFiles, opts.importOutput); err != nil {
+			fatal(exitIO, "Error importing data logs:", err)
+		}
+		return
+	case "decode":
+		if err := runDecode(os.Stdin, os.Stdout, os.Stderr, opts.decodeFormat, opts.decodeFrames); err != nil {
+			if err != ErrDecodeFailed {
+				fatal(exitIO, "Error decoding frames:", err)
+			}
+			os.Exit(exitDecode)
+		}
+		return
+	case "check-config":
+		if err := opts.serve.validate(); err != nil {
+			fatal(exitConfig, "Invalid configuration:", err)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
+
+	o := &opts.serve
+	if err := o.validate(); err != nil {
+		app.Errorf("%v", err)
+		os.Exit(exitConfig)
+	}
+
+	path := o.serialPort
+	if o.replayFile != "" {
+		path = o.replayFile
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		fatal(exitIO, "Error opening source:", err)
+	}
+
+	var input io.Reader = src
+	if o.replayFile != "" {
+		input = NewReplayReader(input, o.replaySpeed)
+	}
+	var rec *Recorder
+	if o.recordFile != "" {
+		rec, err = NewRecorder(o.recordFile, int64(o.recordMaxSize), o.recordMaxFiles)
+		if err != nil {
+			fatal(exitIO, "Error opening record file:", err)
+		}
+		input = io.TeeReader(input, rec)
+	}
+
+	if o.oneshot {
+		err := runOneshot(input, os.Stdout, o.oneshotTimeout)
+		src.Close()
+		if rec != nil {
+			rec.Close()
+		}
+		switch {
+		case err == errNoFrame:
+			fatal(exitDecode, "Error reading a frame:", err)
+		case err != nil:
+			fatal(exitIO, "Error reading a frame:", err)
+		}
+		return
+	}
+
+	exp := NewExporter(prometheus.DefaultRegisterer)
+	reloader := NewReloader(os.Args[1:], o, prometheus.DefaultRegisterer)
+	var web *WebServer
+	if o.web != nil {
+		if web, err = NewWebServer(o.web); err != nil {
+			fatal(exitConfig, "Error loading web config file:", err)
+		}
+		reloader.web = web
+	}
+
+	http.Handle(o.metricsPath, promhttp.Handler())
+	http.Handle("/api/v1/", NewAPIHandler(exp))
+	health := NewHealthHandler(exp, o.readyMaxFrameAge)
+	http.Handle("/-/healthy", health)
+	http.Handle("/-/ready", health)
+	if o.alerts != nil {
+		alerts, err := NewAlertEngine(o.alerts, prometheus.DefaultRegisterer)
+		if err != nil {
+			fatal(exitConfig, "Error loading alerts file:", err)
+		}
+		reloader.alerts = alerts
+		http.Handle("/api/v1/alerts", alerts)
+	}
+	http.Handle("/", NewDashboardHandler(o.metricsPath))
+
 	var wg sync.WaitGroup
+	if o.mqtt.Broker != "" {
+		pub := NewMQTTPublisher(o.mqtt)
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			pub.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if o.influxDB.URL != "" {
+		w := NewInfluxDBWriter(o.influxDB)
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			w.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if o.textfile.Path != "" {
+		w := NewTextfileWriter(o.textfile)
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			w.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if o.csv.Dir != "" {
+		l, err := NewCSVLogger(o.csv)
+		if err != nil {
+			fatal(exitIO, "Error creating CSV logger:", err)
+		}
+		sub := exp.Subscribe(csvBuffer)
+		wg.Add(1)
+		go func() {
+			l.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if reloader.alerts != nil {
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			reloader.alerts.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if len(o.webhook.URLs) > 0 {
+		n, err := NewWebhookNotifier(o.webhook)
+		if err != nil {
+			fatal(exitConfig, "Error parsing webhook template:", err)
+		}
+		reloader.webhook = n
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			n.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if len(o.alertmanager.URLs) > 0 {
+		c := NewAlertmanagerClient(o.alertmanager)
+		reloader.alertmanager = c
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			c.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if o.hooks != nil {
+		r := NewHookRunner(o.hooks, prometheus.DefaultRegisterer)
+		reloader.hooks = r
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			r.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if o.remoteWrite.URL != "" {
+		w, err := NewRemoteWriter(o.remoteWrite)
+		if err != nil {
+			fatal(exitIO, "Error opening remote write queue:", err)
+		}
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			w.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if o.pushgateway.URL != "" {
+		p := NewPushgatewayPusher(o.pushgateway)
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			p.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	if o.otlp.Endpoint != "" {
+		e, err := NewOTLPExporter(o.otlp)
+		if err != nil {
+			fatal(exitConfig, "Error creating OTLP exporter:", err)
+		}
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			e.Run(sub)
+			wg.Done()
+		}()
+	}
+
+	var nut *NUTServer
+	if o.nutListenAddress != "" {
+		l, err := net.Listen("tcp", o.nutListenAddress)
+		if err != nil {
+			fatal(exitIO, "Error listening for NUT clients:", err)
+		}
+		log.Infoln("Serving NUT on", o.nutListenAddress)
+		nut = NewNUTServer(o.nut, exp)
+		wg.Add(1)
+		go func() {
+			if err := nut.Serve(l); err != errNUTClosed {
+				log.Errorln(err)
+			}
+			wg.Done()
+		}()
+	}
+
+	var modbus *ModbusServer
+	if o.modbusListenAddress != "" {
+		l, err := net.Listen("tcp", o.modbusListenAddress)
+		if err != nil {
+			fatal(exitIO, "Error listening for Modbus clients:", err)
+		}
+		log.Infoln("Serving Modbus TCP on", o.modbusListenAddress)
+		modbus = NewModbusServer(exp)
+		wg.Add(1)
+		go func() {
+			if err := modbus.Serve(l); err != errModbusClosed {
+				log.Errorln(err)
+			}
+			wg.Done()
+		}()
+	}
+
+	var snmp *SNMPAgent
+	if o.snmpListenAddress != "" || len(o.snmp.TrapTargets) > 0 {
+		snmp, err = NewSNMPAgent(o.snmp, exp)
+		if err != nil {
+			fatal(exitConfig, "Error creating SNMP agent:", err)
+		}
+	}
+	if len(o.snmp.TrapTargets) > 0 {
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			snmp.Run(sub)
+			wg.Done()
+		}()
+	}
+	if o.snmpListenAddress != "" {
+		pc, err := net.ListenPacket("udp", o.snmpListenAddress)
+		if err != nil {
+			fatal(exitIO, "Error listening for SNMP requests:", err)
+		}
+		log.Infoln("Serving SNMP on", o.snmpListenAddress)
+		wg.Add(1)
+		go func() {
+			if err := snmp.Serve(pc); err != errSNMPClosed {
+				log.Errorln(err)
+			}
+			wg.Done()
+		}()
+	}
+
+	// The reload handlers start once every reloadable component is known.
+	http.Handle("/-/reload", reloader)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloader.Reload()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, shutdownSignals...)
+	go func() {
+		select {
+		case sig := <-term:
+			log.Infof("Received %v, shutting down", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		// A second signal kills the exporter.
+		signal.Stop(term)
+	}()
+
+	listeners, err := systemdListeners()
+	if err != nil {
+		fatal(exitIO, "Error using socket-activated listeners:", err)
+	}
+	if len(listeners) == 0 {
+		l, err := net.Listen("tcp", o.listenAddress)
+		if err != nil {
+			fatal(exitIO, "Error listening for HTTP requests:", err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	srv := &http.Server{}
+	if web != nil {
+		srv.Handler = web.Handler(http.DefaultServeMux)
+		for i, l := range listeners {
+			listeners[i] = web.Listener(l)
+		}
+	}
+	srvErr := make(chan error, len(listeners))
 	log.Infoln("Starting sbms_exporter", version.Info())
-	log.Infoln("Listening on", *listenAddress)
-	wg.Add(1)
+	for _, l := range listeners {
+		log.Infoln("Listening on", l.Addr())
+		wg.Add(1)
+		go func(l net.Listener) {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				log.Errorln("Error serving HTTP:", err)
+				srvErr <- err
+				cancel()
+			}
+			wg.Done()
+		}(l)
+	}
+
+	notifier := NewSystemdNotifier()
+	if notifier.watchdog > 0 {
+		sub := exp.Subscribe(outputBuffer)
+		wg.Add(1)
+		go func() {
+			notifier.Run(sub)
+			wg.Done()
+		}()
+	}
+	if err := notifier.Notify("READY=1"); err != nil {
+		log.Errorln("Error notifying systemd:", err)
+	}
+
+	code := 0
+	switch err := exp.Export(ctx, input); {
+	case err == context.Canceled:
+	case err == io.EOF && o.replayFile != "":
+		log.Infoln("Replay file ended")
+	default:
+		log.Errorln("Error reading source:", err)
+		code = exitIO
+	}
+	cancel()
+	src.Close()
+	if err := notifier.Notify("STOPPING=1"); err != nil {
+		log.Errorln("Error notifying systemd:", err)
+	}
+
+	// Outputs flush what they hold once their subscription is closed.
+	exp.hub.Close()
+	if nut != nil {
+		nut.Close()
+	}
+	if modbus != nil {
+		modbus.Close()
+	}
+	if snmp != nil {
+		snmp.Close()
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), o.shutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Errorln("Error shutting down HTTP server:", err)
+	}
+	stopped := make(chan struct{})
 	go func() {
-		log.Errorln(srv.ListenAndServe())
-		(*serialPort).Close()
-		wg.Done()
+		wg.Wait()
+		close(stopped)
 	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		log.Errorf("Outputs still running after %v, exiting", o.shutdownTimeout)
+	}
+	if rec != nil {
+		rec.Close()
+	}
 
-	log.Errorln(NewExporter(prometheus.DefaultRegisterer).Export(*serialPort))
-	srv.Shutdown(context.Background())
-	wg.Wait()
+	select {
+	case <-srvErr:
+		code = exitIO
+	default:
+	}
+	os.Exit(code)
 }
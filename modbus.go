@@ -0,0 +1,223 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// Modbus function codes and exception codes.
+const (
+	modbusReadHoldingRegisters = 0x03
+	modbusReadInputRegisters   = 0x04
+
+	modbusIllegalFunction     = 0x01
+	modbusIllegalDataAddress  = 0x02
+	modbusIllegalDataValue    = 0x03
+	modbusServerDeviceFailure = 0x04
+)
+
+// modbusMaxQuantity is the largest number of registers a request can read.
+const modbusMaxQuantity = 125
+
+// modbusRegisterCount is the size of the register map.
+const modbusRegisterCount = 31
+
+// errModbusClosed is returned by Serve once the server is closed.
+var errModbusClosed = errors.New("modbus: server closed")
+
+// ModbusServer is a Modbus TCP server exposing the last decoded frame as
+// registers, readable both as holding and input registers. Values are in the
+// native integer units of the device; 32-bit values span two registers, high
+// word first. The map is stable, new registers are only ever appended:
+//
+//	0      state of charge (%)
+//	1-8    cell 1 to 8 voltage (mV)
+//	9      battery voltage (mV)
+//	10-11  battery current (mA, signed, positive when charging)
+//	12-13  PV1 current (mA)
+//	14-15  PV2 current (mA)
+//	16-17  external load current (mA)
+//	18     internal temperature (0.1 °C, signed)
+//	19     external temperature (0.1 °C, signed)
+//	20     status word
+//	21     charging (0 or 1)
+//	22-23  battery power (mW, signed)
+//	24-25  device date (seconds since the epoch)
+//	26-28  ADC2 to ADC4
+//	29-30  heat1 and heat2
+//
+// Reads fail with a server device failure exception while the device is
+// down.
+type ModbusServer struct {
+	exp *Exporter
+
+	mu     sync.Mutex
+	l      net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// NewModbusServer returns a server exposing the state of exp.
+func NewModbusServer(exp *Exporter) *ModbusServer {
+	return &ModbusServer{exp: exp, conns: map[net.Conn]struct{}{}}
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *ModbusServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return errModbusClosed
+	}
+	s.l = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				return errModbusClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// Close stops the listener and closes the open connections.
+func (s *ModbusServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.l != nil {
+		return s.l.Close()
+	}
+	return nil
+}
+
+func (s *ModbusServer) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	// The MBAP header: transaction, protocol, length and unit identifier.
+	var hdr [7]byte
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			if err != io.EOF {
+				log.Debugln("Error reading Modbus request:", err)
+			}
+			return
+		}
+		n := binary.BigEndian.Uint16(hdr[4:])
+		if binary.BigEndian.Uint16(hdr[2:]) != 0 || n < 2 || n > 254 {
+			log.Debugln("Invalid Modbus request header, closing connection")
+			return
+		}
+		pdu := make([]byte, n-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			log.Debugln("Error reading Modbus request:", err)
+			return
+		}
+
+		res := s.handle(pdu)
+		out := make([]byte, 7+len(res))
+		copy(out, hdr[:4])
+		binary.BigEndian.PutUint16(out[4:], uint16(len(res)+1))
+		out[6] = hdr[6]
+		copy(out[7:], res)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response PDU to a request PDU.
+func (s *ModbusServer) handle(pdu []byte) []byte {
+	fn := pdu[0]
+	exception := func(code byte) []byte {
+		return []byte{fn | 0x80, code}
+	}
+
+	if fn != modbusReadHoldingRegisters && fn != modbusReadInputRegisters {
+		return exception(modbusIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(modbusIllegalDataValue)
+	}
+	addr := int(binary.BigEndian.Uint16(pdu[1:]))
+	quantity := int(binary.BigEndian.Uint16(pdu[3:]))
+	if quantity < 1 || quantity > modbusMaxQuantity {
+		return exception(modbusIllegalDataValue)
+	}
+	if addr+quantity > modbusRegisterCount {
+		return exception(modbusIllegalDataAddress)
+	}
+
+	st := s.exp.State()
+	if !st.Up {
+		return exception(modbusServerDeviceFailure)
+	}
+	regs := modbusRegisters(&st.Values)
+
+	res := make([]byte, 2+2*quantity)
+	res[0], res[1] = fn, byte(2*quantity)
+	for i := 0; i < quantity; i++ {
+		binary.BigEndian.PutUint16(res[2+2*i:], regs[addr+i])
+	}
+	return res
+}
+
+// modbusRegisters returns the register map of v.
+func modbusRegisters(v *Values) []uint16 {
+	regs := make([]uint16, 0, modbusRegisterCount)
+	u32 := func(x uint32) {
+		regs = append(regs, uint16(x>>16), uint16(x))
+	}
+
+	regs = append(regs, uint16(v.StateOfCharge))
+	for _, cell := range []float64{v.Cell1Voltage, v.Cell2Voltage, v.Cell3Voltage, v.Cell4Voltage, v.Cell5Voltage, v.Cell6Voltage, v.Cell7Voltage, v.Cell8Voltage} {
+		regs = append(regs, uint16(milli(cell)))
+	}
+	regs = append(regs, uint16(milli(v.BatteryVoltage())))
+	u32(uint32(milli(v.BatteryCurrent)))
+	u32(uint32(milli(v.PV1Current)))
+	u32(uint32(milli(v.PV2Current)))
+	u32(uint32(milli(v.ExtLoadCurrent)))
+	regs = append(regs, uint16(deci(v.InternalTemp)), uint16(deci(v.ExternalTemp)), uint16(v.Status), uint16(boolAsFloat(v.Charging)))
+	u32(uint32(milli(v.BatteryPower())))
+	u32(uint32(v.Date.Unix()))
+	regs = append(regs, uint16(v.ADC2), uint16(v.ADC3), uint16(v.ADC4), uint16(v.Heat1), uint16(v.Heat2))
+	return regs
+}
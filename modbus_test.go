@@ -0,0 +1,127 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// modbusRead sends a read request and returns the response PDU.
+func modbusRead(t *testing.T, conn net.Conn, fn byte, addr, quantity uint16) []byte {
+	t.Helper()
+	req := []byte{0x12, 0x34, 0, 0, 0, 6, 1, fn, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(req[8:], addr)
+	binary.BigEndian.PutUint16(req[10:], quantity)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	var hdr [7]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]byte{0x12, 0x34, 0, 0}, hdr[:4]); diff != "" || hdr[6] != 1 {
+		t.Fatalf("unexpected response header: %x", hdr)
+	}
+	pdu := make([]byte, binary.BigEndian.Uint16(hdr[4:])-1)
+	if _, err := io.ReadFull(conn, pdu); err != nil {
+		t.Fatal(err)
+	}
+	return pdu
+}
+
+func TestModbusServer(t *testing.T) {
+	exp := NewExporter(prometheus.NewRegistry())
+	s := NewModbusServer(exp)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if diff := cmp.Diff([]byte{0x84, modbusServerDeviceFailure}, modbusRead(t, conn, 4, 0, 1)); diff != "" {
+		t.Errorf("response mismatch while down (-want +got):\n%s", diff)
+	}
+
+	v := new(Values)
+	if err := v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(")); err != nil {
+		t.Fatal(err)
+	}
+	exp.mu.Lock()
+	exp.state = State{Up: true, Values: *v}
+	exp.mu.Unlock()
+
+	pdu := modbusRead(t, conn, 4, 0, modbusRegisterCount)
+	if pdu[0] != 4 || int(pdu[1]) != 2*modbusRegisterCount {
+		t.Fatalf("unexpected response: %x", pdu[:2])
+	}
+	var regs []uint16
+	for i := 2; i < len(pdu); i += 2 {
+		regs = append(regs, binary.BigEndian.Uint16(pdu[i:]))
+	}
+	want := []uint16{
+		100,
+		3464, 3465, 3466, 3466, 3457, 3460, 3466, 3465,
+		27709,
+		0, 591,
+		0, 0,
+		0, 937,
+		0, 0,
+		256,
+		0xfe3e, // -45.0 °C
+		20480,
+		1,
+		0, 16376,
+		uint16(v.Date.Unix() >> 16), uint16(v.Date.Unix()),
+		0, 0, 0,
+		0, 0,
+	}
+	if diff := cmp.Diff(want, regs); diff != "" {
+		t.Errorf("registers mismatch (-want +got):\n%s", diff)
+	}
+
+	// Holding registers hold the same values.
+	if diff := cmp.Diff([]byte{3, 4, 0x0d, 0x88, 0x0d, 0x89}, modbusRead(t, conn, 3, 1, 2)); diff != "" {
+		t.Errorf("holding registers mismatch (-want +got):\n%s", diff)
+	}
+
+	exceptions := []struct {
+		name           string
+		fn             byte
+		addr, quantity uint16
+		want           []byte
+	}{
+		{"write function", 6, 0, 1, []byte{0x86, modbusIllegalFunction}},
+		{"past the map", 4, 30, 2, []byte{0x84, modbusIllegalDataAddress}},
+		{"no register", 4, 0, 0, []byte{0x84, modbusIllegalDataValue}},
+	}
+	for _, e := range exceptions {
+		if diff := cmp.Diff(e.want, modbusRead(t, conn, e.fn, e.addr, e.quantity)); diff != "" {
+			t.Errorf("%s: response mismatch (-want +got):\n%s", e.name, diff)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/common/log"
+)
+
+// Availability payloads published by the MQTT publisher.
+const (
+	MQTTOnline  = "online"
+	MQTTOffline = "offline"
+)
+
+const (
+	// mqttTimeout bounds the time spent waiting on the broker.
+	mqttTimeout = 5 * time.Second
+	// mqttRetryInterval is the delay between initial connection attempts.
+	// Once connected, the client reconnects on its own.
+	mqttRetryInterval = 10 * time.Second
+)
+
+// MQTTConfig configures an MQTTPublisher.
+type MQTTConfig struct {
+	// Broker is the URL of the broker, e.g. tcp://localhost:1883.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// TopicPrefix is the topic under which frames and availability are
+	// published.
+	TopicPrefix string
+	// DiscoveryPrefix is the Home Assistant discovery prefix. Discovery is
+	// disabled when empty.
+	DiscoveryPrefix string
+	// DeviceID identifies the device in Home Assistant.
+	DeviceID string
+	QoS      byte
+	Retain   bool
+}
+
+// MQTTPublisher publishes every decoded frame to an MQTT broker, both as a
+// JSON document on <prefix>/state and as one topic per field, and keeps
+// <prefix>/availability in sync with the device state. Availability is set
+// to offline by the broker through the Last Will when the exporter
+// disappears.
+type MQTTPublisher struct {
+	cfg    MQTTConfig
+	client mqtt.Client
+
+	mu        sync.Mutex
+	available string
+}
+
+type mqttDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type mqttDiscovery struct {
+	Name              string     `json:"name"`
+	UniqueID          string     `json:"unique_id"`
+	StateTopic        string     `json:"state_topic"`
+	ValueTemplate     string     `json:"value_template"`
+	AvailabilityTopic string     `json:"availability_topic"`
+	UnitOfMeasurement string     `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string     `json:"device_class,omitempty"`
+	StateClass        string     `json:"state_class,omitempty"`
+	PayloadOn         string     `json:"payload_on,omitempty"`
+	PayloadOff        string     `json:"payload_off,omitempty"`
+	Device            mqttDevice `json:"device"`
+}
+
+// mqttDeviceClasses maps units to Home Assistant sensor device classes.
+var mqttDeviceClasses = map[string]string{
+	"%":  "battery",
+	"V":  "voltage",
+	"A":  "current",
+	"W":  "power",
+	"°C": "temperature",
+}
+
+// NewMQTTPublisher returns a publisher connecting to the broker described by
+// cfg. The connection is only attempted by Run.
+func NewMQTTPublisher(cfg MQTTConfig) *MQTTPublisher {
+	p := &MQTTPublisher{cfg: cfg, available: MQTTOffline}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout).
+		SetWill(p.topic("availability"), MQTTOffline, cfg.QoS, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warnln("Lost connection to MQTT broker:", err)
+		})
+	p.client = mqtt.NewClient(opts)
+
+	return p
+}
+
+// Run publishes the states received from sub until it is closed, then marks
+// the device offline and disconnects.
+func (p *MQTTPublisher) Run(sub *Subscription) {
+	stop := make(chan struct{})
+	go p.connect(stop)
+	defer close(stop)
+
+	for st := range sub.C {
+		p.setAvailability(st.Up)
+		if st.Up {
+			p.publishValues(&st.Values)
+		}
+	}
+
+	p.setAvailability(false)
+	p.client.Disconnect(uint(mqttTimeout / time.Millisecond))
+}
+
+func (p *MQTTPublisher) connect(stop <-chan struct{}) {
+	for {
+		t := p.client.Connect()
+		t.Wait()
+		if t.Error() == nil {
+			return
+		}
+		log.Warnln("Error connecting to MQTT broker:", t.Error())
+
+		select {
+		case <-time.After(mqttRetryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *MQTTPublisher) onConnect(c mqtt.Client) {
+	log.Infoln("Connected to MQTT broker", p.cfg.Broker)
+	if p.cfg.DiscoveryPrefix != "" {
+		p.publishDiscovery()
+	}
+	p.mu.Lock()
+	available := p.available
+	p.mu.Unlock()
+	p.publish(p.topic("availability"), available, true)
+}
+
+func (p *MQTTPublisher) setAvailability(up bool) {
+	available := MQTTOffline
+	if up {
+		available = MQTTOnline
+	}
+
+	p.mu.Lock()
+	changed := p.available != available
+	p.available = available
+	p.mu.Unlock()
+
+	if changed {
+		p.publish(p.topic("availability"), available, true)
+	}
+}
+
+func (p *MQTTPublisher) publishValues(v *Values) {
+	doc := make(map[string]interface{}, len(valuesFields))
+	for _, f := range valuesFields {
+		value := roundValue(f.value(v))
+		doc[f.name] = value
+		p.publish(p.topic(f.name), mqttPayload(value), p.cfg.Retain)
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		log.Errorln("Error encoding MQTT state:", err)
+		return
+	}
+	p.publish(p.topic("state"), string(b), p.cfg.Retain)
+}
+
+func (p *MQTTPublisher) publishDiscovery() {
+	device := mqttDevice{
+		Identifiers:  []string{p.cfg.DeviceID},
+		Name:         "SBMS " + p.cfg.DeviceID,
+		Manufacturer: "Electrodacus",
+		Model:        "SBMS",
+	}
+
+	for _, f := range valuesFields {
+		component := "sensor"
+		cfg := mqttDiscovery{
+			Name:              strings.Replace(f.name, "_", " ", -1),
+			UniqueID:          p.cfg.DeviceID + "_" + f.name,
+			StateTopic:        p.topic("state"),
+			ValueTemplate:     "{{ value_json." + f.name + " }}",
+			AvailabilityTopic: p.topic("availability"),
+			UnitOfMeasurement: f.unit,
+			DeviceClass:       mqttDeviceClasses[f.unit],
+			Device:            device,
+		}
+		switch f.name {
+		case "date":
+			cfg.DeviceClass = "timestamp"
+		case "status_flags":
+			cfg.ValueTemplate = "{{ value_json.status_flags | join(',') }}"
+		case "charging":
+			component = "binary_sensor"
+			cfg.DeviceClass = "battery_charging"
+			cfg.ValueTemplate = "{{ 'ON' if value_json.charging else 'OFF' }}"
+			cfg.PayloadOn, cfg.PayloadOff = "ON", "OFF"
+		}
+		if f.unit != "" {
+			cfg.StateClass = "measurement"
+		}
+
+		b, err := json.Marshal(cfg)
+		if err != nil {
+			log.Errorln("Error encoding MQTT discovery config:", err)
+			continue
+		}
+		p.publish(fmt.Sprintf("%s/%s/%s/%s/config", p.cfg.DiscoveryPrefix, component, p.cfg.DeviceID, f.name), string(b), true)
+	}
+}
+
+func (p *MQTTPublisher) publish(topic, payload string, retain bool) {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+	t := p.client.Publish(topic, p.cfg.QoS, retain, payload)
+	if p.cfg.QoS == 0 {
+		return
+	}
+	if !t.WaitTimeout(mqttTimeout) {
+		log.Warnln("Timeout publishing to MQTT topic", topic)
+	} else if t.Error() != nil {
+		log.Warnln("Error publishing to MQTT topic", topic, t.Error())
+	}
+}
+
+func (p *MQTTPublisher) topic(name string) string {
+	return p.cfg.TopicPrefix + "/" + name
+}
+
+func mqttPayload(v interface{}) string {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type mqttMessage struct {
+	Topic   string
+	Payload string
+	Retain  bool
+}
+
+// mqttBroker is an embedded broker speaking just enough MQTT 3.1.1 to
+// record what clients publish.
+type mqttBroker struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	will     mqttMessage
+	messages []mqttMessage
+}
+
+func newMQTTBroker(t *testing.T) *mqttBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &mqttBroker{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *mqttBroker) URL() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+func (b *mqttBroker) Close() {
+	b.l.Close()
+}
+
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.will = mqttMessage{Topic: p.WillTopic, Payload: string(p.WillMessage), Retain: p.WillRetain}
+			b.mu.Unlock()
+			packets.NewControlPacket(packets.Connack).Write(conn)
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.messages = append(b.messages, mqttMessage{Topic: p.TopicName, Payload: string(p.Payload), Retain: p.Retain})
+			b.mu.Unlock()
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// Messages returns the messages published so far, keeping only those whose
+// topic is listed when topics are given.
+func (b *mqttBroker) Messages(topics ...string) []mqttMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var msgs []mqttMessage
+	for _, m := range b.messages {
+		keep := len(topics) == 0
+		for _, topic := range topics {
+			keep = keep || m.Topic == topic
+		}
+		if keep {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker := newMQTTBroker(t)
+	defer broker.Close()
+
+	exp := NewExporter(prometheus.NewRegistry())
+	pub := NewMQTTPublisher(MQTTConfig{
+		Broker:          broker.URL(),
+		ClientID:        "test",
+		TopicPrefix:     "sbms",
+		DiscoveryPrefix: "homeassistant",
+		DeviceID:        "garage",
+		QoS:             1,
+	})
+	wg := sync.WaitGroup{}
+	w, r := net.Pipe()
+
+	wg.Add(2)
+	go func() {
+		pub.Run(exp.Subscribe(outputBuffer))
+		wg.Done()
+	}()
+	go func() {
+		if err := exp.Export(context.Background(), r); err != io.EOF {
+			t.Errorf("unexpected error: %q", err)
+		}
+		exp.hub.Close()
+		wg.Done()
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); len(broker.Messages("sbms/availability")) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the publisher to connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	receiveData(t, w, `testdata/example1.sbms`)
+	receiveData(t, w, `testdata/too-short.sbms`)
+	w.Close()
+	wg.Wait()
+
+	if diff := cmp.Diff(mqttMessage{Topic: "sbms/availability", Payload: "offline", Retain: true}, broker.will); diff != "" {
+		t.Errorf("will mismatch (-want +got):\n%s", diff)
+	}
+
+	want := []mqttMessage{
+		{Topic: "sbms/availability", Payload: "offline", Retain: true},
+		{Topic: "sbms/availability", Payload: "online", Retain: true},
+		{Topic: "sbms/state_of_charge", Payload: "100"},
+		{Topic: "sbms/cell1_voltage", Payload: "3.464"},
+		{Topic: "sbms/charging", Payload: "true"},
+		{Topic: "sbms/status_flags", Payload: "CFET,DFET"},
+		{Topic: "sbms/battery_voltage", Payload: "27.709"},
+		{Topic: "sbms/availability", Payload: "offline", Retain: true},
+	}
+	got := broker.Messages("sbms/availability", "sbms/state_of_charge", "sbms/cell1_voltage", "sbms/battery_voltage", "sbms/charging", "sbms/status_flags")
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("messages mismatch (-want +got):\n%s", diff)
+	}
+
+	states := broker.Messages("sbms/state")
+	if len(states) != 1 {
+		t.Fatalf("unexpected number of states: %d", len(states))
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(states[0].Payload), &state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := state["battery_voltage"], 27.709; got != want {
+		t.Errorf("unexpected battery voltage in state: got %v, want %v", got, want)
+	}
+
+	soc := broker.Messages("homeassistant/sensor/garage/state_of_charge/config")
+	if len(soc) != 1 {
+		t.Fatalf("unexpected number of discovery configs: %d", len(soc))
+	}
+	var cfg mqttDiscovery
+	if err := json.Unmarshal([]byte(soc[0].Payload), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	wantCfg := mqttDiscovery{
+		Name:              "state of charge",
+		UniqueID:          "garage_state_of_charge",
+		StateTopic:        "sbms/state",
+		ValueTemplate:     "{{ value_json.state_of_charge }}",
+		AvailabilityTopic: "sbms/availability",
+		UnitOfMeasurement: "%",
+		DeviceClass:       "battery",
+		StateClass:        "measurement",
+		Device: mqttDevice{
+			Identifiers:  []string{"garage"},
+			Name:         "SBMS garage",
+			Manufacturer: "Electrodacus",
+			Model:        "SBMS",
+		},
+	}
+	if diff := cmp.Diff(wantCfg, cfg); diff != "" {
+		t.Errorf("discovery config mismatch (-want +got):\n%s", diff)
+	}
+	if !soc[0].Retain {
+		t.Error("discovery config is not retained")
+	}
+	if n := len(broker.Messages("homeassistant/binary_sensor/garage/charging/config")); n != 1 {
+		t.Errorf("unexpected number of charging discovery configs: %d", n)
+	}
+}
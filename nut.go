@@ -0,0 +1,464 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+// NUTConfig configures a NUTServer.
+type NUTConfig struct {
+	// UPS is the name under which the battery is presented.
+	UPS         string
+	Description string
+	// LowCharge is the state of charge (%) at or below which the battery is
+	// reported low (LB), which makes upsmon shut down hosts running on it.
+	LowCharge int
+	// Username and Password, when set, are required to log in. They are
+	// always required to act as the primary and force a shutdown.
+	Username string
+	Password string
+}
+
+// nutMaxLineLength is the length of the longest request line, and
+// nutIdleTimeout the time after which connections without requests are
+// closed, so that clients cannot hold onto memory or goroutines.
+const (
+	nutMaxLineLength = 1024
+	nutIdleTimeout   = 2 * time.Minute
+)
+
+// NUTServer speaks the network protocol of the Network UPS Tools upsd
+// daemon, presenting the battery as a UPS so upsmon can shut hosts down
+// before it runs flat.
+type NUTServer struct {
+	cfg NUTConfig
+	exp *Exporter
+
+	mu     sync.Mutex
+	l      net.Listener
+	conns  map[net.Conn]struct{}
+	logins int
+	fsd    bool
+	closed bool
+}
+
+// errNUTClosed is returned by Serve once the server is closed.
+var errNUTClosed = errors.New("nut: server closed")
+
+// NewNUTServer returns a server presenting the state of exp.
+func NewNUTServer(cfg NUTConfig, exp *Exporter) *NUTServer {
+	return &NUTServer{cfg: cfg, exp: exp, conns: map[net.Conn]struct{}{}}
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *NUTServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return errNUTClosed
+	}
+	s.l = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				return errNUTClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// Close stops the listener and closes the open connections.
+func (s *NUTServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.l != nil {
+		return s.l.Close()
+	}
+	return nil
+}
+
+// nutSession is the state of a client connection.
+type nutSession struct {
+	username string
+	password string
+	loggedIn bool
+}
+
+func (s *NUTServer) serve(conn net.Conn) {
+	sess := &nutSession{}
+	defer func() {
+		if sess.loggedIn {
+			s.mu.Lock()
+			s.logins--
+			s.mu.Unlock()
+		}
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewScanner(conn)
+	r.Buffer(make([]byte, 0, 256), nutMaxLineLength)
+	for {
+		conn.SetReadDeadline(time.Now().Add(nutIdleTimeout))
+		if !r.Scan() {
+			if err := r.Err(); err != nil {
+				log.Debugln("Error reading NUT request:", err)
+			}
+			return
+		}
+
+		args, err := nutSplit(r.Text())
+		if err != nil {
+			fmt.Fprint(conn, "ERR INVALID-ARGUMENT\n")
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		res, quit := s.handle(sess, args)
+		if _, err := io.WriteString(conn, res); err != nil || quit {
+			return
+		}
+	}
+}
+
+// handle returns the response to a request, and whether to close the
+// connection after sending it.
+func (s *NUTServer) handle(sess *nutSession, args []string) (string, bool) {
+	cmd := strings.ToUpper(args[0])
+	switch {
+	case cmd == "VER":
+		return "Network UPS Tools upsd-compatible sbms_exporter " + version.Version + "\n", false
+	case cmd == "NETVER":
+		return "1.2\n", false
+	case cmd == "HELP":
+		return "Commands: HELP VER GET LIST USERNAME PASSWORD STARTTLS LOGIN LOGOUT PRIMARY MASTER FSD\n", false
+	case cmd == "STARTTLS":
+		return "ERR FEATURE-NOT-CONFIGURED\n", false
+	case cmd == "LOGOUT":
+		return "OK Goodbye\n", true
+	case cmd == "USERNAME" && len(args) == 2:
+		if sess.username != "" {
+			return "ERR ALREADY-SET-USERNAME\n", false
+		}
+		sess.username = args[1]
+		return "OK\n", false
+	case cmd == "PASSWORD" && len(args) == 2:
+		if sess.password != "" {
+			return "ERR ALREADY-SET-PASSWORD\n", false
+		}
+		sess.password = args[1]
+		return "OK\n", false
+	case cmd == "LOGIN" && len(args) == 2:
+		if sess.loggedIn {
+			return "ERR ALREADY-LOGGED-IN\n", false
+		}
+		if args[1] != s.cfg.UPS {
+			return "ERR UNKNOWN-UPS\n", false
+		}
+		if !s.authorized(sess) {
+			return "ERR ACCESS-DENIED\n", false
+		}
+		sess.loggedIn = true
+		s.mu.Lock()
+		s.logins++
+		s.mu.Unlock()
+		return "OK\n", false
+	case (cmd == "MASTER" || cmd == "PRIMARY") && len(args) == 2:
+		if args[1] != s.cfg.UPS {
+			return "ERR UNKNOWN-UPS\n", false
+		}
+		if !s.privileged(sess) {
+			return "ERR ACCESS-DENIED\n", false
+		}
+		return "OK " + cmd + "-GRANTED\n", false
+	case cmd == "FSD" && len(args) == 2:
+		if args[1] != s.cfg.UPS {
+			return "ERR UNKNOWN-UPS\n", false
+		}
+		if !s.privileged(sess) {
+			return "ERR ACCESS-DENIED\n", false
+		}
+		s.mu.Lock()
+		s.fsd = true
+		s.mu.Unlock()
+		return "OK FSD-SET\n", false
+	case cmd == "GET" && len(args) >= 2:
+		return s.get(strings.ToUpper(args[1]), args[2:]), false
+	case cmd == "LIST" && len(args) >= 2:
+		return s.list(strings.ToUpper(args[1]), args[2:]), false
+	}
+	return "ERR UNKNOWN-COMMAND\n", false
+}
+
+// authorized tells whether the session may log in: anyone may without
+// credentials configured.
+func (s *NUTServer) authorized(sess *nutSession) bool {
+	return s.cfg.Username == "" || s.authenticated(sess)
+}
+
+// privileged tells whether the session may act as the primary and force the
+// shutdown of every host, which needs credentials to be configured.
+func (s *NUTServer) privileged(sess *nutSession) bool {
+	return s.cfg.Username != "" && s.authenticated(sess)
+}
+
+func (s *NUTServer) authenticated(sess *nutSession) bool {
+	user := subtle.ConstantTimeCompare([]byte(sess.username), []byte(s.cfg.Username))
+	password := subtle.ConstantTimeCompare([]byte(sess.password), []byte(s.cfg.Password))
+	return user&password == 1
+}
+
+func (s *NUTServer) get(sub string, args []string) string {
+	if len(args) == 0 {
+		return "ERR INVALID-ARGUMENT\n"
+	}
+	if args[0] != s.cfg.UPS {
+		return "ERR UNKNOWN-UPS\n"
+	}
+	ups := s.cfg.UPS
+
+	switch {
+	case sub == "UPSDESC" && len(args) == 1:
+		return "UPSDESC " + ups + " " + nutQuote(s.cfg.Description) + "\n"
+	case sub == "NUMLOGINS" && len(args) == 1:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return "NUMLOGINS " + ups + " " + strconv.Itoa(s.logins) + "\n"
+	case sub == "VAR" && len(args) == 2:
+		vars, err := s.vars()
+		if err != "" {
+			return err
+		}
+		value, ok := vars[args[1]]
+		if !ok {
+			return "ERR VAR-NOT-SUPPORTED\n"
+		}
+		return "VAR " + ups + " " + args[1] + " " + nutQuote(value) + "\n"
+	case sub == "TYPE" && len(args) == 2:
+		if _, ok := nutVarDescriptions[args[1]]; !ok {
+			return "ERR VAR-NOT-SUPPORTED\n"
+		}
+		if nutNumericVars[args[1]] {
+			return "TYPE " + ups + " " + args[1] + " NUMBER\n"
+		}
+		return "TYPE " + ups + " " + args[1] + " STRING:64\n"
+	case sub == "DESC" && len(args) == 2:
+		desc, ok := nutVarDescriptions[args[1]]
+		if !ok {
+			return "ERR VAR-NOT-SUPPORTED\n"
+		}
+		return "DESC " + ups + " " + args[1] + " " + nutQuote(desc) + "\n"
+	case sub == "CMDDESC" && len(args) == 2:
+		return "ERR CMD-NOT-SUPPORTED\n"
+	}
+	return "ERR INVALID-ARGUMENT\n"
+}
+
+func (s *NUTServer) list(sub string, args []string) string {
+	if sub == "UPS" && len(args) == 0 {
+		return "BEGIN LIST UPS\nUPS " + s.cfg.UPS + " " + nutQuote(s.cfg.Description) + "\nEND LIST UPS\n"
+	}
+	if len(args) == 0 {
+		return "ERR INVALID-ARGUMENT\n"
+	}
+	if args[0] != s.cfg.UPS {
+		return "ERR UNKNOWN-UPS\n"
+	}
+	ups := s.cfg.UPS
+
+	switch {
+	case sub == "VAR" && len(args) == 1:
+		vars, err := s.vars()
+		if err != "" {
+			return err
+		}
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		b := new(strings.Builder)
+		b.WriteString("BEGIN LIST VAR " + ups + "\n")
+		for _, name := range names {
+			b.WriteString("VAR " + ups + " " + name + " " + nutQuote(vars[name]) + "\n")
+		}
+		b.WriteString("END LIST VAR " + ups + "\n")
+		return b.String()
+	case (sub == "RW" || sub == "CMD" || sub == "CLIENT") && len(args) == 1:
+		// Nothing can be set nor run.
+		return "BEGIN LIST " + sub + " " + ups + "\nEND LIST " + sub + " " + ups + "\n"
+	case (sub == "ENUM" || sub == "RANGE") && len(args) == 2:
+		return "BEGIN LIST " + sub + " " + ups + " " + args[1] + "\nEND LIST " + sub + " " + ups + " " + args[1] + "\n"
+	}
+	return "ERR INVALID-ARGUMENT\n"
+}
+
+// nutVarDescriptions describes the variables of the UPS.
+var nutVarDescriptions = map[string]string{
+	"battery.charge":     "Battery charge (percent of full)",
+	"battery.charge.low": "Remaining battery level when UPS switches to LB (percent)",
+	"battery.current":    "Battery current (A)",
+	"battery.voltage":    "Battery voltage (V)",
+	"device.mfr":         "Device manufacturer",
+	"device.model":       "Device model",
+	"device.type":        "Device type",
+	"driver.name":        "Driver name",
+	"driver.version":     "Driver version",
+	"ups.mfr":            "UPS manufacturer",
+	"ups.model":          "UPS model",
+	"ups.status":         "UPS status",
+	"ups.temperature":    "UPS temperature (degrees C)",
+	"output.current":     "Output current (A)",
+	"input.current":      "Input current (A)",
+}
+
+// nutNumericVars are the variables whose value is a number.
+var nutNumericVars = map[string]bool{
+	"battery.charge":     true,
+	"battery.charge.low": true,
+	"battery.current":    true,
+	"battery.voltage":    true,
+	"ups.temperature":    true,
+	"output.current":     true,
+	"input.current":      true,
+}
+
+func (s *NUTServer) staticVars() map[string]string {
+	return map[string]string{
+		"battery.charge.low": strconv.Itoa(s.cfg.LowCharge),
+		"device.mfr":         "Electrodacus",
+		"device.model":       "SBMS",
+		"device.type":        "ups",
+		"driver.name":        "sbms_exporter",
+		"driver.version":     version.Version,
+		"ups.mfr":            "Electrodacus",
+		"ups.model":          "SBMS",
+	}
+}
+
+// vars returns the variables of the UPS, or the error to send when the
+// device is down.
+func (s *NUTServer) vars() (map[string]string, string) {
+	st := s.exp.State()
+	if !st.Up {
+		return nil, "ERR DATA-STALE\n"
+	}
+	v := &st.Values
+
+	vars := s.staticVars()
+	vars["battery.charge"] = strconv.Itoa(v.StateOfCharge)
+	vars["battery.voltage"] = strconv.FormatFloat(v.BatteryVoltage(), 'f', 2, 64)
+	vars["battery.current"] = strconv.FormatFloat(v.BatteryCurrent, 'f', 2, 64)
+	vars["ups.temperature"] = strconv.FormatFloat(v.InternalTemp, 'f', 1, 64)
+	vars["output.current"] = strconv.FormatFloat(v.ExtLoadCurrent, 'f', 2, 64)
+	vars["input.current"] = strconv.FormatFloat(v.PV1Current+v.PV2Current, 'f', 2, 64)
+	vars["ups.status"] = s.status(v)
+	return vars, ""
+}
+
+// status returns the ups.status of v: on line while charging, on battery
+// otherwise, and low battery at or below the configured charge. Like with
+// upsd, a forced shutdown is cleared once the battery is back on line.
+func (s *NUTServer) status(v *Values) string {
+	flags := []string{"OB"}
+	if v.Charging {
+		flags = []string{"OL", "CHRG"}
+	}
+	if v.StateOfCharge <= s.cfg.LowCharge {
+		flags = append(flags, "LB")
+	}
+	s.mu.Lock()
+	if v.Charging {
+		s.fsd = false
+	}
+	if s.fsd {
+		flags = append([]string{"FSD"}, flags...)
+	}
+	s.mu.Unlock()
+	return strings.Join(flags, " ")
+}
+
+// nutSplit splits a request line into its arguments, which may be quoted
+// and contain escaped characters.
+func nutSplit(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped, inArg = true, true
+		case c == '"':
+			quoted, inArg = !quoted, true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quoted || escaped {
+		return nil, errors.New("unterminated argument")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func nutQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,215 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type nutClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// do sends a request and returns its response, reading up to the END line of
+// lists.
+func (c *nutClient) do(req string) string {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "%s\n", req)
+	var res []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		res = append(res, strings.TrimSuffix(line, "\n"))
+		if !strings.HasPrefix(res[0], "BEGIN ") || strings.HasPrefix(line, "END ") {
+			return strings.Join(res, "\n")
+		}
+	}
+}
+
+func TestNUTServer(t *testing.T) {
+	exp := NewExporter(prometheus.NewRegistry())
+	s := NewNUTServer(NUTConfig{UPS: "sbms", Description: "Cabin bank", LowCharge: 20, Username: "upsmon", Password: "secret"}, exp)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &nutClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	// The device has not sent anything yet.
+	if got, want := c.do("GET VAR sbms ups.status"), "ERR DATA-STALE"; got != want {
+		t.Errorf("unexpected response: got %q, want %q", got, want)
+	}
+
+	v := new(Values)
+	if err := v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(")); err != nil {
+		t.Fatal(err)
+	}
+	exp.mu.Lock()
+	exp.state = State{Up: true, Values: *v}
+	exp.mu.Unlock()
+
+	conversation := []struct {
+		req, res string
+	}{
+		{"LIST UPS", "BEGIN LIST UPS\nUPS sbms \"Cabin bank\"\nEND LIST UPS"},
+		{"LOGIN sbms", "ERR ACCESS-DENIED"},
+		{"USERNAME upsmon", "OK"},
+		{`PASSWORD "secret"`, "OK"},
+		{"LOGIN sbms", "OK"},
+		{"GET NUMLOGINS sbms", "NUMLOGINS sbms 1"},
+		{"GET VAR sbms battery.charge", `VAR sbms battery.charge "100"`},
+		{"GET VAR sbms battery.voltage", `VAR sbms battery.voltage "27.71"`},
+		{"GET VAR sbms ups.status", `VAR sbms ups.status "OL CHRG"`},
+		{"GET VAR sbms ups.load", "ERR VAR-NOT-SUPPORTED"},
+		{"GET VAR ups ups.status", "ERR UNKNOWN-UPS"},
+		{"GET TYPE sbms battery.charge", "TYPE sbms battery.charge NUMBER"},
+		{"LIST VAR sbms", strings.Join([]string{
+			"BEGIN LIST VAR sbms",
+			`VAR sbms battery.charge "100"`,
+			`VAR sbms battery.charge.low "20"`,
+			`VAR sbms battery.current "0.59"`,
+			`VAR sbms battery.voltage "27.71"`,
+			`VAR sbms device.mfr "Electrodacus"`,
+			`VAR sbms device.model "SBMS"`,
+			`VAR sbms device.type "ups"`,
+			`VAR sbms driver.name "sbms_exporter"`,
+			`VAR sbms driver.version ""`,
+			`VAR sbms input.current "0.94"`,
+			`VAR sbms output.current "0.00"`,
+			`VAR sbms ups.mfr "Electrodacus"`,
+			`VAR sbms ups.model "SBMS"`,
+			`VAR sbms ups.status "OL CHRG"`,
+			`VAR sbms ups.temperature "25.6"`,
+			"END LIST VAR sbms",
+		}, "\n")},
+		{"MASTER sbms", "OK MASTER-GRANTED"},
+		{"FOO", "ERR UNKNOWN-COMMAND"},
+		{`GET "VAR`, "ERR INVALID-ARGUMENT"},
+	}
+	for _, step := range conversation {
+		if diff := cmp.Diff(step.res, c.do(step.req)); diff != "" {
+			t.Errorf("%s: response mismatch (-want +got):\n%s", step.req, diff)
+		}
+	}
+
+	// Discharging below the low charge threshold.
+	v.Charging = false
+	v.StateOfCharge = 15
+	exp.mu.Lock()
+	exp.state = State{Up: true, Values: *v}
+	exp.mu.Unlock()
+	if got, want := c.do("GET VAR sbms ups.status"), `VAR sbms ups.status "OB LB"`; got != want {
+		t.Errorf("unexpected response: got %q, want %q", got, want)
+	}
+	c.do("FSD sbms")
+	if got, want := c.do("GET VAR sbms ups.status"), `VAR sbms ups.status "FSD OB LB"`; got != want {
+		t.Errorf("unexpected response: got %q, want %q", got, want)
+	}
+
+	// The forced shutdown is cleared once back on line.
+	for _, charging := range []bool{true, false} {
+		v.Charging = charging
+		exp.mu.Lock()
+		exp.state = State{Up: true, Values: *v}
+		exp.mu.Unlock()
+		c.do("GET VAR sbms ups.status")
+	}
+	if got, want := c.do("GET VAR sbms ups.status"), `VAR sbms ups.status "OB LB"`; got != want {
+		t.Errorf("unexpected response after the return of power: got %q, want %q", got, want)
+	}
+
+	// Overlong requests close the connection.
+	long, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer long.Close()
+	fmt.Fprintf(long, "GET VAR sbms %s\n", strings.Repeat("x", nutMaxLineLength))
+	long.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = long.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); err == nil || ok && e.Timeout() {
+		t.Errorf("got error %v after an overlong request, want the connection closed", err)
+	}
+
+	if got, want := c.do("LOGOUT"), "OK Goodbye"; got != want {
+		t.Errorf("unexpected response: got %q, want %q", got, want)
+	}
+}
+
+func TestNUTServerWithoutCredentials(t *testing.T) {
+	exp := NewExporter(prometheus.NewRegistry())
+	s := NewNUTServer(NUTConfig{UPS: "sbms"}, exp)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &nutClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	// Monitoring is open, but not forcing hosts to shut down.
+	for _, step := range []struct {
+		req, res string
+	}{
+		{"LOGIN sbms", "OK"},
+		{"PRIMARY sbms", "ERR ACCESS-DENIED"},
+		{"MASTER sbms", "ERR ACCESS-DENIED"},
+		{"FSD sbms", "ERR ACCESS-DENIED"},
+	} {
+		if diff := cmp.Diff(step.res, c.do(step.req)); diff != "" {
+			t.Errorf("%s: response mismatch (-want +got):\n%s", step.req, diff)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fsd {
+		t.Error("FSD set without credentials")
+	}
+}
+
+func TestNUTSplit(t *testing.T) {
+	got, err := nutSplit(`SET VAR sbms ups.id "my \"big\" ups"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"SET", "VAR", "sbms", "ups.id", `my "big" ups`}, got); diff != "" {
+		t.Errorf("arguments mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// OTLP protocols.
+const (
+	OTLPProtocolHTTP = "http/protobuf"
+	OTLPProtocolGRPC = "grpc"
+)
+
+// otlpExportMethod is the gRPC method of the OTLP metrics service.
+const otlpExportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// otlpMaxGap is the longest time between two frames over which energy is
+// integrated. Longer gaps are outages and do not count.
+const otlpMaxGap = 5 * time.Minute
+
+// OTLPConfig configures an OTLPExporter.
+type OTLPConfig struct {
+	// Endpoint is the URL of the metrics endpoint for OTLP/HTTP, e.g.
+	// http://collector:4318/v1/metrics, or the address of the collector for
+	// OTLP/gRPC, e.g. collector:4317.
+	Endpoint string
+	Protocol string
+	// Insecure disables TLS for OTLP/gRPC.
+	Insecure bool
+	// Headers are sent with every request, as gRPC metadata for OTLP/gRPC.
+	Headers map[string]string
+	// Attributes are the resource attributes identifying the device.
+	Attributes map[string]string
+
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// OTLPExporter periodically exports the last decoded frame to an
+// OpenTelemetry collector, along with the energy integrated since it started.
+type OTLPExporter struct {
+	cfg    OTLPConfig
+	client *http.Client
+	conn   *grpc.ClientConn
+
+	start    time.Time
+	last     State
+	energy   otlpEnergy
+	received bool
+}
+
+// otlpEnergy holds the energy counters, in watt-hours.
+type otlpEnergy struct {
+	Charged    float64
+	Discharged float64
+	PV         float64
+	Load       float64
+}
+
+// NewOTLPExporter returns an exporter sending metrics to cfg.Endpoint. The
+// gRPC connection is established lazily.
+func NewOTLPExporter(cfg OTLPConfig) (*OTLPExporter, error) {
+	e := &OTLPExporter{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+
+	switch cfg.Protocol {
+	case OTLPProtocolHTTP:
+	case OTLPProtocolGRPC:
+		creds := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+		if cfg.Insecure {
+			creds = grpc.WithInsecure()
+		}
+		conn, err := grpc.Dial(cfg.Endpoint, creds)
+		if err != nil {
+			return nil, err
+		}
+		e.conn = conn
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q", cfg.Protocol)
+	}
+	return e, nil
+}
+
+// Run accumulates the frames received from sub and exports them at every
+// interval until sub is closed, at which point they are exported once more.
+func (e *OTLPExporter) Run(sub *Subscription) {
+	if e.conn != nil {
+		defer e.conn.Close()
+	}
+
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				e.flush()
+				return
+			}
+			e.add(st)
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+// add integrates the energy between the last frame and st.
+func (e *OTLPExporter) add(st State) {
+	if !st.Up {
+		e.last.Up = false
+		return
+	}
+
+	if !e.received {
+		e.start, e.received = st.Received, true
+	}
+	if e.last.Up {
+		if dt := st.Received.Sub(e.last.Received); dt > 0 && dt <= otlpMaxGap {
+			h := dt.Hours()
+			v := &e.last.Values
+			if p := v.BatteryPower(); p > 0 {
+				e.energy.Charged += p * h
+			} else {
+				e.energy.Discharged -= p * h
+			}
+			e.energy.PV += (v.PV1Current + v.PV2Current) * v.BatteryVoltage() * h
+			e.energy.Load += v.ExtLoadCurrent * v.BatteryVoltage() * h
+		}
+	}
+	e.last = st
+}
+
+func (e *OTLPExporter) flush() {
+	if !e.received {
+		return
+	}
+
+	req := otlpRequest(e.cfg.Attributes, e.last, e.energy, e.start)
+	if err := e.export(req); err != nil {
+		log.Errorln("Error exporting OTLP metrics:", err)
+	}
+}
+
+func (e *OTLPExporter) export(req *otlpExportRequest) error {
+	if e.conn != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+		defer cancel()
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(e.cfg.Headers))
+		return e.conn.Invoke(ctx, otlpExportMethod, req, &otlpExportResponse{})
+	}
+
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest("POST", e.cfg.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "sbms_exporter/"+version.Version)
+	for k, v := range e.cfg.Headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	res, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// otlpRequest returns the metrics of st and the energy integrated since
+// start. Gauges are left out while the device is down.
+func otlpRequest(attrs map[string]string, st State, energy otlpEnergy, start time.Time) *otlpExportRequest {
+	now := uint64(st.Received.UnixNano())
+	gauge := func(name, desc, unit string, points ...*otlpNumberDataPoint) *otlpMetric {
+		for _, p := range points {
+			p.TimeUnixNano = now
+		}
+		return &otlpMetric{Name: name, Description: desc, Unit: unit, Gauge: &otlpGauge{DataPoints: points}}
+	}
+	sum := func(name, desc, unit string, points ...*otlpNumberDataPoint) *otlpMetric {
+		for _, p := range points {
+			p.StartTimeUnixNano = uint64(start.UnixNano())
+			p.TimeUnixNano = now
+		}
+		return &otlpMetric{Name: name, Description: desc, Unit: unit, Sum: &otlpSum{
+			DataPoints:             points,
+			AggregationTemporality: otlpAggregationTemporalityCumulative,
+			IsMonotonic:            true,
+		}}
+	}
+	point := func(value float64, attrs ...string) *otlpNumberDataPoint {
+		p := &otlpNumberDataPoint{AsDouble: proto.Float64(value)}
+		for i := 0; i+1 < len(attrs); i += 2 {
+			p.Attributes = append(p.Attributes, otlpKeyValue(attrs[i], attrs[i+1]))
+		}
+		return p
+	}
+
+	var metrics []*otlpMetric
+	if st.Up {
+		v := &st.Values
+		battVolts := v.BatteryVoltage()
+		metrics = append(metrics,
+			gauge("sbms.battery.state_of_charge", "Battery state of charge.", "%", point(float64(v.StateOfCharge))),
+			gauge("sbms.battery.voltage", "Battery voltage.", "V", point(battVolts)),
+			gauge("sbms.battery.current", "Battery current (positive means charging).", "A", point(v.BatteryCurrent)),
+			gauge("sbms.battery.power", "Battery power (positive means charging).", "W", point(v.BatteryPower())),
+			gauge("sbms.battery.charging", "Whether the battery is charging.", "1", point(boolAsFloat(v.Charging))),
+			gauge("sbms.cell.voltage", "Battery cell voltage.", "V",
+				point(v.Cell1Voltage, "cell", "1"),
+				point(v.Cell2Voltage, "cell", "2"),
+				point(v.Cell3Voltage, "cell", "3"),
+				point(v.Cell4Voltage, "cell", "4"),
+				point(v.Cell5Voltage, "cell", "5"),
+				point(v.Cell6Voltage, "cell", "6"),
+				point(v.Cell7Voltage, "cell", "7"),
+				point(v.Cell8Voltage, "cell", "8"),
+			),
+			gauge("sbms.pv.current", "PV current.", "A", point(v.PV1Current, "pv", "1"), point(v.PV2Current, "pv", "2")),
+			gauge("sbms.pv.power", "PV power.", "W", point(v.PV1Current*battVolts, "pv", "1"), point(v.PV2Current*battVolts, "pv", "2")),
+			gauge("sbms.load.current", "External load current.", "A", point(v.ExtLoadCurrent)),
+			gauge("sbms.load.power", "External load power.", "W", point(v.ExtLoadCurrent*battVolts)),
+			gauge("sbms.temperature", "Temperature.", "Cel", point(v.InternalTemp, "sensor", "internal"), point(v.ExternalTemp, "sensor", "external")),
+			gauge("sbms.status", "Device status bits.", "1", point(float64(v.Status))),
+		)
+	}
+	metrics = append(metrics,
+		sum("sbms.battery.energy", "Energy flowing in and out of the battery.", "W.h",
+			point(energy.Charged, "direction", "charge"),
+			point(energy.Discharged, "direction", "discharge"),
+		),
+		sum("sbms.pv.energy", "Energy produced by the PV arrays.", "W.h", point(energy.PV)),
+		sum("sbms.load.energy", "Energy consumed by the external load.", "W.h", point(energy.Load)),
+	)
+
+	resource := &otlpResource{}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		resource.Attributes = append(resource.Attributes, otlpKeyValue(k, attrs[k]))
+	}
+
+	return &otlpExportRequest{ResourceMetrics: []*otlpResourceMetrics{{
+		Resource: resource,
+		ScopeMetrics: []*otlpScopeMetrics{{
+			Scope:   &otlpInstrumentationScope{Name: "sbms_exporter", Version: version.Version},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+func otlpKeyValue(key, value string) *otlpAttribute {
+	return &otlpAttribute{Key: key, Value: &otlpAnyValue{StringValue: proto.String(value)}}
+}
+
+// The messages below mirror the ones of opentelemetry-proto that metrics
+// export needs. Fields of a oneof are pointers so they are encoded even when
+// holding a zero value.
+
+const otlpAggregationTemporalityCumulative = 2
+
+type otlpExportRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics,proto3"`
+}
+
+func (m *otlpExportRequest) Reset()         { *m = otlpExportRequest{} }
+func (m *otlpExportRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpExportRequest) ProtoMessage()    {}
+
+type otlpExportResponse struct{}
+
+func (m *otlpExportResponse) Reset()         { *m = otlpExportResponse{} }
+func (m *otlpExportResponse) String() string { return proto.CompactTextString(m) }
+func (*otlpExportResponse) ProtoMessage()    {}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `protobuf:"bytes,1,opt,name=resource,proto3"`
+	ScopeMetrics []*otlpScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics,proto3"`
+}
+
+func (m *otlpResourceMetrics) Reset()         { *m = otlpResourceMetrics{} }
+func (m *otlpResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpResourceMetrics) ProtoMessage()    {}
+
+type otlpResource struct {
+	Attributes []*otlpAttribute `protobuf:"bytes,1,rep,name=attributes,proto3"`
+}
+
+func (m *otlpResource) Reset()         { *m = otlpResource{} }
+func (m *otlpResource) String() string { return proto.CompactTextString(m) }
+func (*otlpResource) ProtoMessage()    {}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpInstrumentationScope `protobuf:"bytes,1,opt,name=scope,proto3"`
+	Metrics []*otlpMetric             `protobuf:"bytes,2,rep,name=metrics,proto3"`
+}
+
+func (m *otlpScopeMetrics) Reset()         { *m = otlpScopeMetrics{} }
+func (m *otlpScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpScopeMetrics) ProtoMessage()    {}
+
+type otlpInstrumentationScope struct {
+	Name    string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Version string `protobuf:"bytes,2,opt,name=version,proto3"`
+}
+
+func (m *otlpInstrumentationScope) Reset()         { *m = otlpInstrumentationScope{} }
+func (m *otlpInstrumentationScope) String() string { return proto.CompactTextString(m) }
+func (*otlpInstrumentationScope) ProtoMessage()    {}
+
+type otlpMetric struct {
+	Name        string     `protobuf:"bytes,1,opt,name=name,proto3"`
+	Description string     `protobuf:"bytes,2,opt,name=description,proto3"`
+	Unit        string     `protobuf:"bytes,3,opt,name=unit,proto3"`
+	Gauge       *otlpGauge `protobuf:"bytes,5,opt,name=gauge"`
+	Sum         *otlpSum   `protobuf:"bytes,7,opt,name=sum"`
+}
+
+func (m *otlpMetric) Reset()         { *m = otlpMetric{} }
+func (m *otlpMetric) String() string { return proto.CompactTextString(m) }
+func (*otlpMetric) ProtoMessage()    {}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3"`
+}
+
+func (m *otlpGauge) Reset()         { *m = otlpGauge{} }
+func (m *otlpGauge) String() string { return proto.CompactTextString(m) }
+func (*otlpGauge) ProtoMessage()    {}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3"`
+	AggregationTemporality int32                  `protobuf:"varint,2,opt,name=aggregation_temporality,proto3"`
+	IsMonotonic            bool                   `protobuf:"varint,3,opt,name=is_monotonic,proto3"`
+}
+
+func (m *otlpSum) Reset()         { *m = otlpSum{} }
+func (m *otlpSum) String() string { return proto.CompactTextString(m) }
+func (*otlpSum) ProtoMessage()    {}
+
+type otlpNumberDataPoint struct {
+	StartTimeUnixNano uint64           `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3"`
+	TimeUnixNano      uint64           `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	AsDouble          *float64         `protobuf:"fixed64,4,opt,name=as_double"`
+	Attributes        []*otlpAttribute `protobuf:"bytes,7,rep,name=attributes,proto3"`
+}
+
+func (m *otlpNumberDataPoint) Reset()         { *m = otlpNumberDataPoint{} }
+func (m *otlpNumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpNumberDataPoint) ProtoMessage()    {}
+
+type otlpAttribute struct {
+	Key   string        `protobuf:"bytes,1,opt,name=key,proto3"`
+	Value *otlpAnyValue `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *otlpAttribute) Reset()         { *m = otlpAttribute{} }
+func (m *otlpAttribute) String() string { return proto.CompactTextString(m) }
+func (*otlpAttribute) ProtoMessage()    {}
+
+type otlpAnyValue struct {
+	StringValue *string `protobuf:"bytes,1,opt,name=string_value"`
+}
+
+func (m *otlpAnyValue) Reset()         { *m = otlpAnyValue{} }
+func (m *otlpAnyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpAnyValue) ProtoMessage()    {}
@@ -0,0 +1,179 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// otlpStates returns two frames a minute apart, followed by a disconnection.
+func otlpStates() []State {
+	v := new(Values)
+	v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N("))
+	start := time.Date(2019, 11, 14, 23, 2, 11, 0, time.UTC)
+	return []State{
+		{Up: true, Values: *v, Received: start},
+		{Up: true, Values: *v, Received: start.Add(time.Minute)},
+		{Up: false, Values: *v, Received: start.Add(time.Minute)},
+	}
+}
+
+func checkOTLPRequest(t *testing.T, req *otlpExportRequest, up bool) {
+	t.Helper()
+	if len(req.ResourceMetrics) != 1 || len(req.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("unexpected request layout: %v", req)
+	}
+	rm := req.ResourceMetrics[0]
+	if diff := cmp.Diff([]*otlpAttribute{otlpKeyValue("device.id", "cabin"), otlpKeyValue("service.name", "sbms_exporter")}, rm.Resource.Attributes); diff != "" {
+		t.Errorf("resource attributes mismatch (-want +got):\n%s", diff)
+	}
+
+	metrics := map[string]*otlpMetric{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	soc := metrics["sbms.battery.state_of_charge"]
+	switch {
+	case !up && soc != nil:
+		t.Error("gauges exported while the device is down")
+	case up && (soc == nil || soc.Unit != "%" || *soc.Gauge.DataPoints[0].AsDouble != 100):
+		t.Errorf("unexpected state of charge: %v", soc)
+	}
+
+	energy := metrics["sbms.battery.energy"]
+	if energy == nil || energy.Unit != "W.h" || energy.Sum == nil || !energy.Sum.IsMonotonic || energy.Sum.AggregationTemporality != otlpAggregationTemporalityCumulative {
+		t.Fatalf("unexpected battery energy: %v", energy)
+	}
+	charged := energy.Sum.DataPoints[0]
+	if got, want := *charged.AsDouble, 16.376019/60; math.Abs(got-want) > 1e-9 {
+		t.Errorf("unexpected charged energy: got %v, want %v", got, want)
+	}
+	if got := *energy.Sum.DataPoints[1].AsDouble; got != 0 {
+		t.Errorf("unexpected discharged energy: %v", got)
+	}
+	if got, want := charged.StartTimeUnixNano, uint64(time.Date(2019, 11, 14, 23, 2, 11, 0, time.UTC).UnixNano()); got != want {
+		t.Errorf("unexpected start time: got %d, want %d", got, want)
+	}
+}
+
+func TestOTLPExporterHTTP(t *testing.T) {
+	var reqs []*otlpExportRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Api-Key") != "secret" {
+			t.Errorf("unexpected request: %s %v", r.URL.Path, r.Header)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		req := &otlpExportRequest{}
+		if err := proto.Unmarshal(b, req); err != nil {
+			t.Error(err)
+		}
+		reqs = append(reqs, req)
+	}))
+	defer srv.Close()
+
+	e, err := NewOTLPExporter(OTLPConfig{
+		Endpoint:   srv.URL + "/v1/metrics",
+		Protocol:   OTLPProtocolHTTP,
+		Headers:    map[string]string{"Api-Key": "secret"},
+		Attributes: map[string]string{"service.name": "sbms_exporter", "device.id": "cabin"},
+		Interval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	sub := hub.Subscribe(outputBuffer)
+	states := otlpStates()
+	for _, st := range states[:2] {
+		hub.Publish(st)
+	}
+	hub.Close()
+	e.Run(sub)
+
+	if len(reqs) != 1 {
+		t.Fatalf("unexpected number of requests: %d", len(reqs))
+	}
+	checkOTLPRequest(t, reqs[0], true)
+}
+
+func TestOTLPExporterGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reqs []*otlpExportRequest
+	var md metadata.MD
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Export",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &otlpExportRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				reqs = append(reqs, req)
+				md, _ = metadata.FromIncomingContext(ctx)
+				return &otlpExportResponse{}, nil
+			},
+		}},
+	}, struct{}{})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	e, err := NewOTLPExporter(OTLPConfig{
+		Endpoint:   l.Addr().String(),
+		Protocol:   OTLPProtocolGRPC,
+		Insecure:   true,
+		Headers:    map[string]string{"api-key": "secret"},
+		Attributes: map[string]string{"service.name": "sbms_exporter", "device.id": "cabin"},
+		Interval:   time.Hour,
+		Timeout:    5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	sub := hub.Subscribe(outputBuffer)
+	for _, st := range otlpStates() {
+		hub.Publish(st)
+	}
+	hub.Close()
+	e.Run(sub)
+
+	if len(reqs) != 1 {
+		t.Fatalf("unexpected number of requests: %d", len(reqs))
+	}
+	checkOTLPRequest(t, reqs[0], false)
+	if got := md.Get("api-key"); len(got) != 1 || got[0] != "secret" {
+		t.Errorf("unexpected api-key metadata: %v", got)
+	}
+}
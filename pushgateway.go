@@ -0,0 +1,142 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/log"
+)
+
+// PushgatewayConfig configures a PushgatewayPusher.
+type PushgatewayConfig struct {
+	// URL is the address of the Pushgateway, e.g. http://pushgateway:9091.
+	URL      string
+	Job      string
+	Grouping map[string]string
+	Username string
+	Password string
+
+	// Interval is the interval at which the metrics are pushed, on top of
+	// the pushes on every up/down transition.
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// PushgatewayPusher pushes the metrics of the exporter to a Pushgateway and
+// deletes its group on exit, so stale values do not outlive the exporter.
+type PushgatewayPusher struct {
+	cfg      PushgatewayConfig
+	client   *http.Client
+	pusher   *push.Pusher
+	groupURL string
+	exp      *Exporter
+}
+
+// NewPushgatewayPusher returns a pusher replacing the group described by cfg.
+func NewPushgatewayPusher(cfg PushgatewayConfig) *PushgatewayPusher {
+	reg := prometheus.NewRegistry()
+	client := &http.Client{Timeout: cfg.Timeout}
+	p := push.New(cfg.URL, cfg.Job).Gatherer(reg).Client(client)
+	if cfg.Username != "" {
+		p = p.BasicAuth(cfg.Username, cfg.Password)
+	}
+
+	// The group URL is built the way push does, which does not expose it.
+	base := strings.TrimSuffix(cfg.URL, "/")
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	groupURL := base + "/metrics/job/" + url.QueryEscape(cfg.Job)
+	keys := make([]string, 0, len(cfg.Grouping))
+	for k := range cfg.Grouping {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p = p.Grouping(k, cfg.Grouping[k])
+		groupURL += "/" + k + "/" + cfg.Grouping[k]
+	}
+
+	return &PushgatewayPusher{cfg: cfg, client: client, pusher: p, groupURL: groupURL, exp: NewExporter(reg)}
+}
+
+// Run pushes the metrics at every interval and whenever the device goes up
+// or down, until sub is closed, at which point the group is deleted.
+func (p *PushgatewayPusher) Run(sub *Subscription) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	received, up := false, false
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				if err := p.delete(); err != nil {
+					log.Errorln("Error deleting Pushgateway group:", err)
+				}
+				return
+			}
+			p.exp.mirror(st)
+			if !received || st.Up != up {
+				p.push()
+			}
+			received, up = true, st.Up
+		case <-ticker.C:
+			if received {
+				p.push()
+			}
+		}
+	}
+}
+
+// push replaces the metrics of the group. Failures are only logged since
+// the next push carries fresher values anyway.
+func (p *PushgatewayPusher) push() {
+	if err := p.pusher.Push(); err != nil {
+		log.Errorln("Error pushing to Pushgateway:", err)
+	}
+}
+
+// delete removes the group from the Pushgateway. The push package of this
+// version of client_golang cannot do it.
+func (p *PushgatewayPusher) delete() error {
+	req, err := http.NewRequest("DELETE", p.groupURL, nil)
+	if err != nil {
+		return err
+	}
+	if p.cfg.Username != "" {
+		req.SetBasicAuth(p.cfg.Username, p.cfg.Password)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("unexpected status code %d while deleting %s: %s", res.StatusCode, p.groupURL, body)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+type pushgatewayRequest struct {
+	Method string
+	Path   string
+	// Up is the value of sbms_up pushed, and SOC whether the battery state
+	// of charge was part of it.
+	Up  float64
+	SOC bool
+}
+
+func TestPushgatewayPusher(t *testing.T) {
+	var mu sync.Mutex
+	var requests []pushgatewayRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := pushgatewayRequest{Method: r.Method, Path: r.URL.Path}
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Error(err)
+				break
+			}
+			switch mf.GetName() {
+			case "sbms_up":
+				req.Up = mf.Metric[0].GetGauge().GetValue()
+			case "sbms_battery_soc":
+				req.SOC = true
+			}
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	p := NewPushgatewayPusher(PushgatewayConfig{
+		URL:      srv.URL,
+		Job:      "sbms",
+		Grouping: map[string]string{"site": "cabin"},
+		Interval: time.Hour,
+	})
+
+	hub := NewHub()
+	sub := hub.Subscribe(outputBuffer)
+	v := new(Values)
+	v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N("))
+	for _, st := range []State{{Up: true, Values: *v}, {Up: true, Values: *v}, {Up: false}, {Up: false}, {Up: true, Values: *v}} {
+		hub.Publish(st)
+	}
+	hub.Close()
+	p.Run(sub)
+
+	want := []pushgatewayRequest{
+		{Method: "PUT", Path: "/metrics/job/sbms/site/cabin", Up: 1, SOC: true},
+		{Method: "PUT", Path: "/metrics/job/sbms/site/cabin", Up: 0},
+		{Method: "PUT", Path: "/metrics/job/sbms/site/cabin", Up: 1, SOC: true},
+		{Method: "DELETE", Path: "/metrics/job/sbms/site/cabin"},
+	}
+	if diff := cmp.Diff(want, requests); diff != "" {
+		t.Errorf("requests mismatch (-want +got):\n%s", diff)
+	}
+}
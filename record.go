@@ -0,0 +1,207 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// Recorder appends every raw line written to it to a rotating log file,
+// each one prefixed with the host time at which it was received.
+//
+// A record is a single line made of an RFC 3339 timestamp, a tab and the
+// raw line as it came out of the device.
+type Recorder struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	now      func() time.Time
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	pending []byte
+}
+
+// NewRecorder opens (or creates) the log file at path. Once the file grows
+// past maxSize bytes it is rotated to path.1, path.1 to path.2 and so on,
+// keeping at most maxFiles rotated files. A maxSize of 0 disables rotation.
+func NewRecorder(path string, maxSize int64, maxFiles int) (*Recorder, error) {
+	r := &Recorder{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		now:      time.Now,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write records every complete line found in p. Partial lines are kept
+// until their newline arrives. Recording failures are logged rather than
+// returned so that a full disk never interrupts the exporter.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.pending = append(r.pending, p...)
+	for {
+		i := bytes.IndexByte(r.pending, '\n')
+		if i < 0 {
+			break
+		}
+		if err := r.record(now, r.pending[:i]); err != nil {
+			log.Errorln("Error recording frame:", err)
+		}
+		r.pending = r.pending[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Close closes the underlying log file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func (r *Recorder) record(t time.Time, line []byte) error {
+	rec := make([]byte, 0, len(line)+40)
+	rec = t.UTC().AppendFormat(rec, time.RFC3339Nano)
+	rec = append(rec, '\t')
+	rec = append(rec, line...)
+	rec = append(rec, '\n')
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(rec)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.f.Write(rec)
+	r.size += int64(n)
+	return err
+}
+
+func (r *Recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *Recorder) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	if r.maxFiles < 1 {
+		return os.Remove(r.path)
+	}
+	for i := r.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, r.path+".1")
+}
+
+// ReplayReader reads a log written by a Recorder and gives back the raw
+// lines it contains, paced by their recorded timestamps.
+type ReplayReader struct {
+	s       *bufio.Scanner
+	speed   float64
+	sleep   func(time.Duration)
+	line    int
+	last    time.Time
+	pending []byte
+}
+
+// NewReplayReader returns a reader replaying the recording read from r.
+// A speed of 1 replays in real time, 10 ten times faster and 0 as fast as
+// possible.
+func NewReplayReader(r io.Reader, speed float64) *ReplayReader {
+	return &ReplayReader{
+		s:     bufio.NewScanner(r),
+		speed: speed,
+		sleep: time.Sleep,
+	}
+}
+
+// Read implements io.Reader.
+func (r *ReplayReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if !r.s.Scan() {
+			if r.s.Err() != nil {
+				return 0, r.s.Err()
+			}
+			return 0, io.EOF
+		}
+		r.line++
+
+		rec := r.s.Bytes()
+		i := bytes.IndexByte(rec, '\t')
+		if i < 0 {
+			return 0, fmt.Errorf("replay: line %d: missing timestamp separator", r.line)
+		}
+		t, err := time.Parse(time.RFC3339Nano, string(rec[:i]))
+		if err != nil {
+			return 0, fmt.Errorf("replay: line %d: %v", r.line, err)
+		}
+
+		if r.speed > 0 && !r.last.IsZero() && t.After(r.last) {
+			r.sleep(time.Duration(float64(t.Sub(r.last)) / r.speed))
+		}
+		r.last = t
+
+		r.pending = append(append(r.pending, rec[i+1:]...), '\n')
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sbms.rec")
+	rec, err := NewRecorder(path, 40, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 11, 14, 23, 2, 11, 0, time.UTC)
+	rec.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, chunk := range []string{"first", " line\nsec", "ond line\n", "third line\n"} {
+		if n, err := rec.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("unexpected write result: %d, %q", n, err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{
+		path + ".1": "2019-11-14T23:02:14Z\tsecond line\n",
+		path:        "2019-11-14T23:02:15Z\tthird line\n",
+	} {
+		got, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, string(got)); diff != "" {
+			t.Errorf("%s mismatch (-want +got):\n%s", file, diff)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("unexpected rotated file: %v", err)
+	}
+}
+
+func TestReplayReader(t *testing.T) {
+	f, err := os.Open(`testdata/example.rec`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var slept []time.Duration
+	r := NewReplayReader(f, 2)
+	r.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+
+	want := new(strings.Builder)
+	for _, sbms := range []string{`testdata/example1.sbms`, `testdata/too-short.sbms`, `testdata/example2.sbms`} {
+		b, _ := ioutil.ReadFile(sbms)
+		want.Write(b)
+	}
+	if diff := cmp.Diff(want.String(), string(got)); diff != "" {
+		t.Errorf("replayed data mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]time.Duration{498500 * time.Microsecond, 498500 * time.Microsecond}, slept); diff != "" {
+		t.Errorf("pacing mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReplayReaderMalformed(t *testing.T) {
+	r := NewReplayReader(strings.NewReader("not a recording\n"), 0)
+	if _, err := ioutil.ReadAll(r); err == nil || err.Error() != "replay: line 1: missing timestamp separator" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReplayExport(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	exp := NewExporter(reg)
+	sub := exp.Subscribe(outputBuffer)
+	wg := sync.WaitGroup{}
+	w, r := net.Pipe()
+
+	wg.Add(1)
+	go func() {
+		err := exp.Export(context.Background(), r)
+		if err != io.EOF {
+			t.Errorf("unexpected error: %q", err)
+		}
+		wg.Done()
+	}()
+
+	f, err := os.Open(`testdata/example.rec`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, NewReplayReader(f, 0)); err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	// One state per recorded line.
+	for i := 0; i < 3; i++ {
+		<-sub.C
+	}
+	ensureMetricsEquals(t, reg, `testdata/example2.metrics`)
+
+	w.Close()
+	wg.Wait()
+}
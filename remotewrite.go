@@ -0,0 +1,272 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+// RemoteWriteConfig configures a RemoteWriter.
+type RemoteWriteConfig struct {
+	// URL is the remote write endpoint, e.g. http://prometheus:9090/api/v1/write.
+	URL string
+	// Labels are added to every series, typically job and instance.
+	Labels      map[string]string
+	Username    string
+	Password    string
+	BearerToken string
+
+	// QueueDir is the directory holding the samples not sent yet.
+	QueueDir string
+	// SegmentSize and MaxSegments bound the size of the queue on disk.
+	SegmentSize int64
+	MaxSegments int
+
+	// BatchSize is the number of frames sent per request.
+	BatchSize int
+	// FlushInterval is the interval at which queued samples are sent.
+	FlushInterval time.Duration
+	Timeout       time.Duration
+}
+
+// RemoteWriter pushes the metrics of every state to a Prometheus remote write
+// endpoint. Samples go through an on-disk queue first, so the ones taken
+// while the endpoint is unreachable are delivered later with their original
+// timestamps, even across restarts.
+type RemoteWriter struct {
+	cfg    RemoteWriteConfig
+	client *http.Client
+	queue  *DiskQueue
+	reg    *prometheus.Registry
+	exp    *Exporter
+	now    func() time.Time
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	backoff    time.Duration
+	retryAt    time.Time
+}
+
+// NewRemoteWriter opens the queue in cfg.QueueDir and returns a writer
+// sending its samples to cfg.URL.
+func NewRemoteWriter(cfg RemoteWriteConfig) (*RemoteWriter, error) {
+	queue, err := OpenDiskQueue(cfg.QueueDir, cfg.SegmentSize, cfg.MaxSegments)
+	if err != nil {
+		return nil, err
+	}
+
+	reg := prometheus.NewRegistry()
+	return &RemoteWriter{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		queue:      queue,
+		reg:        reg,
+		exp:        NewExporter(reg),
+		now:        time.Now,
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+	}, nil
+}
+
+// Run queues the samples of the states received from sub and sends them
+// until sub is closed, at which point the queue is flushed once. Samples left
+// in the queue are sent on the next run.
+func (w *RemoteWriter) Run(sub *Subscription) {
+	defer w.queue.Close()
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				w.retryAt = time.Time{}
+				w.flush()
+				return
+			}
+			if err := w.enqueue(st); err != nil {
+				log.Errorln("Error queuing remote write samples:", err)
+			}
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *RemoteWriter) enqueue(st State) error {
+	w.exp.mirror(st)
+	mfs, err := w.reg.Gather()
+	if err != nil {
+		return err
+	}
+
+	// Down states keep the time of the last frame received, but the samples
+	// need the time at which they were reached.
+	ts := st.Time
+	if ts.IsZero() {
+		ts = w.now()
+	}
+	req := &prompbWriteRequest{}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			labels := []*prompbLabel{{Name: "__name__", Value: mf.GetName()}}
+			for _, l := range m.Label {
+				labels = append(labels, &prompbLabel{Name: l.GetName(), Value: l.GetValue()})
+			}
+			for k, v := range w.cfg.Labels {
+				labels = append(labels, &prompbLabel{Name: k, Value: v})
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+			req.Timeseries = append(req.Timeseries, &prompbTimeSeries{
+				Labels:  labels,
+				Samples: []*prompbSample{{Value: m.GetGauge().GetValue(), Timestamp: ts.UnixNano() / int64(time.Millisecond)}},
+			})
+		}
+	}
+
+	rec, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return w.queue.Append(rec)
+}
+
+// flush sends the queued samples in batches, stopping at the first failure
+// so they are retried once the backoff has elapsed.
+func (w *RemoteWriter) flush() {
+	if w.now().Before(w.retryAt) {
+		return
+	}
+
+	for {
+		recs, next, err := w.queue.Read(w.cfg.BatchSize)
+		if err != nil {
+			log.Errorln("Error reading remote write queue:", err)
+			return
+		}
+		if len(recs) == 0 {
+			return
+		}
+
+		// Concatenated WriteRequests decode as one holding all the series.
+		retry, err := w.send(bytes.Join(recs, nil))
+		if err != nil && retry {
+			w.backoff *= 2
+			if w.backoff == 0 {
+				w.backoff = w.minBackoff
+			}
+			if w.backoff > w.maxBackoff {
+				w.backoff = w.maxBackoff
+			}
+			w.retryAt = w.now().Add(w.backoff)
+			log.Warnf("Error sending remote write samples, retrying in %s: %v", w.backoff, err)
+			return
+		}
+		if err != nil {
+			log.Errorf("Error sending remote write samples, dropping %d frames: %v", len(recs), err)
+		}
+
+		w.backoff = 0
+		if err := w.queue.Commit(next); err != nil {
+			log.Errorln("Error committing remote write queue:", err)
+			return
+		}
+	}
+}
+
+// send posts a WriteRequest and tells, on failure, whether it should be
+// retried.
+func (w *RemoteWriter) send(req []byte) (bool, error) {
+	httpReq, err := http.NewRequest("POST", w.cfg.URL, bytes.NewReader(snappy.Encode(nil, req)))
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "sbms_exporter/"+version.Version)
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.cfg.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+w.cfg.BearerToken)
+	} else if w.cfg.Username != "" {
+		httpReq.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+
+	res, err := w.client.Do(httpReq)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode/100 == 5:
+		return true, fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(body))
+	default:
+		return false, fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+}
+
+// The messages below mirror the ones of prometheus/prompb/remote.proto and
+// types.proto that remote write needs.
+
+type prompbWriteRequest struct {
+	Timeseries []*prompbTimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3"`
+}
+
+func (m *prompbWriteRequest) Reset()         { *m = prompbWriteRequest{} }
+func (m *prompbWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*prompbWriteRequest) ProtoMessage()    {}
+
+type prompbTimeSeries struct {
+	Labels  []*prompbLabel  `protobuf:"bytes,1,rep,name=labels,proto3"`
+	Samples []*prompbSample `protobuf:"bytes,2,rep,name=samples,proto3"`
+}
+
+func (m *prompbTimeSeries) Reset()         { *m = prompbTimeSeries{} }
+func (m *prompbTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*prompbTimeSeries) ProtoMessage()    {}
+
+type prompbLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *prompbLabel) Reset()         { *m = prompbLabel{} }
+func (m *prompbLabel) String() string { return proto.CompactTextString(m) }
+func (*prompbLabel) ProtoMessage()    {}
+
+type prompbSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *prompbSample) Reset()         { *m = prompbSample{} }
+func (m *prompbSample) String() string { return proto.CompactTextString(m) }
+func (*prompbSample) ProtoMessage()    {}
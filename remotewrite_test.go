@@ -0,0 +1,177 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type remoteWriteSample struct {
+	Series    string
+	Value     float64
+	Timestamp int64
+}
+
+type remoteWriteServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	requests int
+	samples  []remoteWriteSample
+}
+
+func newRemoteWriteServer(t *testing.T, failures int) *remoteWriteServer {
+	s := &remoteWriteServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.failures > 0 {
+			s.failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers: %v", r.Header)
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+		}
+		var req prompbWriteRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			t.Error(err)
+		}
+
+		s.requests++
+		for _, ts := range req.Timeseries {
+			var labels []string
+			for _, l := range ts.Labels {
+				labels = append(labels, l.Name+"="+l.Value)
+			}
+			series := strings.Join(labels, ",")
+			// Keep the test focused on a couple of series.
+			if series != "__name__=sbms_up,job=sbms" && series != "__name__=sbms_battery_soc,job=sbms" {
+				continue
+			}
+			for _, smpl := range ts.Samples {
+				s.samples = append(s.samples, remoteWriteSample{Series: series, Value: smpl.Value, Timestamp: smpl.Timestamp})
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func (s *remoteWriteServer) Samples() []remoteWriteSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]remoteWriteSample(nil), s.samples...)
+}
+
+func TestRemoteWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newRemoteWriteServer(t, 1)
+	defer srv.Close()
+
+	cfg := RemoteWriteConfig{
+		URL:           srv.URL,
+		Labels:        map[string]string{"job": "sbms"},
+		QueueDir:      dir,
+		SegmentSize:   1 << 20,
+		MaxSegments:   10,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	}
+	w, err := NewRemoteWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 11, 14, 23, 2, 11, 0, time.UTC)
+	w.now = func() time.Time { return now }
+
+	// A frame, a garbled line and another frame, one second apart, then
+	// the end of the source.
+	exp := NewExporter(prometheus.NewRegistry())
+	clock := now.Add(-4 * time.Second)
+	exp.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	frame := "3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(\n"
+	sub := exp.Subscribe(outputBuffer)
+	if err := exp.Export(context.Background(), strings.NewReader(frame+"garbled\n"+frame)); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp.hub.Close()
+	for st := range sub.C {
+		if err := w.enqueue(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The endpoint is down: nothing is lost, the samples stay queued.
+	w.flush()
+	if len(srv.Samples()) != 0 || w.backoff != time.Second {
+		t.Fatalf("unexpected state during outage: backoff %s, samples %v", w.backoff, srv.Samples())
+	}
+	w.queue.Close()
+
+	// Samples survive a restart and are delivered with their timestamps.
+	w, err = NewRemoteWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub()
+	sub = hub.Subscribe(outputBuffer)
+	hub.Close()
+	w.Run(sub)
+
+	ms := now.UnixNano() / int64(time.Millisecond)
+	want := []remoteWriteSample{
+		{Series: "__name__=sbms_battery_soc,job=sbms", Value: 100, Timestamp: ms - 3000},
+		{Series: "__name__=sbms_up,job=sbms", Value: 1, Timestamp: ms - 3000},
+		{Series: "__name__=sbms_up,job=sbms", Value: 0, Timestamp: ms - 2000},
+		{Series: "__name__=sbms_battery_soc,job=sbms", Value: 100, Timestamp: ms - 1000},
+		{Series: "__name__=sbms_up,job=sbms", Value: 1, Timestamp: ms - 1000},
+		{Series: "__name__=sbms_up,job=sbms", Value: 0, Timestamp: ms},
+	}
+	if diff := cmp.Diff(want, srv.Samples()); diff != "" {
+		t.Errorf("samples mismatch (-want +got):\n%s", diff)
+	}
+	if srv.requests != 2 {
+		t.Errorf("unexpected number of requests: %d", srv.requests)
+	}
+}
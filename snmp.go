@@ -0,0 +1,794 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+// ASN.1 BER tags used by SNMP.
+const (
+	berInteger        = 0x02
+	berOctetString    = 0x04
+	berNull           = 0x05
+	berObjectID       = 0x06
+	berSequence       = 0x30
+	berCounter32      = 0x41
+	berGauge32        = 0x42
+	berTimeTicks      = 0x43
+	berNoSuchObject   = 0x80
+	berNoSuchInstance = 0x81
+	berEndOfMibView   = 0x82
+)
+
+// SNMP PDU types.
+const (
+	snmpGetRequest     = 0xa0
+	snmpGetNextRequest = 0xa1
+	snmpResponse       = 0xa2
+	snmpSetRequest     = 0xa3
+	snmpGetBulkRequest = 0xa5
+	snmpTrapV2         = 0xa7
+	snmpReport         = 0xa8
+)
+
+// SNMP error statuses.
+const (
+	snmpTooBig      = 1
+	snmpNotWritable = 17
+)
+
+// SNMP versions, as found in messages.
+const (
+	snmpVersion2c = 1
+	snmpVersion3  = 3
+)
+
+// snmpMaxMessageSize is the largest message sent, so responses fit in a
+// single Ethernet frame.
+const snmpMaxMessageSize = 1472
+
+// snmpHeadroom is the room left in a message for everything but the PDU.
+const snmpHeadroom = 256
+
+var errBER = errors.New("snmp: malformed message")
+
+var (
+	sysDescrOID    = mustParseOID("1.3.6.1.2.1.1.1.0")
+	sysObjectIDOID = mustParseOID("1.3.6.1.2.1.1.2.0")
+	sysUpTimeOID   = mustParseOID("1.3.6.1.2.1.1.3.0")
+	snmpTrapOID    = mustParseOID("1.3.6.1.6.3.1.1.4.1.0")
+	systemOID      = mustParseOID("1.3.6.1.2.1.1")
+
+	// sbmsMIBOID is the root of SBMS-MIB, see mibs/SBMS-MIB.txt.
+	sbmsMIBOID             = mustParseOID("1.3.6.1.3.9101")
+	sbmsObjectsOID         = sbmsMIBOID.Append(1)
+	sbmsUpOID              = sbmsObjectsOID.Append(1)
+	sbmsStateOfChargeOID   = sbmsObjectsOID.Append(2)
+	sbmsBatteryVoltageOID  = sbmsObjectsOID.Append(3)
+	sbmsBatteryCurrentOID  = sbmsObjectsOID.Append(4)
+	sbmsBatteryChargingOID = sbmsObjectsOID.Append(5)
+	sbmsInternalTempOID    = sbmsObjectsOID.Append(6)
+	sbmsExternalTempOID    = sbmsObjectsOID.Append(7)
+	sbmsStatusOID          = sbmsObjectsOID.Append(8)
+	sbmsStatusFlagsOID     = sbmsObjectsOID.Append(9)
+	sbmsDeviceDateOID      = sbmsObjectsOID.Append(10)
+	sbmsCellVoltageOID     = sbmsObjectsOID.Append(11, 1, 2)
+	sbmsDeviceUpTrapOID    = sbmsMIBOID.Append(0, 1)
+	sbmsDeviceDownTrapOID  = sbmsMIBOID.Append(0, 2)
+	sbmsAlarmChangeTrapOID = sbmsMIBOID.Append(0, 3)
+)
+
+// snmpTruthValue maps booleans to TruthValue, and to the up(1) and down(2)
+// values of sbmsUp.
+var snmpTruthValue = map[bool]int64{true: 1, false: 2}
+
+// SNMPUser is an SNMPv3 user of the user-based security model. Protocols
+// are empty for no authentication or no privacy.
+type SNMPUser struct {
+	Name         string
+	AuthProtocol string
+	AuthPassword string
+	PrivProtocol string
+	PrivPassword string
+}
+
+// SNMPConfig configures an SNMPAgent.
+type SNMPConfig struct {
+	// Community is the SNMPv2c community; v2c is disabled when empty.
+	Community string
+	// User is the SNMPv3 user; v3 is disabled when its name is empty.
+	User SNMPUser
+	// EngineID identifies the agent for SNMPv3. A default is derived from
+	// the host name when empty.
+	EngineID []byte
+	// BootsFile stores the number of times the SNMPv3 engine started. It
+	// is needed by v3.
+	BootsFile string
+
+	// TrapTargets are the host:port addresses traps are sent to.
+	TrapTargets []string
+	// TrapVersion is the version of the traps, "2c" or "3".
+	TrapVersion string
+}
+
+// SNMPAgent is an SNMPv2c and SNMPv3 agent serving SBMS-MIB from the last
+// decoded frame, and sending traps when the device goes up or down and when
+// its alarm flags change.
+type SNMPAgent struct {
+	cfg      SNMPConfig
+	exp      *Exporter
+	user     *usmUser
+	engineID []byte
+	boots    uint32
+	start    time.Time
+	now      func() time.Time
+
+	mu        sync.Mutex
+	pc        net.PacketConn
+	closed    bool
+	requestID int32
+	salt      uint64
+	stats     map[string]uint32
+}
+
+// errSNMPClosed is returned by Serve once the agent is closed.
+var errSNMPClosed = errors.New("snmp: agent closed")
+
+// NewSNMPAgent returns an agent serving the state of exp.
+func NewSNMPAgent(cfg SNMPConfig, exp *Exporter) (*SNMPAgent, error) {
+	a := &SNMPAgent{
+		cfg:      cfg,
+		exp:      exp,
+		engineID: cfg.EngineID,
+		start:    time.Now(),
+		now:      time.Now,
+		stats:    map[string]uint32{},
+	}
+	if len(a.engineID) == 0 {
+		a.engineID = defaultEngineID()
+	}
+	if len(a.engineID) < 5 || len(a.engineID) > 32 {
+		return nil, fmt.Errorf("SNMP engine ID must be 5 to 32 bytes long, got %d", len(a.engineID))
+	}
+
+	if cfg.User.Name != "" {
+		u, err := newUSMUser(cfg.User, a.engineID)
+		if err != nil {
+			return nil, err
+		}
+		a.user = u
+	}
+	switch cfg.TrapVersion {
+	case "2c":
+		if len(cfg.TrapTargets) > 0 && cfg.Community == "" {
+			return nil, errors.New("SNMPv2c traps need a community")
+		}
+	case "3":
+		if len(cfg.TrapTargets) > 0 && a.user == nil {
+			return nil, errors.New("SNMPv3 traps need a user")
+		}
+	default:
+		return nil, fmt.Errorf("unknown SNMP trap version %q", cfg.TrapVersion)
+	}
+
+	if a.user != nil {
+		if cfg.BootsFile == "" {
+			return nil, errors.New("SNMPv3 needs a file to store the engine boots")
+		}
+		boots, err := incrementBoots(cfg.BootsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error storing the SNMP engine boots: %v", err)
+		}
+		a.boots = boots
+	}
+	return a, nil
+}
+
+// defaultEngineID returns an engine ID in the text format of RFC 3411,
+// under the enterprise number of Net-SNMP, made of the host name.
+func defaultEngineID() []byte {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "sbms_exporter"
+	}
+	if len(host) > 27 {
+		host = host[:27]
+	}
+	return append([]byte{0x80, 0x00, 0x1f, 0x88, 0x04}, host...)
+}
+
+// Serve answers the requests received on pc until the agent is closed.
+func (a *SNMPAgent) Serve(pc net.PacketConn) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		pc.Close()
+		return errSNMPClosed
+	}
+	a.pc = pc
+	a.mu.Unlock()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.closed {
+				return errSNMPClosed
+			}
+			return err
+		}
+
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		if res := a.handle(msg); res != nil {
+			if _, err := pc.WriteTo(res, addr); err != nil {
+				log.Debugln("Error sending SNMP response:", err)
+			}
+		}
+	}
+}
+
+// Close stops serving requests.
+func (a *SNMPAgent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	if a.pc != nil {
+		return a.pc.Close()
+	}
+	return nil
+}
+
+// Run sends traps on the transitions of the states received from sub until
+// sub is closed.
+func (a *SNMPAgent) Run(sub *Subscription) {
+	up, status := false, 0
+	for st := range sub.C {
+		switch {
+		case st.Up && !up:
+			a.trap(sbmsDeviceUpTrapOID, st)
+		case !st.Up && up:
+			a.trap(sbmsDeviceDownTrapOID, st)
+		case st.Up && st.Values.Status&StatusAlarms != status&StatusAlarms:
+			a.trap(sbmsAlarmChangeTrapOID, st)
+		}
+		up = st.Up
+		if st.Up {
+			status = st.Values.Status
+		}
+	}
+}
+
+// handle returns the response to a request, or nil when there is none.
+func (a *SNMPAgent) handle(msg []byte) []byte {
+	body, _, err := berExpect(msg, berSequence)
+	if err != nil {
+		return nil
+	}
+	version, body, err := berReadInt(body, berInteger)
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case version == snmpVersion2c && a.cfg.Community != "":
+		return a.handleV2c(body)
+	case version == snmpVersion3 && a.user != nil:
+		return a.handleV3(msg, body)
+	}
+	return nil
+}
+
+func (a *SNMPAgent) handleV2c(body []byte) []byte {
+	community, body, err := berExpect(body, berOctetString)
+	if err != nil {
+		return nil
+	}
+	if subtle.ConstantTimeCompare(community, []byte(a.cfg.Community)) != 1 {
+		a.count("snmpInBadCommunityNames")
+		return nil
+	}
+	req, err := parseSNMPPDU(body)
+	if err != nil {
+		return nil
+	}
+	res := a.respond(req, snmpMaxMessageSize-snmpHeadroom)
+	if res == nil {
+		return nil
+	}
+	return berTLV(berSequence, berInt(berInteger, snmpVersion2c), berTLV(berOctetString, community), res.marshal())
+}
+
+func (a *SNMPAgent) count(name string) uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stats[name]++
+	return a.stats[name]
+}
+
+// respond returns the response to a PDU no larger than maxSize, or nil when
+// there is none.
+func (a *SNMPAgent) respond(req *snmpPDU, maxSize int) *snmpPDU {
+	objects := a.objects(a.exp.State())
+	res := &snmpPDU{Type: snmpResponse, RequestID: req.RequestID}
+
+	switch req.Type {
+	case snmpGetRequest:
+		for _, vb := range req.VarBinds {
+			res.VarBinds = append(res.VarBinds, snmpGet(objects, vb.OID))
+		}
+	case snmpGetNextRequest:
+		for _, vb := range req.VarBinds {
+			res.VarBinds = append(res.VarBinds, snmpGetNext(objects, vb.OID))
+		}
+	case snmpGetBulkRequest:
+		nonRepeaters, maxRepetitions := int(req.ErrorStatus), int(req.ErrorIndex)
+		if nonRepeaters < 0 {
+			nonRepeaters = 0
+		}
+		if nonRepeaters > len(req.VarBinds) {
+			nonRepeaters = len(req.VarBinds)
+		}
+		// Bulk responses are truncated rather than failing, so the encoded
+		// size is kept to stop before a variable binding would not fit.
+		head := len(berInt(berInteger, res.RequestID)) + 2*len(berInt(berInteger, 0))
+		size := 0
+		for _, vb := range req.VarBinds[:nonRepeaters] {
+			vb = snmpGetNext(objects, vb.OID)
+			res.VarBinds = append(res.VarBinds, vb)
+			size += vb.size()
+		}
+		repeaters := req.VarBinds[nonRepeaters:]
+		last := make([]snmpOID, len(repeaters))
+		for i, vb := range repeaters {
+			last[i] = vb.OID
+		}
+	repetitions:
+		for r := 0; r < maxRepetitions && len(repeaters) > 0; r++ {
+			done := true
+			for i := range repeaters {
+				vb := snmpGetNext(objects, last[i])
+				n := vb.size()
+				if berSize(head+berSize(size+n)) > maxSize {
+					break repetitions
+				}
+				res.VarBinds = append(res.VarBinds, vb)
+				size += n
+				last[i] = vb.OID
+				done = done && vb.Value[0] == berEndOfMibView
+			}
+			if done {
+				break
+			}
+		}
+	case snmpSetRequest:
+		res.ErrorStatus, res.ErrorIndex = snmpNotWritable, 1
+		res.VarBinds = req.VarBinds
+	default:
+		return nil
+	}
+
+	if len(res.marshal()) > maxSize {
+		return &snmpPDU{Type: snmpResponse, RequestID: req.RequestID, ErrorStatus: snmpTooBig}
+	}
+	return res
+}
+
+func snmpGet(objects []snmpVarBind, oid snmpOID) snmpVarBind {
+	i := sort.Search(len(objects), func(i int) bool { return objects[i].OID.Compare(oid) >= 0 })
+	if i < len(objects) && objects[i].OID.Compare(oid) == 0 {
+		return objects[i]
+	}
+	if oid.HasPrefix(sbmsMIBOID) || oid.HasPrefix(systemOID) {
+		return snmpVarBind{OID: oid, Value: berTLV(berNoSuchInstance)}
+	}
+	return snmpVarBind{OID: oid, Value: berTLV(berNoSuchObject)}
+}
+
+func snmpGetNext(objects []snmpVarBind, oid snmpOID) snmpVarBind {
+	i := sort.Search(len(objects), func(i int) bool { return objects[i].OID.Compare(oid) > 0 })
+	if i < len(objects) {
+		return objects[i]
+	}
+	return snmpVarBind{OID: oid, Value: berTLV(berEndOfMibView)}
+}
+
+// objects returns the objects served for st, sorted by OID. Only sbmsUp is
+// served from SBMS-MIB while the device is down.
+func (a *SNMPAgent) objects(st State) []snmpVarBind {
+	objects := []snmpVarBind{
+		{sysDescrOID, berTLV(berOctetString, []byte("sbms_exporter "+version.Version+", Electrodacus SBMS"))},
+		{sysObjectIDOID, berTLV(berObjectID, sbmsMIBOID.marshal())},
+		{sysUpTimeOID, berUint(berTimeTicks, a.upTime())},
+		{sbmsUpOID.Append(0), berInt(berInteger, snmpTruthValue[st.Up])},
+	}
+	if st.Up {
+		v := &st.Values
+		objects = append(objects,
+			snmpVarBind{sbmsStateOfChargeOID.Append(0), berUint(berGauge32, uint64(v.StateOfCharge))},
+			snmpVarBind{sbmsBatteryVoltageOID.Append(0), berUint(berGauge32, uint64(milli(v.BatteryVoltage())))},
+			snmpVarBind{sbmsBatteryCurrentOID.Append(0), berInt(berInteger, milli(v.BatteryCurrent))},
+			snmpVarBind{sbmsBatteryChargingOID.Append(0), berInt(berInteger, snmpTruthValue[v.Charging])},
+			snmpVarBind{sbmsInternalTempOID.Append(0), berInt(berInteger, deci(v.InternalTemp))},
+			snmpVarBind{sbmsExternalTempOID.Append(0), berInt(berInteger, deci(v.ExternalTemp))},
+			snmpVarBind{sbmsStatusOID.Append(0), berUint(berGauge32, uint64(v.Status))},
+			snmpVarBind{sbmsStatusFlagsOID.Append(0), berTLV(berOctetString, []byte(strings.Join(v.StatusFlags(), ",")))},
+			snmpVarBind{sbmsDeviceDateOID.Append(0), berUint(berGauge32, uint64(v.Date.Unix()))},
+		)
+		for i, cell := range []float64{v.Cell1Voltage, v.Cell2Voltage, v.Cell3Voltage, v.Cell4Voltage, v.Cell5Voltage, v.Cell6Voltage, v.Cell7Voltage, v.Cell8Voltage} {
+			objects = append(objects, snmpVarBind{sbmsCellVoltageOID.Append(uint32(i + 1)), berUint(berGauge32, uint64(milli(cell)))})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].OID.Compare(objects[j].OID) < 0 })
+	return objects
+}
+
+// upTime returns the time since the agent started, in hundredths of a
+// second.
+func (a *SNMPAgent) upTime() uint64 {
+	return uint64(a.now().Sub(a.start) / (10 * time.Millisecond))
+}
+
+// trap sends the notification oid for st to every target.
+func (a *SNMPAgent) trap(oid snmpOID, st State) {
+	objects := a.objects(st)
+	get := func(oid snmpOID) snmpVarBind {
+		return snmpGet(objects, oid.Append(0))
+	}
+
+	a.mu.Lock()
+	a.requestID++
+	pdu := &snmpPDU{Type: snmpTrapV2, RequestID: int64(a.requestID)}
+	a.mu.Unlock()
+	pdu.VarBinds = []snmpVarBind{
+		{sysUpTimeOID, berUint(berTimeTicks, a.upTime())},
+		{snmpTrapOID, berTLV(berObjectID, oid.marshal())},
+	}
+	switch {
+	case oid.Compare(sbmsDeviceUpTrapOID) == 0:
+		pdu.VarBinds = append(pdu.VarBinds, get(sbmsUpOID), get(sbmsStateOfChargeOID), get(sbmsStatusOID))
+	case oid.Compare(sbmsDeviceDownTrapOID) == 0:
+		pdu.VarBinds = append(pdu.VarBinds, get(sbmsUpOID))
+	default:
+		pdu.VarBinds = append(pdu.VarBinds, get(sbmsStatusOID), get(sbmsStatusFlagsOID))
+	}
+
+	var msg []byte
+	if a.cfg.TrapVersion == "3" {
+		a.mu.Lock()
+		msgID := int64(a.requestID)
+		a.mu.Unlock()
+		msg = a.marshalV3(msgID, a.user.flags(), a.user, a.user.name, a.scopedPDU(pdu))
+	} else {
+		msg = berTLV(berSequence, berInt(berInteger, snmpVersion2c), berTLV(berOctetString, []byte(a.cfg.Community)), pdu.marshal())
+	}
+
+	for _, target := range a.cfg.TrapTargets {
+		if err := sendUDP(target, msg); err != nil {
+			log.Errorf("Error sending SNMP trap to %s: %v", target, err)
+		}
+	}
+}
+
+func sendUDP(addr string, msg []byte) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(msg)
+	return err
+}
+
+// snmpOID is an object identifier.
+type snmpOID []uint32
+
+func parseOID(s string) (snmpOID, error) {
+	var oid snmpOID
+	for _, part := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, uint32(n))
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+func mustParseOID(s string) snmpOID {
+	oid, err := parseOID(s)
+	if err != nil {
+		panic(err)
+	}
+	return oid
+}
+
+func (o snmpOID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Append returns a new OID made of o followed by sub.
+func (o snmpOID) Append(sub ...uint32) snmpOID {
+	oid := make(snmpOID, 0, len(o)+len(sub))
+	return append(append(oid, o...), sub...)
+}
+
+// Compare orders OIDs lexicographically.
+func (o snmpOID) Compare(p snmpOID) int {
+	for i := 0; i < len(o) && i < len(p); i++ {
+		switch {
+		case o[i] < p[i]:
+			return -1
+		case o[i] > p[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(p):
+		return -1
+	case len(o) > len(p):
+		return 1
+	}
+	return 0
+}
+
+// HasPrefix tells whether o is p or is under p.
+func (o snmpOID) HasPrefix(p snmpOID) bool {
+	return len(o) >= len(p) && o[:len(p)].Compare(p) == 0
+}
+
+func (o snmpOID) marshal() []byte {
+	b := []byte{byte(o[0]*40 + o[1])}
+	for _, n := range o[2:] {
+		var tmp [5]byte
+		i := len(tmp) - 1
+		tmp[i] = byte(n & 0x7f)
+		for n >>= 7; n > 0; n >>= 7 {
+			i--
+			tmp[i] = byte(n&0x7f) | 0x80
+		}
+		b = append(b, tmp[i:]...)
+	}
+	return b
+}
+
+func unmarshalOID(b []byte) (snmpOID, error) {
+	if len(b) == 0 {
+		return nil, errBER
+	}
+	oid := snmpOID{uint32(b[0]) / 40, uint32(b[0]) % 40}
+	if b[0] >= 80 {
+		oid = snmpOID{2, uint32(b[0]) - 80}
+	}
+	var n uint32
+	for i, c := range b[1:] {
+		if n > 1<<25 {
+			return nil, errBER
+		}
+		n = n<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			oid = append(oid, n)
+			n = 0
+		} else if i == len(b)-2 {
+			return nil, errBER
+		}
+	}
+	return oid, nil
+}
+
+// snmpVarBind is a variable binding, its value being BER encoded.
+type snmpVarBind struct {
+	OID   snmpOID
+	Value []byte
+}
+
+// size returns the length of the encoded variable binding.
+func (vb snmpVarBind) size() int {
+	return berSize(berSize(len(vb.OID.marshal())) + len(vb.Value))
+}
+
+// snmpPDU is a protocol data unit. ErrorStatus and ErrorIndex hold the
+// non-repeaters and max-repetitions of GetBulk requests.
+type snmpPDU struct {
+	Type        byte
+	RequestID   int64
+	ErrorStatus int64
+	ErrorIndex  int64
+	VarBinds    []snmpVarBind
+}
+
+func parseSNMPPDU(b []byte) (*snmpPDU, error) {
+	tag, body, _, err := berRead(b)
+	if err != nil {
+		return nil, err
+	}
+	p := &snmpPDU{Type: tag}
+	if p.RequestID, body, err = berReadInt(body, berInteger); err != nil {
+		return nil, err
+	}
+	if p.ErrorStatus, body, err = berReadInt(body, berInteger); err != nil {
+		return nil, err
+	}
+	if p.ErrorIndex, body, err = berReadInt(body, berInteger); err != nil {
+		return nil, err
+	}
+	vbs, _, err := berExpect(body, berSequence)
+	if err != nil {
+		return nil, err
+	}
+	for len(vbs) > 0 {
+		var vb []byte
+		if vb, vbs, err = berExpect(vbs, berSequence); err != nil {
+			return nil, err
+		}
+		oidBytes, rest, err := berExpect(vb, berObjectID)
+		if err != nil {
+			return nil, err
+		}
+		oid, err := unmarshalOID(oidBytes)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, _, err := berRead(rest); err != nil {
+			return nil, err
+		}
+		p.VarBinds = append(p.VarBinds, snmpVarBind{OID: oid, Value: rest})
+	}
+	return p, nil
+}
+
+func (p *snmpPDU) marshal() []byte {
+	var vbs [][]byte
+	for _, vb := range p.VarBinds {
+		vbs = append(vbs, berTLV(berSequence, berTLV(berObjectID, vb.OID.marshal()), vb.Value))
+	}
+	return berTLV(p.Type,
+		berInt(berInteger, p.RequestID),
+		berInt(berInteger, p.ErrorStatus),
+		berInt(berInteger, p.ErrorIndex),
+		berTLV(berSequence, vbs...),
+	)
+}
+
+// berRead reads the TLV at the start of b, returning its tag, its content
+// and what follows it. The content shares the memory of b.
+func berRead(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errBER
+	}
+	tag, n := b[0], int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		k := n & 0x7f
+		if k == 0 || k > 3 || len(b) < k {
+			return 0, nil, nil, errBER
+		}
+		n = 0
+		for _, c := range b[:k] {
+			n = n<<8 | int(c)
+		}
+		b = b[k:]
+	}
+	if n > len(b) {
+		return 0, nil, nil, errBER
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// berExpect reads a TLV with the given tag.
+func berExpect(b []byte, tag byte) ([]byte, []byte, error) {
+	t, content, rest, err := berRead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t != tag {
+		return nil, nil, errBER
+	}
+	return content, rest, nil
+}
+
+// berReadInt reads a signed integer with the given tag.
+func berReadInt(b []byte, tag byte) (int64, []byte, error) {
+	content, rest, err := berExpect(b, tag)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(content) == 0 || len(content) > 8 {
+		return 0, nil, errBER
+	}
+	n := int64(int8(content[0]))
+	for _, c := range content[1:] {
+		n = n<<8 | int64(c)
+	}
+	return n, rest, nil
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+	b := []byte{tag}
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	case n < 0x10000:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// berSize returns the length of a TLV with n bytes of content.
+func berSize(n int) int {
+	switch {
+	case n < 0x80:
+		return 2 + n
+	case n < 0x100:
+		return 3 + n
+	case n < 0x10000:
+		return 4 + n
+	default:
+		return 5 + n
+	}
+}
+
+// berInt encodes a signed integer in the fewest bytes.
+func berInt(tag byte, n int64) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; !(n == 0 && b[0] < 0x80) && !(n == -1 && b[0] >= 0x80); n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+// berUint encodes an unsigned integer, such as a Gauge32 or TimeTicks.
+func berUint(tag byte, n uint64) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0] >= 0x80 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
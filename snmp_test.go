@@ -0,0 +1,461 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var snmpTestEngineID = []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 't', 'e', 's', 't'}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// snmpTestFrame is the frame the test agents serve.
+const snmpTestFrame = "3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N("
+
+// newTestSNMPAgent returns an agent of cfg serving snmpTestFrame, and a
+// function sending a line to its exporter and waiting for the state.
+func newTestSNMPAgent(t *testing.T, cfg SNMPConfig) (*SNMPAgent, func(line string)) {
+	t.Helper()
+	exp := NewExporter(prometheus.NewRegistry())
+	sub := exp.Subscribe(outputBuffer)
+	w, r := net.Pipe()
+	go exp.Export(context.Background(), r)
+	publish := func(line string) {
+		t.Helper()
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		<-sub.C
+	}
+	publish(snmpTestFrame)
+
+	if cfg.TrapVersion == "" {
+		cfg.TrapVersion = "2c"
+	}
+	cfg.EngineID = snmpTestEngineID
+	a, err := NewSNMPAgent(cfg, exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2019, 11, 14, 23, 2, 11, 0, time.UTC)
+	a.start = start
+	a.now = func() time.Time { return start.Add(42 * time.Second) }
+	return a, publish
+}
+
+// snmpVarBindStrings returns varbinds as "oid=hex value" strings.
+func snmpVarBindStrings(vbs []snmpVarBind) []string {
+	var s []string
+	for _, vb := range vbs {
+		s = append(s, vb.OID.String()+"="+hex.EncodeToString(vb.Value))
+	}
+	return s
+}
+
+func TestSNMPv2cGet(t *testing.T) {
+	a, _ := newTestSNMPAgent(t, SNMPConfig{Community: "public"})
+
+	// GET sbmsStateOfCharge.0, as encoded by a manager.
+	req := mustDecodeHex(t, "302a 020101 0406 7075626c6963 a01d 020401020304 020100 020100 300f 300d 0609 2b060103c70d010200 0500")
+	want := mustDecodeHex(t, "302b 020101 0406 7075626c6963 a21e 020401020304 020100 020100 3010 300e 0609 2b060103c70d010200 420164")
+	if diff := cmp.Diff(want, a.handle(req)); diff != "" {
+		t.Errorf("response mismatch (-want +got):\n%s", diff)
+	}
+
+	// A wrong community gets no response.
+	req = mustDecodeHex(t, "302a 020101 0406 707269766174 a01d 020401020304 020100 020100 300f 300d 0609 2b060103c70d010200 0500")
+	if res := a.handle(req); res != nil {
+		t.Errorf("unexpected response to a wrong community: %x", res)
+	}
+}
+
+func TestSNMPv2cWalk(t *testing.T) {
+	a, publish := newTestSNMPAgent(t, SNMPConfig{Community: "public"})
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Serve(l)
+	defer a.Close()
+
+	conn, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(pdu *snmpPDU) *snmpPDU {
+		t.Helper()
+		msg := berTLV(berSequence, berInt(berInteger, snmpVersion2c), berTLV(berOctetString, []byte("public")), pdu.marshal())
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _, err := berExpect(buf[:n], berSequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, body, _ = berReadInt(body, berInteger)
+		_, body, _ = berExpect(body, berOctetString)
+		res, err := parseSNMPPDU(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Walk the cell table with GETNEXT.
+	var cells []string
+	oid := sbmsObjectsOID.Append(11)
+	for {
+		res := send(&snmpPDU{Type: snmpGetNextRequest, RequestID: 1, VarBinds: []snmpVarBind{{OID: oid, Value: berTLV(berNull)}}})
+		oid = res.VarBinds[0].OID
+		if res.VarBinds[0].Value[0] == berEndOfMibView || !oid.HasPrefix(sbmsObjectsOID.Append(11)) {
+			break
+		}
+		cells = append(cells, snmpVarBindStrings(res.VarBinds)...)
+	}
+	want := []string{
+		"1.3.6.1.3.9101.1.11.1.2.1=42020d88",
+		"1.3.6.1.3.9101.1.11.1.2.2=42020d89",
+		"1.3.6.1.3.9101.1.11.1.2.3=42020d8a",
+		"1.3.6.1.3.9101.1.11.1.2.4=42020d8a",
+		"1.3.6.1.3.9101.1.11.1.2.5=42020d81",
+		"1.3.6.1.3.9101.1.11.1.2.6=42020d84",
+		"1.3.6.1.3.9101.1.11.1.2.7=42020d8a",
+		"1.3.6.1.3.9101.1.11.1.2.8=42020d89",
+	}
+	if diff := cmp.Diff(want, cells); diff != "" {
+		t.Errorf("cells mismatch (-want +got):\n%s", diff)
+	}
+
+	// GETBULK with sysUpTime as non-repeater, stopping at the end of the MIB.
+	res := send(&snmpPDU{Type: snmpGetBulkRequest, RequestID: 2, ErrorStatus: 1, ErrorIndex: 3, VarBinds: []snmpVarBind{
+		{OID: mustParseOID("1.3.6.1.2.1.1.2.0"), Value: berTLV(berNull)},
+		{OID: sbmsObjectsOID.Append(11, 1, 2, 7), Value: berTLV(berNull)},
+	}})
+	want = []string{
+		"1.3.6.1.2.1.1.3.0=43021068",
+		"1.3.6.1.3.9101.1.11.1.2.8=42020d89",
+		"1.3.6.1.3.9101.1.11.1.2.8=8200",
+	}
+	if diff := cmp.Diff(want, snmpVarBindStrings(res.VarBinds)); diff != "" {
+		t.Errorf("bulk mismatch (-want +got):\n%s", diff)
+	}
+
+	// Everything is read-only.
+	res = send(&snmpPDU{Type: snmpSetRequest, RequestID: 3, VarBinds: []snmpVarBind{{OID: sbmsUpOID.Append(0), Value: berInt(berInteger, 2)}}})
+	if res.ErrorStatus != snmpNotWritable || res.ErrorIndex != 1 {
+		t.Errorf("unexpected set response: status %d, index %d", res.ErrorStatus, res.ErrorIndex)
+	}
+
+	// Only sbmsUp is left while the device is down.
+	publish("garbled")
+	res = send(&snmpPDU{Type: snmpGetRequest, RequestID: 4, VarBinds: []snmpVarBind{
+		{OID: sbmsUpOID.Append(0), Value: berTLV(berNull)},
+		{OID: sbmsStateOfChargeOID.Append(0), Value: berTLV(berNull)},
+		{OID: mustParseOID("1.3.6.1.4.1.1.0"), Value: berTLV(berNull)},
+	}})
+	want = []string{
+		"1.3.6.1.3.9101.1.1.0=020102",
+		"1.3.6.1.3.9101.1.2.0=8100",
+		"1.3.6.1.4.1.1.0=8000",
+	}
+	if diff := cmp.Diff(want, snmpVarBindStrings(res.VarBinds)); diff != "" {
+		t.Errorf("down mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSNMPGetBulkTruncation(t *testing.T) {
+	a, _ := newTestSNMPAgent(t, SNMPConfig{Community: "public"})
+	req := &snmpPDU{Type: snmpGetBulkRequest, RequestID: 1, ErrorStatus: 1, ErrorIndex: 1000, VarBinds: []snmpVarBind{
+		{OID: sysUpTimeOID, Value: berTLV(berNull)},
+		{OID: systemOID, Value: berTLV(berNull)},
+	}}
+	all := a.respond(req, 65535).VarBinds
+
+	// Responses hold as many variable bindings as fit.
+	for _, maxSize := range []int{60, 100, 200, 300} {
+		res := a.respond(req, maxSize)
+		if n := len(res.marshal()); n > maxSize {
+			t.Errorf("%d bytes response to a maximum of %d", n, maxSize)
+		}
+		n := len(res.VarBinds)
+		if n >= len(all) {
+			t.Fatalf("response to a maximum of %d is not truncated", maxSize)
+		}
+		if diff := cmp.Diff(snmpVarBindStrings(all[:n]), snmpVarBindStrings(res.VarBinds)); diff != "" {
+			t.Errorf("response to a maximum of %d mismatch (-want +got):\n%s", maxSize, diff)
+		}
+		more := &snmpPDU{Type: snmpResponse, RequestID: 1, VarBinds: all[:n+1]}
+		if len(more.marshal()) <= maxSize {
+			t.Errorf("response to a maximum of %d truncated to %d variable bindings, %d fit", maxSize, n, n+1)
+		}
+	}
+}
+
+func TestUSMKeys(t *testing.T) {
+	// Test vectors of RFC 3414, appendix A.3.
+	engineID := mustDecodeHex(t, "000000000000000000000002")
+	testCases := []struct {
+		name     string
+		key      []byte
+		want     string
+		wantKeyL string
+	}{
+		{"MD5", usmPasswordToKey(md5.New, "maplesyrup"), "9faf3283884e92834ebc9847d8edd963", "526f5eed9fcce26f8964c2930787d82b"},
+		{"SHA", usmPasswordToKey(sha1.New, "maplesyrup"), "9fb5cc0381497b3793528939ff788d5d79145211", "6695febc9288e36282235fc7151f128497b38f3f"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tC.key); got != tC.want {
+				t.Errorf("unexpected key: got %s, want %s", got, tC.want)
+			}
+			h := md5.New
+			if tC.name == "SHA" {
+				h = sha1.New
+			}
+			if got := hex.EncodeToString(usmLocalizeKey(h, tC.key, engineID)); got != tC.wantKeyL {
+				t.Errorf("unexpected localized key: got %s, want %s", got, tC.wantKeyL)
+			}
+		})
+	}
+}
+
+func TestSNMPv3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, priv := range []string{"", "DES", "AES"} {
+		t.Run("priv="+priv, func(t *testing.T) {
+			user := SNMPUser{Name: "nms", AuthProtocol: "SHA", AuthPassword: "authpass", PrivProtocol: priv, PrivPassword: "privpass"}
+			a, _ := newTestSNMPAgent(t, SNMPConfig{User: user, BootsFile: filepath.Join(dir, priv+"boots")})
+
+			// The manager side, sharing the engine ID once discovered.
+			u, err := newUSMUser(user, snmpTestEngineID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mgr := &SNMPAgent{engineID: snmpTestEngineID, boots: a.boots, start: a.start, now: a.now}
+			get := &snmpPDU{Type: snmpGetRequest, RequestID: 7, VarBinds: []snmpVarBind{{OID: sbmsBatteryVoltageOID.Append(0), Value: berTLV(berNull)}}}
+
+			parse := func(msg []byte) (*usmMessage, *snmpPDU) {
+				t.Helper()
+				body, _, err := berExpect(msg, berSequence)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, body, _ = berReadInt(body, berInteger)
+				m, err := parseUSMMessage(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data := m.data
+				if m.flags&usmFlagPriv != 0 {
+					encrypted, _, _ := berExpect(data, berOctetString)
+					if data, err = u.decrypt(encrypted, m.privParams, uint32(m.boots), uint32(m.time)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				pdu, err := parseScopedPDU(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return m, pdu
+			}
+
+			// Discovery.
+			disco := &SNMPAgent{engineID: []byte{}, start: a.start, now: a.now}
+			msg := disco.marshalV3(1, usmFlagReportable, nil, "", disco.scopedPDU(&snmpPDU{Type: snmpGetRequest, RequestID: 6}))
+			m, pdu := parse(a.handle(msg))
+			if m.msgID != 1 || string(m.engineID) != string(snmpTestEngineID) || m.boots != 1 || m.time != 42 {
+				t.Errorf("unexpected discovery response: %+v", m)
+			}
+			if pdu.Type != snmpReport || pdu.VarBinds[0].OID.Compare(usmStatsUnknownEngineIDs) != 0 {
+				t.Errorf("unexpected discovery report: %x %v", pdu.Type, pdu.VarBinds)
+			}
+
+			// Authenticated request.
+			msg = mgr.marshalV3(2, u.flags()|usmFlagReportable, u, "nms", mgr.scopedPDU(get))
+			res := a.handle(msg)
+			m, pdu = parse(res)
+			if m.flags != u.flags() || pdu.Type != snmpResponse || pdu.RequestID != 7 {
+				t.Fatalf("unexpected response: flags %x, PDU %+v", m.flags, pdu)
+			}
+			if diff := cmp.Diff([]string{"1.3.6.1.3.9101.1.3.0=42026c3d"}, snmpVarBindStrings(pdu.VarBinds)); diff != "" {
+				t.Errorf("response mismatch (-want +got):\n%s", diff)
+			}
+
+			// The response is signed with the key of the user.
+			body, _, _ := berExpect(res, berSequence)
+			_, body, _ = berReadInt(body, berInteger)
+			m, _ = parseUSMMessage(body)
+			digest := append([]byte(nil), m.authParams...)
+			for i := range m.authParams {
+				m.authParams[i] = 0
+			}
+			if diff := cmp.Diff(u.digest(res), digest); diff != "" {
+				t.Errorf("digest mismatch (-want +got):\n%s", diff)
+			}
+
+			// Wrong password.
+			bad, _ := newUSMUser(SNMPUser{Name: "nms", AuthProtocol: "SHA", AuthPassword: "wrongpass", PrivProtocol: priv, PrivPassword: "privpass"}, snmpTestEngineID)
+			msg = mgr.marshalV3(3, bad.flags()|usmFlagReportable, bad, "nms", mgr.scopedPDU(get))
+			_, pdu = parse(a.handle(msg))
+			if pdu.Type != snmpReport || pdu.VarBinds[0].OID.Compare(usmStatsWrongDigests) != 0 {
+				t.Errorf("unexpected wrong digest report: %x %v", pdu.Type, pdu.VarBinds)
+			}
+
+			// Unknown user.
+			msg = mgr.marshalV3(4, u.flags()|usmFlagReportable, u, "root", mgr.scopedPDU(get))
+			_, pdu = parse(a.handle(msg))
+			if pdu.Type != snmpReport || pdu.VarBinds[0].OID.Compare(usmStatsUnknownUserNames) != 0 {
+				t.Errorf("unexpected unknown user report: %x %v", pdu.Type, pdu.VarBinds)
+			}
+		})
+	}
+}
+
+func TestSNMPEngineBoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := SNMPConfig{
+		User:        SNMPUser{Name: "nms"},
+		EngineID:    snmpTestEngineID,
+		BootsFile:   filepath.Join(dir, "data", "boots"),
+		TrapVersion: "2c",
+	}
+	exp := NewExporter(prometheus.NewRegistry())
+
+	// Boots are incremented on every start.
+	for want := uint32(1); want <= 3; want++ {
+		a, err := NewSNMPAgent(cfg, exp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if boots, _ := a.engineTime(); boots != want {
+			t.Errorf("got boots %d, want %d", boots, want)
+		}
+	}
+
+	// Agents do not start without storing them.
+	for _, tC := range []struct {
+		desc      string
+		bootsFile string
+		err       string
+	}{
+		{"no file", "", "needs a file to store the engine boots"},
+		{"not stored", filepath.Join(cfg.BootsFile, "boots"), "error storing the SNMP engine boots"},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			cfg := cfg
+			cfg.BootsFile = tC.bootsFile
+			if _, err := NewSNMPAgent(cfg, exp); err == nil || !strings.Contains(err.Error(), tC.err) {
+				t.Errorf("got error %v, want %q", err, tC.err)
+			}
+		})
+	}
+}
+
+func TestSNMPTraps(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	a, _ := newTestSNMPAgent(t, SNMPConfig{Community: "public", TrapTargets: []string{l.LocalAddr().String()}})
+	var v Values
+	if err := v.ReadFrom([]byte(snmpTestFrame)); err != nil {
+		t.Fatal(err)
+	}
+	alarm := v
+	alarm.Status |= StatusUnderVoltage
+	fets := alarm
+	fets.Status &^= StatusChargeFET
+
+	hub := NewHub()
+	sub := hub.Subscribe(outputBuffer)
+	for _, st := range []State{{Up: true, Values: v}, {Up: true, Values: alarm}, {Up: true, Values: fets}, {Up: false}} {
+		hub.Publish(st)
+	}
+	hub.Close()
+	a.Run(sub)
+
+	var traps []string
+	buf := make([]byte, 65535)
+	for i := 0; i < 3; i++ {
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _, _ := berExpect(buf[:n], berSequence)
+		_, body, _ = berReadInt(body, berInteger)
+		_, body, _ = berExpect(body, berOctetString)
+		pdu, err := parseSNMPPDU(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pdu.Type != snmpTrapV2 {
+			t.Errorf("unexpected PDU type %x", pdu.Type)
+		}
+		traps = append(traps, strings.Join(snmpVarBindStrings(pdu.VarBinds[1:]), " "))
+	}
+
+	want := []string{
+		// sbmsDeviceUp with sbmsUp, sbmsStateOfCharge and sbmsStatus.
+		"1.3.6.1.6.3.1.1.4.1.0=06082b060103c70d0001 1.3.6.1.3.9101.1.1.0=020101 1.3.6.1.3.9101.1.2.0=420164 1.3.6.1.3.9101.1.8.0=42025000",
+		// sbmsAlarmChange with UV set, the FET change being ignored.
+		"1.3.6.1.6.3.1.1.4.1.0=06082b060103c70d0003 1.3.6.1.3.9101.1.8.0=42025004 1.3.6.1.3.9101.1.9.0=040c55562c434645542c44464554",
+		// sbmsDeviceDown.
+		"1.3.6.1.6.3.1.1.4.1.0=06082b060103c70d0002 1.3.6.1.3.9101.1.1.0=020102",
+	}
+	if diff := cmp.Diff(want, traps); diff != "" {
+		t.Errorf("traps mismatch (-want +got):\n%s", diff)
+	}
+}
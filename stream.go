@@ -0,0 +1,150 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	// streamBuffer is the number of states a stream client can lag behind
+	// before it starts missing some.
+	streamBuffer = 16
+	// streamKeepAlive is the interval at which idle streams are pinged.
+	streamKeepAlive = 15 * time.Second
+	// streamWriteTimeout bounds the time spent writing to a stream client.
+	streamWriteTimeout = 10 * time.Second
+)
+
+type streamHandler struct {
+	exp      *Exporter
+	upgrader websocket.Upgrader
+}
+
+// newStreamHandler returns a handler pushing every state of exp as it
+// happens, as a WebSocket when asked to upgrade and as Server-Sent Events
+// otherwise.
+func newStreamHandler(exp *Exporter) http.Handler {
+	return &streamHandler{exp: exp}
+}
+
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, apiValues{Error: "method not allowed"})
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r)
+		return
+	}
+	h.serveEvents(w, r)
+}
+
+func (h *streamHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, apiValues{Error: "streaming unsupported"})
+		return
+	}
+
+	sub := h.exp.Subscribe(streamBuffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(newAPIValues(st))
+			if err != nil {
+				log.Errorln("Error encoding stream event:", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *streamHandler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	sub := h.exp.Subscribe(streamBuffer)
+	defer sub.Close()
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied to the client.
+		log.Debugln("Error upgrading stream to a WebSocket:", err)
+		return
+	}
+	defer conn.Close()
+
+	// Clients are not expected to send anything, but reading is needed to
+	// process control frames and notice when they go away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(streamWriteTimeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteJSON(newAPIValues(st)); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStreamEvents(t *testing.T) {
+	exp := NewExporter(prometheus.NewRegistry())
+	srv := httptest.NewServer(NewAPIHandler(exp))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/api/v1/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if got, want := res.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("unexpected content type: got %q, want %q", got, want)
+	}
+
+	events := bufio.NewReader(res.Body)
+	next := func() apiValues {
+		t.Helper()
+		var v apiValues
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &v); err != nil {
+					t.Fatal(err)
+				}
+				return v
+			}
+		}
+	}
+
+	ensureStreamed(t, exp, next)
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	exp := NewExporter(prometheus.NewRegistry())
+	srv := httptest.NewServer(NewAPIHandler(exp))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	next := func() apiValues {
+		t.Helper()
+		var v apiValues
+		if err := conn.ReadJSON(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	ensureStreamed(t, exp, next)
+
+	exp.hub.Close()
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func ensureStreamed(t *testing.T, exp *Exporter, next func() apiValues) {
+	t.Helper()
+
+	wg := sync.WaitGroup{}
+	w, r := net.Pipe()
+
+	wg.Add(1)
+	go func() {
+		err := exp.Export(context.Background(), r)
+		if err != io.EOF {
+			t.Errorf("unexpected error: %q", err)
+		}
+		wg.Done()
+	}()
+
+	receiveData(t, w, `testdata/example1.sbms`)
+	receiveData(t, w, `testdata/too-short.sbms`)
+	receiveData(t, w, `testdata/example2.sbms`)
+	w.Close()
+	wg.Wait()
+
+	for i, want := range []struct {
+		up  bool
+		soc int
+	}{
+		{up: true, soc: 100},
+		{up: false},
+		{up: true, soc: 99},
+		{up: false},
+	} {
+		got := next()
+		if got.Up != want.up {
+			t.Errorf("event %d: unexpected up: got %v, want %v", i, got.Up, want.up)
+		}
+		if soc := got.Values["state_of_charge"].Value; want.up && soc != float64(want.soc) {
+			t.Errorf("event %d: unexpected state of charge: got %v, want %v", i, soc, want.soc)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd, see
+// sd_listen_fds(3).
+const sdListenFDsStart = 3
+
+// SystemdNotifier sends notifications to systemd, see sd_notify(3). It does
+// nothing when the exporter is not run by a Type=notify service.
+type SystemdNotifier struct {
+	socket string
+	// watchdog is WatchdogSec of the service, 0 when disabled.
+	watchdog time.Duration
+}
+
+// NewSystemdNotifier returns a notifier of the socket and watchdog systemd
+// passed in the environment, removing them from it so that hooks do not
+// inherit them.
+func NewSystemdNotifier() *SystemdNotifier {
+	n := &SystemdNotifier{socket: os.Getenv("NOTIFY_SOCKET")}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if err == nil && usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	return n
+}
+
+// Notify sends state, e.g. READY=1, to systemd.
+func (n *SystemdNotifier) Notify(state string) error {
+	if n.socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Run pings the watchdog every half of its timeout until sub is closed, as
+// long as valid frames keep being decoded. A source which stopped sending
+// them lets the watchdog expire and systemd restart the exporter.
+func (n *SystemdNotifier) Run(sub *Subscription) {
+	ticker := time.NewTicker(n.watchdog / 2)
+	defer ticker.Stop()
+	alive, missed := false, false
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			alive = st.Up
+		case <-ticker.C:
+			if !alive {
+				if !missed {
+					log.Warnf("No valid frame decoded in %v, not pinging the systemd watchdog", n.watchdog/2)
+				}
+				missed = true
+				continue
+			}
+			if err := n.Notify("WATCHDOG=1"); err != nil {
+				log.Errorln("Error pinging the systemd watchdog:", err)
+			}
+			alive, missed = false, false
+		}
+	}
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// see sd_listen_fds(3), removing them from the environment.
+func systemdListeners() ([]net.Listener, error) {
+	return listenFDs(sdListenFDsStart)
+}
+
+func listenFDs(first int) ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) || fds == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var listeners []net.Listener
+	for fd := first; fd < first+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %d: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
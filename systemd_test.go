@@ -0,0 +1,178 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket listens on a unixgram socket standing in for the one of
+// systemd, returning its path.
+func listenNotifySocket(t *testing.T) (*net.UnixConn, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return conn, path, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// readNotification returns the next notification received on conn, or ""
+// if none is within timeout.
+func readNotification(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	b := make([]byte, 256)
+	n, err := conn.Read(b)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b[:n])
+}
+
+func TestSystemdNotifier(t *testing.T) {
+	conn, path, cleanup := listenNotifySocket(t)
+	defer cleanup()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	os.Setenv("WATCHDOG_USEC", "100000")
+	n := NewSystemdNotifier()
+	if os.Getenv("NOTIFY_SOCKET") != "" || os.Getenv("WATCHDOG_USEC") != "" {
+		t.Error("the environment still holds the systemd variables")
+	}
+	if n.watchdog != 100*time.Millisecond {
+		t.Errorf("got watchdog %v, want 100ms", n.watchdog)
+	}
+
+	if err := n.Notify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readNotification(t, conn, time.Second); got != "READY=1" {
+		t.Errorf("got notification %q, want READY=1", got)
+	}
+
+	hub := NewHub()
+	sub := hub.Subscribe(outputBuffer)
+	done := make(chan struct{})
+	go func() {
+		n.Run(sub)
+		close(done)
+	}()
+
+	// Pinged while valid frames are decoded, not once they stop.
+	hub.Publish(State{Up: true})
+	if got := readNotification(t, conn, time.Second); got != "WATCHDOG=1" {
+		t.Errorf("got notification %q, want WATCHDOG=1", got)
+	}
+	if got := readNotification(t, conn, 200*time.Millisecond); got != "" {
+		t.Errorf("got notification %q without any frame", got)
+	}
+	hub.Publish(State{Up: false})
+	if got := readNotification(t, conn, 200*time.Millisecond); got != "" {
+		t.Errorf("got notification %q after an invalid frame", got)
+	}
+	hub.Publish(State{Up: true})
+	if got := readNotification(t, conn, time.Second); got != "WATCHDOG=1" {
+		t.Errorf("got notification %q after a valid frame, want WATCHDOG=1", got)
+	}
+	hub.Publish(State{Err: io.EOF})
+	if got := readNotification(t, conn, 200*time.Millisecond); got != "" {
+		t.Errorf("got notification %q once the source closed", got)
+	}
+
+	hub.Close()
+	<-done
+}
+
+func TestSystemdNotifierDisabled(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Setenv("WATCHDOG_USEC", "100000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	n := NewSystemdNotifier()
+	if n.watchdog != 0 {
+		t.Errorf("got watchdog %v for another process, want it disabled", n.watchdog)
+	}
+	if err := n.Notify("READY=1"); err != nil {
+		t.Errorf("got error %v without a notify socket", err)
+	}
+}
+
+func TestListenFDs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The file descriptor passed, closed by listenFDs.
+	fd := -1
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	if err == nil {
+		err = rc.Control(func(s uintptr) { fd, err = syscall.Dup(int(s)) })
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := listenFDs(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || listeners[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("got listeners %v, want one on %v", listeners, l.Addr())
+	}
+	defer listeners[0].Close()
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+		t.Error("the environment still holds the socket activation variables")
+	}
+
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Sockets passed to another process are ignored.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if listeners, err := listenFDs(sdListenFDsStart); err != nil || len(listeners) != 0 {
+		t.Errorf("got listeners %v and error %v for another process", listeners, err)
+	}
+}
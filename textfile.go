@@ -0,0 +1,165 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// TextfileConfig configures a TextfileWriter.
+type TextfileConfig struct {
+	// Path is the file written, which must end in .prom to be picked up by
+	// the textfile collector of node_exporter.
+	Path string
+	// Interval is the interval at which the file is rewritten, on top of
+	// the writes on every up/down transition. The file is rewritten on
+	// every frame when zero.
+	Interval time.Duration
+}
+
+// TextfileWriter writes the metrics of the exporter to a file for the
+// textfile collector of node_exporter.
+type TextfileWriter struct {
+	cfg TextfileConfig
+	reg *prometheus.Registry
+	exp *Exporter
+}
+
+// NewTextfileWriter returns a writer of the file described by cfg.
+func NewTextfileWriter(cfg TextfileConfig) *TextfileWriter {
+	reg := prometheus.NewRegistry()
+	return &TextfileWriter{cfg: cfg, reg: reg, exp: NewExporter(reg)}
+}
+
+// Run writes the file on every frame, or at every interval and whenever the
+// device goes up or down, until sub is closed.
+func (w *TextfileWriter) Run(sub *Subscription) {
+	var tick <-chan time.Time
+	if w.cfg.Interval > 0 {
+		ticker := time.NewTicker(w.cfg.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	received, up := false, false
+	for {
+		select {
+		case st, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			w.exp.mirror(st)
+			if w.cfg.Interval <= 0 || !received || st.Up != up {
+				w.write()
+			}
+			received, up = true, st.Up
+		case <-tick:
+			if received {
+				w.write()
+			}
+		}
+	}
+}
+
+// write replaces the file. Failures are only logged since the next write
+// carries fresher values anyway.
+func (w *TextfileWriter) write() {
+	if err := writeMetricsFile(w.cfg.Path, w.reg); err != nil {
+		log.Errorln("Error writing textfile:", err)
+	}
+}
+
+// writeMetricsFile atomically replaces path with the metrics of g, writing
+// them to a temporary file of the same directory first so readers never see
+// a partial file.
+func writeMetricsFile(path string, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	// The temporary file does not end in .prom, so node_exporter ignores it.
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	enc := expfmt.NewEncoder(f, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err = enc.Encode(mf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		// Temporary files are only readable by their owner, while
+		// node_exporter usually runs as another user.
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// errNoFrame is returned by runOneshot when the input ends, or the timeout
+// expires, before a frame could be decoded.
+var errNoFrame = errors.New("no valid frame received")
+
+// runOneshot reads r until the first frame that can be decoded and writes its
+// metrics to w, failing when none comes within timeout.
+func runOneshot(r io.Reader, w io.Writer, timeout time.Duration) error {
+	frames := make(chan *Values, 1)
+	errs := make(chan error, 1)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			v := new(Values)
+			if err := v.ReadFrom(bytes.TrimSpace(s.Bytes())); err == nil {
+				frames <- v
+				return
+			}
+		}
+		if err := s.Err(); err != nil {
+			errs <- err
+			return
+		}
+		errs <- errNoFrame
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case v := <-frames:
+		return writeValuesMetrics(w, v)
+	case err := <-errs:
+		return err
+	case <-timer.C:
+		return errNoFrame
+	}
+}
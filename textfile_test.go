@@ -0,0 +1,112 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTextfileWriter(t *testing.T) {
+	frame, err := ioutil.ReadFile(`testdata/example1.sbms`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := new(Values)
+	if err := v.ReadFrom(bytes.TrimSpace(frame)); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		states []State
+		golden string
+	}{
+		{"up", []State{{Up: true, Values: *v}}, `testdata/example1.decoded.metrics`},
+		{"down", []State{{Up: true, Values: *v}, {Up: false, Values: *v}}, `testdata/down.metrics`},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "textfile")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "sbms.prom")
+
+			hub := NewHub()
+			sub := hub.Subscribe(outputBuffer)
+			for _, st := range tC.states {
+				hub.Publish(st)
+			}
+			hub.Close()
+			NewTextfileWriter(TextfileConfig{Path: path, Interval: time.Hour}).Run(sub)
+
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := ioutil.ReadFile(tC.golden)
+			if diff := cmp.Diff(string(want), string(got)); diff != "" {
+				t.Errorf("file does not match golden file %s (-want +got):\n%s", tC.golden, diff)
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0644 {
+				t.Errorf("unexpected file mode %v", fi.Mode())
+			}
+			if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+				t.Errorf("temporary files left behind: %d files", len(files))
+			}
+		})
+	}
+}
+
+func TestOneshot(t *testing.T) {
+	frame, err := ioutil.ReadFile(`testdata/example1.sbms`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	in := io.MultiReader(strings.NewReader("garbage\n"), bytes.NewReader(frame), strings.NewReader("garbage\n"))
+	if err := runOneshot(in, out, time.Second); err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+	want, _ := ioutil.ReadFile(`testdata/example1.decoded.metrics`)
+	if diff := cmp.Diff(string(want), out.String()); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := runOneshot(strings.NewReader("garbage\n"), ioutil.Discard, time.Second); err != errNoFrame {
+		t.Errorf("unexpected error at the end of the input: %v", err)
+	}
+
+	r, w := io.Pipe()
+	defer w.Close()
+	if err := runOneshot(r, ioutil.Discard, 10*time.Millisecond); err != errNoFrame {
+		t.Errorf("unexpected error after the timeout: %v", err)
+	}
+}
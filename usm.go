@@ -0,0 +1,473 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SNMPv3 message flags.
+const (
+	usmFlagAuth       = 0x01
+	usmFlagPriv       = 0x02
+	usmFlagReportable = 0x04
+)
+
+// usmSecurityModel is the identifier of the user-based security model.
+const usmSecurityModel = 3
+
+// usmTimeWindow is how far the time of an authenticated message may be from
+// the engine time.
+const usmTimeWindow = 150
+
+// usmAuthParamsSize is the size of the truncated HMAC of authenticated
+// messages.
+const usmAuthParamsSize = 12
+
+// The usmStats counters reported to managers, from SNMP-USER-BASED-SM-MIB.
+var (
+	usmStatsUnsupportedSecLevels = mustParseOID("1.3.6.1.6.3.15.1.1.1.0")
+	usmStatsNotInTimeWindows     = mustParseOID("1.3.6.1.6.3.15.1.1.2.0")
+	usmStatsUnknownUserNames     = mustParseOID("1.3.6.1.6.3.15.1.1.3.0")
+	usmStatsUnknownEngineIDs     = mustParseOID("1.3.6.1.6.3.15.1.1.4.0")
+	usmStatsWrongDigests         = mustParseOID("1.3.6.1.6.3.15.1.1.5.0")
+	usmStatsDecryptionErrors     = mustParseOID("1.3.6.1.6.3.15.1.1.6.0")
+)
+
+// usmUser is an SNMPv3 user with its keys localized to the engine.
+type usmUser struct {
+	name    string
+	hash    func() hash.Hash
+	authKey []byte
+	priv    string
+	privKey []byte
+}
+
+func newUSMUser(u SNMPUser, engineID []byte) (*usmUser, error) {
+	user := &usmUser{name: u.Name}
+
+	switch u.AuthProtocol {
+	case "":
+	case "MD5":
+		user.hash = md5.New
+	case "SHA":
+		user.hash = sha1.New
+	default:
+		return nil, fmt.Errorf("unknown SNMP authentication protocol %q", u.AuthProtocol)
+	}
+	switch u.PrivProtocol {
+	case "":
+	case "DES", "AES":
+		if user.hash == nil {
+			return nil, fmt.Errorf("SNMP privacy protocol %s needs an authentication protocol", u.PrivProtocol)
+		}
+		user.priv = u.PrivProtocol
+	default:
+		return nil, fmt.Errorf("unknown SNMP privacy protocol %q", u.PrivProtocol)
+	}
+
+	if user.hash != nil {
+		if len(u.AuthPassword) < 8 {
+			return nil, fmt.Errorf("SNMP authentication password must be at least 8 characters")
+		}
+		user.authKey = usmLocalizeKey(user.hash, usmPasswordToKey(user.hash, u.AuthPassword), engineID)
+	}
+	if user.priv != "" {
+		if len(u.PrivPassword) < 8 {
+			return nil, fmt.Errorf("SNMP privacy password must be at least 8 characters")
+		}
+		user.privKey = usmLocalizeKey(user.hash, usmPasswordToKey(user.hash, u.PrivPassword), engineID)
+	}
+	return user, nil
+}
+
+// flags returns the security level of the user as message flags.
+func (u *usmUser) flags() byte {
+	var flags byte
+	if u.hash != nil {
+		flags |= usmFlagAuth
+	}
+	if u.priv != "" {
+		flags |= usmFlagPriv
+	}
+	return flags
+}
+
+// usmPasswordToKey implements the password to key algorithm of RFC 3414:
+// the password repeated over a megabyte, hashed.
+func usmPasswordToKey(h func() hash.Hash, password string) []byte {
+	d := h()
+	buf := make([]byte, 64)
+	for i := 0; i < 1<<20; i += len(buf) {
+		for j := range buf {
+			buf[j] = password[(i+j)%len(password)]
+		}
+		d.Write(buf)
+	}
+	return d.Sum(nil)
+}
+
+// usmLocalizeKey derives the key specific to an engine from a user key.
+func usmLocalizeKey(h func() hash.Hash, key, engineID []byte) []byte {
+	d := h()
+	d.Write(key)
+	d.Write(engineID)
+	d.Write(key)
+	return d.Sum(nil)
+}
+
+// digest returns the truncated HMAC of msg, whose authentication parameters
+// must be zeroed.
+func (u *usmUser) digest(msg []byte) []byte {
+	mac := hmac.New(u.hash, u.authKey)
+	mac.Write(msg)
+	return mac.Sum(nil)[:usmAuthParamsSize]
+}
+
+// encrypt encrypts a scoped PDU, returning it along with the privacy
+// parameters to send.
+func (u *usmUser) encrypt(plain []byte, boots, engineTime uint32, salt uint64) ([]byte, []byte) {
+	params := make([]byte, 8)
+	switch u.priv {
+	case "DES":
+		binary.BigEndian.PutUint32(params, boots)
+		binary.BigEndian.PutUint32(params[4:], uint32(salt))
+		block, _ := des.NewCipher(u.privKey[:8])
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = u.privKey[8+i] ^ params[i]
+		}
+		padded := make([]byte, (len(plain)+7)/8*8)
+		copy(padded, plain)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+		return padded, params
+	default:
+		binary.BigEndian.PutUint64(params, salt)
+		block, _ := aes.NewCipher(u.privKey[:16])
+		out := make([]byte, len(plain))
+		cipher.NewCFBEncrypter(block, usmAESIV(boots, engineTime, params)).XORKeyStream(out, plain)
+		return out, params
+	}
+}
+
+// decrypt decrypts a scoped PDU encrypted with the given privacy parameters.
+func (u *usmUser) decrypt(data, params []byte, boots, engineTime uint32) ([]byte, error) {
+	if len(params) != 8 {
+		return nil, fmt.Errorf("invalid privacy parameters")
+	}
+	switch u.priv {
+	case "DES":
+		if len(data)%8 != 0 {
+			return nil, fmt.Errorf("invalid DES ciphertext length %d", len(data))
+		}
+		block, _ := des.NewCipher(u.privKey[:8])
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = u.privKey[8+i] ^ params[i]
+		}
+		out := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+		return out, nil
+	default:
+		block, _ := aes.NewCipher(u.privKey[:16])
+		out := make([]byte, len(data))
+		cipher.NewCFBDecrypter(block, usmAESIV(boots, engineTime, params)).XORKeyStream(out, data)
+		return out, nil
+	}
+}
+
+func usmAESIV(boots, engineTime uint32, params []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv, boots)
+	binary.BigEndian.PutUint32(iv[4:], engineTime)
+	copy(iv[8:], params)
+	return iv
+}
+
+// usmMessage is an SNMPv3 message, its byte slices sharing the memory of
+// the raw message.
+type usmMessage struct {
+	msgID      int64
+	maxSize    int64
+	flags      byte
+	engineID   []byte
+	boots      int64
+	time       int64
+	userName   []byte
+	authParams []byte
+	privParams []byte
+	data       []byte
+}
+
+// parseUSMMessage parses the part of a message following its version.
+func parseUSMMessage(body []byte) (*usmMessage, error) {
+	m := &usmMessage{}
+
+	global, body, err := berExpect(body, berSequence)
+	if err != nil {
+		return nil, err
+	}
+	if m.msgID, global, err = berReadInt(global, berInteger); err != nil {
+		return nil, err
+	}
+	if m.maxSize, global, err = berReadInt(global, berInteger); err != nil {
+		return nil, err
+	}
+	flags, global, err := berExpect(global, berOctetString)
+	if err != nil || len(flags) != 1 {
+		return nil, errBER
+	}
+	m.flags = flags[0]
+	model, _, err := berReadInt(global, berInteger)
+	if err != nil {
+		return nil, err
+	}
+	if model != usmSecurityModel || m.flags&(usmFlagAuth|usmFlagPriv) == usmFlagPriv {
+		return nil, errBER
+	}
+
+	params, body, err := berExpect(body, berOctetString)
+	if err != nil {
+		return nil, err
+	}
+	if params, _, err = berExpect(params, berSequence); err != nil {
+		return nil, err
+	}
+	if m.engineID, params, err = berExpect(params, berOctetString); err != nil {
+		return nil, err
+	}
+	if m.boots, params, err = berReadInt(params, berInteger); err != nil {
+		return nil, err
+	}
+	if m.time, params, err = berReadInt(params, berInteger); err != nil {
+		return nil, err
+	}
+	if m.userName, params, err = berExpect(params, berOctetString); err != nil {
+		return nil, err
+	}
+	if m.authParams, params, err = berExpect(params, berOctetString); err != nil {
+		return nil, err
+	}
+	if m.privParams, _, err = berExpect(params, berOctetString); err != nil {
+		return nil, err
+	}
+
+	m.data = body
+	return m, nil
+}
+
+// handleV3 processes an SNMPv3 request, as the authoritative engine.
+func (a *SNMPAgent) handleV3(msg, body []byte) []byte {
+	m, err := parseUSMMessage(body)
+	if err != nil {
+		return nil
+	}
+
+	report := func(oid snmpOID, flags byte) []byte {
+		if m.flags&usmFlagReportable == 0 {
+			return nil
+		}
+		// The request ID is only known when the PDU is in clear.
+		var requestID int64
+		if m.flags&usmFlagPriv == 0 {
+			if pdu, err := parseScopedPDU(m.data); err == nil {
+				requestID = pdu.RequestID
+			}
+		}
+		pdu := &snmpPDU{Type: snmpReport, RequestID: requestID, VarBinds: []snmpVarBind{
+			{oid, berUint(berCounter32, uint64(a.count(oid.String())))},
+		}}
+		return a.marshalV3(m.msgID, flags, a.user, string(m.userName), a.scopedPDU(pdu))
+	}
+
+	if string(m.engineID) != string(a.engineID) {
+		// Discovery of the engine ID, boots and time by the manager.
+		return report(usmStatsUnknownEngineIDs, 0)
+	}
+	if string(m.userName) != a.user.name {
+		return report(usmStatsUnknownUserNames, 0)
+	}
+	level := m.flags & (usmFlagAuth | usmFlagPriv)
+	if level != a.user.flags() {
+		return report(usmStatsUnsupportedSecLevels, 0)
+	}
+
+	if level&usmFlagAuth != 0 {
+		if len(m.authParams) != usmAuthParamsSize {
+			return report(usmStatsWrongDigests, 0)
+		}
+		digest := append([]byte(nil), m.authParams...)
+		for i := range m.authParams {
+			m.authParams[i] = 0
+		}
+		if !hmac.Equal(digest, a.user.digest(msg)) {
+			return report(usmStatsWrongDigests, 0)
+		}
+		boots, engineTime := a.engineTime()
+		if m.boots != int64(boots) || m.time < int64(engineTime)-usmTimeWindow || m.time > int64(engineTime)+usmTimeWindow {
+			return report(usmStatsNotInTimeWindows, usmFlagAuth)
+		}
+	}
+
+	data := m.data
+	if level&usmFlagPriv != 0 {
+		encrypted, _, err := berExpect(data, berOctetString)
+		if err != nil {
+			return report(usmStatsDecryptionErrors, usmFlagAuth)
+		}
+		if data, err = a.user.decrypt(encrypted, m.privParams, uint32(m.boots), uint32(m.time)); err != nil {
+			return report(usmStatsDecryptionErrors, usmFlagAuth)
+		}
+	}
+	req, err := parseScopedPDU(data)
+	if err != nil {
+		if level&usmFlagPriv != 0 {
+			return report(usmStatsDecryptionErrors, usmFlagAuth)
+		}
+		return nil
+	}
+
+	maxSize := int(m.maxSize)
+	if maxSize > snmpMaxMessageSize {
+		maxSize = snmpMaxMessageSize
+	}
+	res := a.respond(req, maxSize-snmpHeadroom)
+	if res == nil {
+		return nil
+	}
+	return a.marshalV3(m.msgID, level, a.user, a.user.name, a.scopedPDU(res))
+}
+
+func parseScopedPDU(b []byte) (*snmpPDU, error) {
+	scoped, _, err := berExpect(b, berSequence)
+	if err != nil {
+		return nil, err
+	}
+	if _, scoped, err = berExpect(scoped, berOctetString); err != nil {
+		return nil, err
+	}
+	if _, scoped, err = berExpect(scoped, berOctetString); err != nil {
+		return nil, err
+	}
+	return parseSNMPPDU(scoped)
+}
+
+// scopedPDU returns pdu in the default context of the engine.
+func (a *SNMPAgent) scopedPDU(pdu *snmpPDU) []byte {
+	return berTLV(berSequence, berTLV(berOctetString, a.engineID), berTLV(berOctetString), pdu.marshal())
+}
+
+// engineTime returns the boots and time of the engine.
+func (a *SNMPAgent) engineTime() (uint32, uint32) {
+	return a.boots, uint32(a.now().Sub(a.start) / time.Second)
+}
+
+// usmMaxBoots is the latest snmpEngineBoots, kept once reached, see RFC
+// 3414 section 2.2.2.
+const usmMaxBoots = 2147483647
+
+// incrementBoots increments the snmpEngineBoots stored in path, 0 when the
+// file does not exist yet, and returns it. Boots must never go back, or
+// replayed messages would be accepted again, so an error is returned when
+// they cannot be stored.
+func incrementBoots(path string) (uint32, error) {
+	var boots int64
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return 0, err
+	default:
+		boots, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 32)
+		if err != nil || boots < 0 {
+			return 0, fmt.Errorf("invalid SNMP engine boots in %s: %q", path, b)
+		}
+	}
+	if boots < usmMaxBoots {
+		boots++
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	if err := writeFileSync(path, []byte(strconv.FormatInt(boots, 10)+"\n")); err != nil {
+		return 0, err
+	}
+	return uint32(boots), nil
+}
+
+// marshalV3 returns an SNMPv3 message with the security level given by
+// flags.
+func (a *SNMPAgent) marshalV3(msgID int64, flags byte, u *usmUser, userName string, scoped []byte) []byte {
+	boots, engineTime := a.engineTime()
+
+	data := scoped
+	var privParams []byte
+	if flags&usmFlagPriv != 0 {
+		a.mu.Lock()
+		a.salt++
+		salt := a.salt
+		a.mu.Unlock()
+		var encrypted []byte
+		encrypted, privParams = u.encrypt(scoped, boots, engineTime, salt)
+		data = berTLV(berOctetString, encrypted)
+	}
+	var authParams []byte
+	if flags&usmFlagAuth != 0 {
+		authParams = make([]byte, usmAuthParamsSize)
+	}
+
+	params := berTLV(berSequence,
+		berTLV(berOctetString, a.engineID),
+		berInt(berInteger, int64(boots)),
+		berInt(berInteger, int64(engineTime)),
+		berTLV(berOctetString, []byte(userName)),
+		berTLV(berOctetString, authParams),
+		berTLV(berOctetString, privParams),
+	)
+	msg := berTLV(berSequence,
+		berInt(berInteger, snmpVersion3),
+		berTLV(berSequence,
+			berInt(berInteger, msgID),
+			berInt(berInteger, snmpMaxMessageSize),
+			berTLV(berOctetString, []byte{flags}),
+			berInt(berInteger, usmSecurityModel),
+		),
+		berTLV(berOctetString, params),
+		data,
+	)
+
+	if flags&usmFlagAuth != 0 {
+		// Sign the message in place, the parsed parameters sharing its
+		// memory.
+		body, _, _ := berExpect(msg, berSequence)
+		_, body, _ = berReadInt(body, berInteger)
+		m, _ := parseUSMMessage(body)
+		copy(m.authParams, u.digest(msg))
+	}
+	return msg
+}
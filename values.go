@@ -15,6 +15,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"time"
 )
@@ -24,6 +25,45 @@ var (
 	ErrDataLength = errors.New("invalid data length")
 )
 
+// Status flags, as found in Values.Status.
+const (
+	StatusOverVoltage = 1 << iota
+	StatusOverVoltageLock
+	StatusUnderVoltage
+	StatusUnderVoltageLock
+	StatusInternalOverTemp
+	StatusChargeOverCurrent
+	StatusDischargeOverCurrent
+	StatusDischargeShortCircuit
+	StatusCellFailure
+	StatusOpenCellWire
+	StatusLowVoltageCutoff
+	StatusEEPROMFailure
+	StatusChargeFET
+	StatusEndOfCharge
+	StatusDischargeFET
+)
+
+// StatusAlarms are the status flags reporting a fault, as opposed to the
+// state of the FETs and the end of charge.
+const StatusAlarms = StatusOverVoltage | StatusOverVoltageLock | StatusUnderVoltage | StatusUnderVoltageLock |
+	StatusInternalOverTemp | StatusChargeOverCurrent | StatusDischargeOverCurrent | StatusDischargeShortCircuit |
+	StatusCellFailure | StatusOpenCellWire | StatusLowVoltageCutoff | StatusEEPROMFailure
+
+// statusFlagNames are the names given to the status flags, in bit order, by
+// the device's own interface.
+var statusFlagNames = []string{"OV", "OVLK", "UV", "UVLK", "IOT", "COC", "DOC", "DSC", "CELF", "OPEN", "LVC", "ECCF", "CFET", "EOC", "DFET"}
+
+// DecodeError reports a byte of a frame that is not valid base91.
+type DecodeError struct {
+	Offset int
+	Byte   byte
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("invalid byte %q at offset %d", e.Byte, e.Offset)
+}
+
 // Values TODO
 type Values struct {
 	Date           time.Time
@@ -56,6 +96,11 @@ func (v *Values) ReadFrom(b []byte) error {
 	if len(b) != 59 {
 		return ErrDataLength
 	}
+	for i, c := range b {
+		if c < 35 || c > 125 {
+			return &DecodeError{Offset: i, Byte: c}
+		}
+	}
 
 	v.Date = time.Date(2000+v.unpackBase91(b, 0, 1), time.Month(v.unpackBase91(b, 1, 1)), v.unpackBase91(b, 2, 1), v.unpackBase91(b, 3, 1), v.unpackBase91(b, 4, 1), v.unpackBase91(b, 5, 1), 0, time.UTC)
 	v.StateOfCharge = v.unpackBase91(b, 6, 2)
@@ -88,6 +133,28 @@ func (v *Values) ReadFrom(b []byte) error {
 	return nil
 }
 
+// BatteryVoltage returns the battery voltage, the sum of the cell voltages.
+func (v *Values) BatteryVoltage() float64 {
+	return v.Cell1Voltage + v.Cell2Voltage + v.Cell3Voltage + v.Cell4Voltage + v.Cell5Voltage + v.Cell6Voltage + v.Cell7Voltage + v.Cell8Voltage
+}
+
+// BatteryPower returns the battery power (positive means charging, negative
+// means discharging).
+func (v *Values) BatteryPower() float64 {
+	return v.BatteryCurrent * v.BatteryVoltage()
+}
+
+// StatusFlags returns the names of the flags set in Status.
+func (v *Values) StatusFlags() []string {
+	flags := []string{}
+	for i, name := range statusFlagNames {
+		if v.Status&(1<<uint(i)) != 0 {
+			flags = append(flags, name)
+		}
+	}
+	return flags
+}
+
 func (v *Values) unpackBase91(b []byte, pos, size int) int {
 	n := 0
 	for i := 0; i < size; i++ {
@@ -16,6 +16,7 @@ package main
 import (
 	"github.com/google/go-cmp/cmp"
 
+	"math"
 	"testing"
 	"time"
 )
@@ -110,3 +111,46 @@ func TestValuesReadFrom(t *testing.T) {
 		})
 	}
 }
+
+func TestValuesReadFromInvalidByte(t *testing.T) {
+	values := new(Values)
+	err := values.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I** h##+#)P####->##################%N"))
+
+	if diff := cmp.Diff(&DecodeError{Offset: 25, Byte: ' '}, err); diff != "" {
+		t.Errorf("error mismatch (-want +got):\n%s", diff)
+	}
+	if got, want := err.Error(), `invalid byte ' ' at offset 25`; got != want {
+		t.Errorf("unexpected error message: got %q, want %q", got, want)
+	}
+}
+
+func TestValuesDerived(t *testing.T) {
+	values := new(Values)
+	if err := values.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##-#)P####->##################%N(")); err != nil {
+		t.Fatalf("unexpected error: %q", err)
+	}
+
+	if got, want := values.BatteryVoltage(), 27.709; math.Abs(got-want) > 1e-9 {
+		t.Errorf("unexpected battery voltage: got %v, want %v", got, want)
+	}
+	if got, want := values.BatteryPower(), -16.376019; math.Abs(got-want) > 1e-9 {
+		t.Errorf("unexpected battery power: got %v, want %v", got, want)
+	}
+}
+
+func TestValuesStatusFlags(t *testing.T) {
+	testCases := []struct {
+		status int
+		flags  []string
+	}{
+		{status: 0, flags: []string{}},
+		{status: 20480, flags: []string{"CFET", "DFET"}},
+		{status: StatusOverVoltage | StatusUnderVoltageLock | StatusEndOfCharge, flags: []string{"OV", "UVLK", "EOC"}},
+	}
+	for _, tC := range testCases {
+		values := &Values{Status: tC.status}
+		if diff := cmp.Diff(tC.flags, values.StatusFlags()); diff != "" {
+			t.Errorf("status %d: flags mismatch (-want +got):\n%s", tC.status, diff)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webClientAuthTypes are the client certificate policies of a web
+// configuration file.
+var webClientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// webPublicPaths are served without authentication, for the probes of
+// systemd or Kubernetes.
+var webPublicPaths = map[string]bool{
+	"/-/healthy": true,
+	"/-/ready":   true,
+}
+
+// webDummyHash is compared with the passwords of unknown users, so that they
+// take as long to reject as those of known users. It is generated on first
+// use.
+var (
+	webDummyHash     []byte
+	webDummyHashOnce sync.Once
+)
+
+// WebConfig is the content of a web configuration file.
+type WebConfig struct {
+	TLS *WebTLSConfig `yaml:"tls_server_config"`
+	// Users are the bcrypt hashes of the passwords of the users allowed,
+	// keyed by name. Requests need no authentication when empty.
+	Users map[string]string `yaml:"basic_auth_users"`
+}
+
+// WebTLSConfig configures the TLS of the HTTP server.
+type WebTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientAuth is the client certificate policy, e.g.
+	// RequireAndVerifyClientCert. Certificates are verified against the
+	// ones of ClientCAFile.
+	ClientAuth   string `yaml:"client_auth_type"`
+	ClientCAFile string `yaml:"client_ca_file"`
+
+	cert      *webCert
+	clientCAs *x509.CertPool
+}
+
+// LoadWebConfigFile reads and validates a web configuration file, along
+// with the certificates it refers to. Relative paths are relative to the
+// directory of the file.
+func LoadWebConfigFile(path string) (*WebConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &WebConfig{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *WebConfig) validate(dir string) error {
+	for user, hash := range cfg.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("user %q: invalid bcrypt hash: %v", user, err)
+		}
+	}
+
+	c := cfg.TLS
+	if c == nil {
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("tls_server_config needs a cert_file and a key_file")
+	}
+	for _, path := range []*string{&c.CertFile, &c.KeyFile, &c.ClientCAFile} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	if c.ClientAuth == "" {
+		c.ClientAuth = "NoClientCert"
+	}
+	auth, ok := webClientAuthTypes[c.ClientAuth]
+	if !ok {
+		return fmt.Errorf("invalid client_auth_type %q", c.ClientAuth)
+	}
+	verify := auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert
+	switch {
+	case verify && c.ClientCAFile == "":
+		return fmt.Errorf("client_auth_type %s needs a client_ca_file", c.ClientAuth)
+	case !verify && c.ClientCAFile != "":
+		return fmt.Errorf("client_ca_file is only used by client_auth_type VerifyClientCertIfGiven or RequireAndVerifyClientCert")
+	}
+
+	c.cert = &webCert{certFile: c.CertFile, keyFile: c.KeyFile}
+	if err := c.cert.load(); err != nil {
+		return err
+	}
+	if c.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		c.clientCAs = x509.NewCertPool()
+		if !c.clientCAs.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificate found in %s", c.ClientCAFile)
+		}
+	}
+	return nil
+}
+
+// webCert is a certificate reloaded when its files change.
+type webCert struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime [2]time.Time
+}
+
+func (c *webCert) modTimes() ([2]time.Time, error) {
+	var times [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return times, err
+		}
+		times[i] = fi.ModTime()
+	}
+	return times, nil
+}
+
+func (c *webCert) load() error {
+	times, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, times
+	return nil
+}
+
+// get returns the certificate, reading its files again when they changed.
+// The previous certificate is kept when they cannot be read, e.g. while
+// being renewed.
+func (c *webCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if times, err := c.modTimes(); err == nil && times != c.modTime {
+		if err := c.load(); err != nil {
+			log.Errorln("Error reloading TLS certificate:", err)
+		} else {
+			log.Infoln("Reloaded TLS certificate", c.certFile)
+		}
+	}
+	return c.cert, nil
+}
+
+// WebServer applies a web configuration to the HTTP server: TLS on its
+// listeners and basic authentication of its requests.
+type WebServer struct {
+	mu  sync.RWMutex
+	cfg *WebConfig
+	tls *tls.Config
+	// verified caches the passwords known to match the hashes, as bcrypt
+	// takes a while by design.
+	verified map[string][sha256.Size]byte
+}
+
+// NewWebServer returns a web server applying cfg.
+func NewWebServer(cfg *WebConfig) (*WebServer, error) {
+	s := &WebServer{}
+	if err := s.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload replaces the configuration of the server, applied from the next
+// connection or request on. TLS can be neither enabled nor disabled.
+func (s *WebServer) Reload(cfg *WebConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg != nil && (s.cfg.TLS == nil) != (cfg.TLS == nil) {
+		return errors.New("enabling or disabling TLS needs a restart")
+	}
+
+	s.cfg, s.tls = cfg, nil
+	s.verified = map[string][sha256.Size]byte{}
+	if c := cfg.TLS; c != nil {
+		s.tls = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: c.cert.get,
+			ClientAuth:     webClientAuthTypes[c.ClientAuth],
+			ClientCAs:      c.clientCAs,
+		}
+	}
+	return nil
+}
+
+// Listener returns l serving TLS, if enabled.
+func (s *WebServer) Listener(l net.Listener) net.Listener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.tls == nil {
+		return l
+	}
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			return s.tls, nil
+		},
+	})
+}
+
+// Handler returns h requiring basic authentication, if users are set, but
+// for the health and readiness probes.
+func (s *WebServer) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if webPublicPaths[r.URL.Path] || s.authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="sbms_exporter", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+func (s *WebServer) authorized(r *http.Request) bool {
+	s.mu.RLock()
+	users, verified := s.cfg.Users, s.verified
+	s.mu.RUnlock()
+	if len(users) == 0 {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	hash, known := users[user]
+	if !ok {
+		return false
+	}
+	if !known {
+		webDummyHashOnce.Do(func() {
+			webDummyHash, _ = bcrypt.GenerateFromPassword([]byte("sbms_exporter"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(webDummyHash, []byte(password))
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(hash + "\x00" + password))
+	s.mu.RLock()
+	cached, hit := verified[user]
+	s.mu.RUnlock()
+	if hit && subtle.ConstantTimeCompare(cached[:], sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	s.mu.Lock()
+	verified[user] = sum
+	s.mu.Unlock()
+	return true
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testCert is a certificate and its key, signed by parent or self-signed.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	c := &testCert{key: key}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	if c.der, err = x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey); err != nil {
+		t.Fatal(err)
+	}
+	if c.cert, err = x509.ParseCertificate(c.der); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	writeConfigFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})))
+	if keyFile == "" {
+		return
+	}
+	b, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfigFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})))
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestLoadWebConfigFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newTestCert(t, "server", nil, x509.ExtKeyUsageServerAuth).write(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	path := filepath.Join(dir, "web.yml")
+
+	for _, tC := range []struct {
+		desc    string
+		content string
+		err     string
+	}{
+		{"unknown", `tls_config: {}`, `field tls_config not found`},
+		{"hash", `basic_auth_users: {alice: secret}`, `user "alice": invalid bcrypt hash`},
+		{"no key", `tls_server_config: {cert_file: server.crt}`, `needs a cert_file and a key_file`},
+		{"missing cert", `tls_server_config: {cert_file: other.crt, key_file: server.key}`, `no such file`},
+		{"client auth", `tls_server_config: {cert_file: server.crt, key_file: server.key, client_auth_type: Always}`, `invalid client_auth_type "Always"`},
+		{"no ca", `tls_server_config: {cert_file: server.crt, key_file: server.key, client_auth_type: RequireAndVerifyClientCert}`, `needs a client_ca_file`},
+		{"unused ca", `tls_server_config: {cert_file: server.crt, key_file: server.key, client_ca_file: server.crt}`, `client_ca_file is only used`},
+		{"invalid ca", `tls_server_config: {cert_file: server.crt, key_file: server.key, client_auth_type: VerifyClientCertIfGiven, client_ca_file: server.key}`, `no certificate found`},
+	} {
+		t.Run(tC.desc, func(t *testing.T) {
+			writeConfigFile(t, path, tC.content)
+			_, err := LoadWebConfigFile(path)
+			if err == nil || !strings.Contains(err.Error(), tC.err) {
+				t.Errorf("got error %v, want %q", err, tC.err)
+			}
+		})
+	}
+}
+
+func TestWebServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	ca.write(t, filepath.Join(dir, "ca.crt"), "")
+	server := newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth)
+	server.write(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	client := newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "web.yml")
+	writeConfigFile(t, path, `
+tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+basic_auth_users:
+  alice: `+string(hash)+"\n")
+
+	cfg, err := LoadWebConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewWebServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))}
+	go srv.Serve(s.Listener(l))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	var peer *x509.Certificate
+	get := func(path, user, password string, certs ...tls.Certificate) (int, error) {
+		t.Helper()
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		req, _ := http.NewRequest("GET", "https://"+l.Addr().String()+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		peer = res.TLS.PeerCertificates[0]
+		return res.StatusCode, nil
+	}
+	ensure := func(path, user, password string, want int) {
+		t.Helper()
+		if code, err := get(path, user, password, client.tls()); err != nil || code != want {
+			t.Errorf("GET %s as %q: got status %d and error %v, want %d", path, user, code, err, want)
+		}
+	}
+
+	if _, err := get("/metrics", "alice", "secret"); err == nil {
+		t.Error("got no error without a client certificate")
+	}
+	ensure("/metrics", "alice", "secret", http.StatusOK)
+	ensure("/metrics", "alice", "secret", http.StatusOK) // cached
+	ensure("/metrics", "alice", "wrong", http.StatusUnauthorized)
+	ensure("/metrics", "bob", "secret", http.StatusUnauthorized)
+	if webDummyHash == nil {
+		t.Error("unknown users are not checked against the dummy hash")
+	}
+	ensure("/api/v1/values", "", "", http.StatusUnauthorized)
+	ensure("/-/healthy", "", "", http.StatusOK)
+	ensure("/-/ready", "", "", http.StatusOK)
+
+	// Renewed certificates are used by the next connections.
+	renewed := newTestCert(t, "renewed", ca, x509.ExtKeyUsageServerAuth)
+	renewed.write(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{"server.crt", "server.key"} {
+		if err := os.Chtimes(filepath.Join(dir, name), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ensure("/metrics", "alice", "secret", http.StatusOK)
+	if peer == nil || peer.Subject.CommonName != "renewed" {
+		t.Errorf("got server certificate %v, want the renewed one", peer.Subject)
+	}
+
+	// Reloads apply to the next requests, but cannot disable TLS.
+	writeConfigFile(t, path, `
+tls_server_config: {cert_file: server.crt, key_file: server.key}
+`)
+	if cfg, err = LoadWebConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if code, err := get("/metrics", "", ""); err != nil || code != http.StatusOK {
+		t.Errorf("got status %d and error %v after the reload, want 200", code, err)
+	}
+	if err := s.Reload(&WebConfig{}); err == nil {
+		t.Error("got no error disabling TLS")
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// Webhook events.
+const (
+	WebhookUp           = "up"
+	WebhookDown         = "down"
+	WebhookDisconnected = "disconnected"
+	WebhookStatus       = "status"
+)
+
+// DefaultWebhookTemplate is the payload sent when no template is configured.
+const DefaultWebhookTemplate = `{"event":{{json .Event}},"text":{{json .Text}},"time":{{json .Time}},"up":{{.Up}},"status":{{.Status}},"flags":{{json .Flags}}}`
+
+// WebhookConfig configures a WebhookNotifier.
+type WebhookConfig struct {
+	URLs []string
+	// Template is the text/template of the payloads, executed with a
+	// WebhookEvent.
+	Template string
+	Timeout  time.Duration
+	// Retries is the number of times a failed delivery is retried, with an
+	// exponential backoff.
+	Retries int
+	// DedupWindow is the time during which an event identical to the last
+	// one delivered to a URL is not sent again.
+	DedupWindow time.Duration
+	// At most RateLimit notifications are sent every RatePeriod, the others
+	// being dropped. Zero disables rate limiting.
+	RateLimit  int
+	RatePeriod time.Duration
+	// DownAfter is the time the device must keep sending lines that cannot
+	// be decoded before it is notified down, so that a garbled line does
+	// not notify it down and up again. Zero notifies it at once.
+	DownAfter time.Duration
+}
+
+// WebhookEvent is a transition of the device or of the exporter, as given
+// to the payload template.
+type WebhookEvent struct {
+	// Event is one of up, down, disconnected and status.
+	Event string
+	// Text describes the event in plain words.
+	Text string
+	Time time.Time
+	Up   bool
+	// Status and Flags are the status word and its flags, and Set and
+	// Cleared the flags which changed, as of the last decoded frame.
+	Status  int
+	Flags   []string
+	Set     []string
+	Cleared []string
+	// Values is the last decoded frame, nil before the first one.
+	Values *Values
+	// Error is the error which stopped the reading of the serial port.
+	Error string
+}
+
+// key identifies the event for deduplication.
+func (e *WebhookEvent) key() string {
+	if e.Event == WebhookStatus {
+		return e.Event + ":" + strings.Join(e.Flags, ",")
+	}
+	return e.Event
+}
+
+// WebhookNotifier POSTs a templated payload to every URL when the device
+// goes up or down, when the serial port disconnects and when the status
+// bits of the device change.
+type WebhookNotifier struct {
+	mu      sync.Mutex
+	cfg     WebhookConfig
+	tmpl    *template.Template
+	client  *http.Client
+	now     func() time.Time
+	sleep   func(time.Duration)
+	after   func(time.Duration) <-chan time.Time
+	targets []*webhookTarget
+	sent    []time.Time
+}
+
+type webhookTarget struct {
+	url      string
+	lastKey  string
+	lastSent time.Time
+}
+
+// NewWebhookNotifier returns a notifier for cfg, failing when its template
+// does not parse.
+func NewWebhookNotifier(cfg WebhookConfig) (*WebhookNotifier, error) {
+	n := &WebhookNotifier{now: time.Now, sleep: time.Sleep, after: time.After}
+	if err := n.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Reload replaces the configuration of the notifier, failing when its
+// template does not parse. URLs kept keep their deduplication state.
+func (n *WebhookNotifier) Reload(cfg WebhookConfig) error {
+	if cfg.Template == "" {
+		cfg.Template = DefaultWebhookTemplate
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"join": strings.Join,
+	}).Parse(cfg.Template)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	old := map[string]*webhookTarget{}
+	for _, t := range n.targets {
+		old[t.url] = t
+	}
+	n.targets = nil
+	for _, u := range cfg.URLs {
+		t := old[u]
+		if t == nil {
+			t = &webhookTarget{url: u}
+		}
+		n.targets = append(n.targets, t)
+	}
+	n.cfg, n.tmpl, n.client = cfg, tmpl, &http.Client{Timeout: cfg.Timeout}
+	return nil
+}
+
+// Run notifies the transitions of the states received from sub until it is
+// closed. The device is considered down until the first state. Payloads are
+// delivered in the background, in order, so that slow endpoints do not hold
+// up the states.
+func (n *WebhookNotifier) Run(sub *Subscription) {
+	deliveries := make(chan *webhookDelivery, outputBuffer)
+	delivered := make(chan struct{})
+	go func() {
+		for d := range deliveries {
+			n.deliver(d)
+		}
+		close(delivered)
+	}()
+	defer func() {
+		close(deliveries)
+		<-delivered
+	}()
+	notify := func(e *WebhookEvent) {
+		d := n.prepare(e)
+		if d == nil {
+			return
+		}
+		select {
+		case deliveries <- d:
+		default:
+			log.Warnf("Dropping webhook notification %q, %d already waiting to be delivered", e.Text, len(deliveries))
+		}
+	}
+
+	up, status := false, 0
+	var last *Values
+	// down fires once the device was down for DownAfter, nil when it is
+	// not going down.
+	var down <-chan time.Time
+	event := func(up bool) *WebhookEvent {
+		e := &WebhookEvent{Time: n.now(), Up: up}
+		if last != nil {
+			e.Values = last
+			e.Status, e.Flags = last.Status, last.StatusFlags()
+		}
+		return e
+	}
+
+	for {
+		var st State
+		select {
+		case s, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			st = s
+		case <-down:
+			down, up = nil, false
+			e := event(false)
+			e.Event, e.Text = WebhookDown, "SBMS is down"
+			notify(e)
+			continue
+		}
+		if st.Up {
+			v := st.Values
+			last = &v
+		}
+		e := event(st.Up)
+
+		switch {
+		case st.Err == context.Canceled || st.Err == io.EOF:
+			// The exporter is shutting down or the replayed file ended,
+			// not a disconnection.
+		case st.Err != nil:
+			e.Event, e.Error = WebhookDisconnected, st.Err.Error()
+			e.Text = "SBMS serial port disconnected: " + e.Error
+		case !st.Up && up:
+			if down != nil {
+				continue
+			}
+			n.mu.Lock()
+			after := n.cfg.DownAfter
+			n.mu.Unlock()
+			if after > 0 {
+				down = n.after(after)
+				continue
+			}
+			e.Event, e.Text = WebhookDown, "SBMS is down"
+		case st.Up && !up:
+			e.Event = WebhookUp
+			e.Text = fmt.Sprintf("SBMS is up, state of charge %d%%", st.Values.StateOfCharge)
+		case st.Up && st.Values.Status != status:
+			e.Event = WebhookStatus
+			e.Set = statusFlagNamesOf(st.Values.Status &^ status)
+			e.Cleared = statusFlagNamesOf(status &^ st.Values.Status)
+			e.Text = "SBMS status changed:"
+			for _, f := range e.Set {
+				e.Text += " +" + f
+			}
+			for _, f := range e.Cleared {
+				e.Text += " -" + f
+			}
+		}
+		up, down = st.Up, nil
+		if st.Up {
+			status = st.Values.Status
+		}
+
+		if e.Event != "" {
+			notify(e)
+		}
+	}
+}
+
+// statusFlagNamesOf returns the names of the flags set in status.
+func statusFlagNamesOf(status int) []string {
+	return (&Values{Status: status}).StatusFlags()
+}
+
+// webhookDelivery is a payload to deliver to targets.
+type webhookDelivery struct {
+	text    string
+	key     string
+	time    time.Time
+	body    []byte
+	targets []*webhookTarget
+	client  *http.Client
+	retries int
+}
+
+// notify delivers the payload of e, if it is neither a duplicate nor rate
+// limited.
+func (n *WebhookNotifier) notify(e *WebhookEvent) {
+	if d := n.prepare(e); d != nil {
+		n.deliver(d)
+	}
+}
+
+// prepare returns the delivery of the payload of e to the targets it is not
+// a duplicate for, or nil when there is none or when it is rate limited.
+func (n *WebhookNotifier) prepare(e *WebhookEvent) *webhookDelivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	d := &webhookDelivery{text: e.Text, key: e.key(), time: n.now(), client: n.client, retries: n.cfg.Retries}
+	for _, t := range n.targets {
+		if d.key == t.lastKey && d.time.Sub(t.lastSent) < n.cfg.DedupWindow {
+			log.Debugf("Skipping duplicate webhook notification %q to %s", e.Text, t.url)
+			continue
+		}
+		d.targets = append(d.targets, t)
+	}
+	if len(d.targets) == 0 {
+		return nil
+	}
+
+	if n.cfg.RateLimit > 0 {
+		for len(n.sent) > 0 && d.time.Sub(n.sent[0]) >= n.cfg.RatePeriod {
+			n.sent = n.sent[1:]
+		}
+		if len(n.sent) >= n.cfg.RateLimit {
+			log.Warnf("Dropping webhook notification %q, %d already sent in the last %v", e.Text, len(n.sent), n.cfg.RatePeriod)
+			return nil
+		}
+		n.sent = append(n.sent, d.time)
+	}
+
+	var body bytes.Buffer
+	if err := n.tmpl.Execute(&body, e); err != nil {
+		log.Errorln("Error executing webhook template:", err)
+		return nil
+	}
+	d.body = body.Bytes()
+	return d
+}
+
+// deliver sends d to its targets, without holding the lock of the notifier
+// so that reloads do not wait for slow endpoints.
+func (n *WebhookNotifier) deliver(d *webhookDelivery) {
+	for _, t := range d.targets {
+		if err := n.post(d, t.url); err != nil {
+			log.Errorf("Error sending webhook notification to %s: %v", t.url, err)
+			continue
+		}
+		n.mu.Lock()
+		t.lastKey, t.lastSent = d.key, d.time
+		n.mu.Unlock()
+	}
+}
+
+// post POSTs the body of d to url, retrying with an exponential backoff.
+func (n *WebhookNotifier) post(d *webhookDelivery, url string) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := n.send(d.client, url, d.body)
+		if err == nil || !retry || attempt >= d.retries {
+			return err
+		}
+		log.Debugf("Error sending webhook notification to %s, retrying in %v: %v", url, backoff, err)
+		n.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// send POSTs body and tells, on failure, whether it should be retried.
+func (n *WebhookNotifier) send(client *http.Client, url string, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode/100 == 5:
+		return true, fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(b))
+	default:
+		return false, fmt.Errorf("server returned %s: %s", res.Status, bytes.TrimSpace(b))
+	}
+}
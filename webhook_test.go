@@ -0,0 +1,214 @@
+// Copyright 2019 Mike Gleason jr Couturier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// webhookServer records the payloads it receives, failing the first fail
+// requests.
+type webhookServer struct {
+	mu       sync.Mutex
+	fail     int
+	payloads []string
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	s.payloads = append(s.payloads, r.Header.Get("Content-Type")+" "+string(b))
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	s := &webhookServer{fail: 1}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	n, err := NewWebhookNotifier(WebhookConfig{URLs: []string{srv.URL}, Timeout: time.Second, Retries: 1, DownAfter: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.now = func() time.Time { return time.Date(2019, 11, 14, 12, 0, 0, 0, time.UTC) }
+	var slept []time.Duration
+	n.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	v := new(Values)
+	if err := v.ReadFrom([]byte("3';2LD$,I)I*I+I+H}I%I+I**h##+#)P####->##################%N(")); err != nil {
+		t.Fatal(err)
+	}
+	alarm := *v
+	alarm.Status = alarm.Status&^StatusChargeFET | StatusOverVoltage
+
+	armed := make(chan chan time.Time)
+	n.after = func(d time.Duration) <-chan time.Time {
+		if d != time.Minute {
+			t.Errorf("got down delay %v, want 1m", d)
+		}
+		c := make(chan time.Time)
+		armed <- c
+		return c
+	}
+
+	hub := NewHub()
+	sub := hub.Subscribe(outputBuffer)
+	done := make(chan struct{})
+	go func() {
+		n.Run(sub)
+		close(done)
+	}()
+	publish := func(states ...State) {
+		for _, st := range states {
+			hub.Publish(st)
+		}
+	}
+	publish(
+		State{Up: true, Values: *v},
+		State{Up: true, Values: *v},
+		State{Up: true, Values: alarm},
+		// A garbled line is no transition.
+		State{Up: false, Values: alarm},
+		State{Up: true, Values: alarm},
+		State{Up: false, Values: alarm},
+		State{Up: false, Values: alarm},
+	)
+	<-armed
+	(<-armed) <- time.Time{}
+	publish(
+		State{Up: false, Values: alarm},
+		State{Up: true, Values: alarm},
+		State{Up: false, Values: alarm, Err: errors.New("read /dev/ttyUSB0: input/output error")},
+		// Neither shutting down nor the end of a replay is a disconnection.
+		State{Up: false, Values: alarm, Err: context.Canceled},
+		State{Up: false, Values: alarm, Err: io.EOF},
+	)
+	hub.Close()
+	<-done
+
+	want := []string{
+		`application/json {"event":"up","text":"SBMS is up, state of charge 100%","time":"2019-11-14T12:00:00Z","up":true,"status":20480,"flags":["CFET","DFET"]}`,
+		`application/json {"event":"status","text":"SBMS status changed: +OV -CFET","time":"2019-11-14T12:00:00Z","up":true,"status":16385,"flags":["OV","DFET"]}`,
+		`application/json {"event":"down","text":"SBMS is down","time":"2019-11-14T12:00:00Z","up":false,"status":16385,"flags":["OV","DFET"]}`,
+		`application/json {"event":"up","text":"SBMS is up, state of charge 100%","time":"2019-11-14T12:00:00Z","up":true,"status":16385,"flags":["OV","DFET"]}`,
+		`application/json {"event":"disconnected","text":"SBMS serial port disconnected: read /dev/ttyUSB0: input/output error","time":"2019-11-14T12:00:00Z","up":false,"status":16385,"flags":["OV","DFET"]}`,
+	}
+	if diff := cmp.Diff(want, s.payloads); diff != "" {
+		t.Errorf("payloads mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]time.Duration{time.Second}, slept); diff != "" {
+		t.Errorf("backoff mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWebhookNotifierSlowEndpoint(t *testing.T) {
+	s := &webhookServer{fail: 1}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	cfg := WebhookConfig{URLs: []string{srv.URL}, Timeout: time.Second, Retries: 1}
+	n, err := NewWebhookNotifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleeping, release := make(chan struct{}), make(chan struct{})
+	n.sleep = func(time.Duration) {
+		close(sleeping)
+		<-release
+	}
+	done := make(chan struct{})
+	go func() {
+		n.notify(&WebhookEvent{Event: WebhookDown})
+		close(done)
+	}()
+
+	// Reloads do not wait for the retries of a delivery.
+	<-sleeping
+	reloaded := make(chan error)
+	go func() { reloaded <- n.Reload(cfg) }()
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload waited for the delivery")
+	}
+	close(release)
+	<-done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.payloads) != 1 {
+		t.Errorf("got %d payloads delivered, want 1", len(s.payloads))
+	}
+}
+
+func TestWebhookNotifierLimits(t *testing.T) {
+	s := &webhookServer{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	n, err := NewWebhookNotifier(WebhookConfig{
+		URLs:        []string{srv.URL},
+		Template:    `{{.Event}}{{range .Set}} +{{.}}{{end}}`,
+		Timeout:     time.Second,
+		DedupWindow: 5 * time.Minute,
+		RateLimit:   3,
+		RatePeriod:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2019, 11, 14, 12, 0, 0, 0, time.UTC)
+	for _, e := range []struct {
+		after time.Duration
+		event WebhookEvent
+	}{
+		{0, WebhookEvent{Event: WebhookDown}},
+		{time.Minute, WebhookEvent{Event: WebhookDown}}, // duplicate
+		{2 * time.Minute, WebhookEvent{Event: WebhookStatus, Flags: []string{"UV"}, Set: []string{"UV"}}},
+		{10 * time.Minute, WebhookEvent{Event: WebhookStatus, Flags: []string{"UV"}, Set: []string{"UV"}}}, // reminder
+		{11 * time.Minute, WebhookEvent{Event: WebhookUp}},                                                 // rate limited
+		{61 * time.Minute, WebhookEvent{Event: WebhookUp}},
+	} {
+		n.now = func() time.Time { return start.Add(e.after) }
+		event := e.event
+		n.notify(&event)
+	}
+
+	want := []string{"application/json down", "application/json status +UV", "application/json status +UV", "application/json up"}
+	if diff := cmp.Diff(want, s.payloads); diff != "" {
+		t.Errorf("payloads mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := NewWebhookNotifier(WebhookConfig{Template: "{{.Event"}); err == nil {
+		t.Error("expected a template error")
+	}
+}